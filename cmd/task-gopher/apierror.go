@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Errors of the API are sent as {"error": {"code": ..., "message": ..., "field": ...}}, with the status that fits them:
+// 400 for malformed requests, 401 and 403 for missing or insufficient tokens, 422 for invalid values,
+// 404 for missing resources, 409 for conflicts with the tasks and 429 for clients over their rate.
+const (
+	codeInvalidRequest       = "invalid_request"        // the request is malformed, e.g. its body is not JSON
+	codeInvalidValue         = "invalid_value"          // a value of the request is invalid, see the field
+	codeInvalidQuery         = "invalid_query"          // a filter or a query parameter is invalid
+	codeUnauthorized         = "unauthorized"           // the request has no valid API token
+	codeForbidden            = "forbidden"              // the scope of the token doesn't allow the request
+	codeNotFound             = "not_found"              // the resource doesn't exist
+	codeVersionConflict      = "version_conflict"       // the task changed since the version the update is based on
+	codeWIPLimit             = "wip_limit"              // a status is at its work-in-progress limit
+	codeTransition           = "transition_not_allowed" // the workflow doesn't allow a status change
+	codePreconditionRequired = "precondition_required"  // the update needs an If-Match header
+	codeRateLimited          = "rate_limited"           // the client sent too many requests, see the Retry-After header
+	codeInternal             = "internal"               // something went wrong on the server
+)
+
+// An APIError is an error response of the API
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"` // the value of the request the error is about, if any
+	cause   error  // the error behind an internal error, logged by the server
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// newAPIError returns an error response with a status code, an error code and a message
+func newAPIError(status int, code, msg string) *APIError {
+	return &APIError{Status: status, Code: code, Message: msg}
+}
+
+// internalError returns the response for an error of the server, the cause is only logged
+func internalError(msg string, cause error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: codeInternal, Message: msg, cause: cause}
+}
+
+// notFound returns the response for a missing resource
+func notFound(msg string) *APIError {
+	return newAPIError(http.StatusNotFound, codeNotFound, msg)
+}
+
+// errorResponse is the body of an error response
+type errorResponse struct {
+	Error   *APIError `json:"error"`
+	Current *Task     `json:"current,omitempty"` // the current task, when an update conflicts with it
+}
+
+// A fieldError reports an invalid value of a request, e.g. an unknown status
+type fieldError struct {
+	Field string // the key of the value in the request, e.g. Status or Fields.estimate
+	Err   error
+}
+
+func (e *fieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.Err
+}
+
+// toAPIError returns the error response for an error of a handler
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	var fieldErr *fieldError
+	var queryErr *queryError
+	var wipErr *wipLimitError
+	var transErr *transitionError
+	var conflictErr *conflictError
+	var httpErr *echo.HTTPError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.As(err, &fieldErr):
+		return &APIError{Status: http.StatusUnprocessableEntity, Code: codeInvalidValue, Message: fieldErr.Error(), Field: fieldErr.Field}
+	case errors.As(err, &queryErr):
+		return newAPIError(http.StatusBadRequest, codeInvalidQuery, queryErr.Error())
+	case errors.As(err, &wipErr):
+		return newAPIError(http.StatusConflict, codeWIPLimit, wipErr.Error()+", use force to override")
+	case errors.As(err, &transErr):
+		return newAPIError(http.StatusConflict, codeTransition, transErr.Error())
+	case errors.As(err, &conflictErr):
+		return newAPIError(http.StatusConflict, codeVersionConflict, fmt.Sprintf("Task %v was changed by someone else, it is now at version %v", conflictErr.Current.ID, conflictErr.Current.Version))
+	case errors.Is(err, errVersionConflict):
+		return newAPIError(http.StatusConflict, codeVersionConflict, err.Error())
+	case errors.Is(err, sql.ErrNoRows):
+		return newAPIError(http.StatusNotFound, codeNotFound, "Not found")
+	case errors.As(err, &httpErr):
+		// e.g. unknown routes, named after their status like method_not_allowed
+		code := strings.ReplaceAll(strings.ToLower(http.StatusText(httpErr.Code)), " ", "_")
+		return newAPIError(httpErr.Code, code, fmt.Sprint(httpErr.Message))
+	}
+	return internalError("Internal server error", err)
+}
+
+// handleHTTPError is the error handler of the server, it sends errors as JSON error responses
+func handleHTTPError(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	apiErr := toAPIError(err)
+	if apiErr.cause != nil {
+		log.Println(c.Request().Method, c.Request().URL, apiErr.Message+":", apiErr.cause)
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.Status)
+	} else {
+		err = c.JSON(apiErr.Status, errorResponse{Error: apiErr})
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// decodeBody decodes the JSON body of a request into v, which must have all the values of the body
+func decodeBody(c echo.Context, v interface{}) error {
+	return decodeJSON(c.Request().Body, v)
+}
+
+// decodeJSON decodes a JSON object into v like decodeBody, e.g. a request sent over a websocket
+func decodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, io.EOF):
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "You must provide a request body")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &fieldError{typeErr.Field, fmt.Errorf("%v must be of type %v", typeErr.Field, jsonType(typeErr.Type.Kind().String()))}
+	case errors.As(err, &typeErr):
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "The request body must be a JSON object")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// the decoder has no error type for unknown fields
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return &fieldError{name, fmt.Errorf("unknown value %q", name)}
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidRequest, "The request body must be valid JSON: "+err.Error())
+}
+
+// jsonType returns the JSON name of a Go kind, e.g. number for int64
+func jsonType(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "map", kind == "struct":
+		return "object"
+	case kind == "slice":
+		return "array"
+	case kind == "bool":
+		return "boolean"
+	}
+	return kind
+}
+
+// readError returns the error of a response that is not OK, with the message of the server
+func readError(res *http.Response) error {
+	msg, _ := io.ReadAll(res.Body)
+	var body errorResponse
+	if json.Unmarshal(msg, &body) == nil && body.Error != nil {
+		body.Error.Status = res.StatusCode
+		return body.Error
+	}
+	return fmt.Errorf("%v: %s", res.Status, strings.TrimSpace(string(msg)))
+}
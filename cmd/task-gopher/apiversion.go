@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiVersion is the version of the API this server serves under /api/<version>, and this client uses
+// A change to the JSON of the API that breaks the clients needs a new version.
+const apiVersion = "v1"
+
+// apiPrefix is where the routes of apiVersion are mounted
+const apiPrefix = "/api/" + apiVersion
+
+// APIVersions tells the clients which versions of the API a server has, it is returned by GET /api
+type APIVersions struct {
+	Versions []string // oldest first
+}
+
+// serverAPIVersions are the versions of the API this server has
+var serverAPIVersions = APIVersions{Versions: []string{apiVersion}}
+
+// handleGetAPIVersions returns the versions of the API the server has
+func handleGetAPIVersions(c echo.Context) error {
+	return c.JSON(http.StatusOK, serverAPIVersions)
+}
+
+// deprecated marks the responses of a deprecated route, one at the root from before the API was versioned
+// The Link header points to its successor under apiPrefix.
+func deprecated(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := c.Response().Header()
+		h.Set("Deprecation", "true")
+		h.Add("Link", "<"+apiPrefix+c.Request().URL.RequestURI()+`>; rel="successor-version"`)
+		return next(c)
+	}
+}
+
+var (
+	// apiBase is the prefix of the routes of the server the client uses, see negotiateAPI
+	apiBase   = apiPrefix
+	negotiate sync.Once
+)
+
+// serverURL returns the URL of a route of the API on the server, path starting with a slash
+// The version of the API is negotiated with the server on first use.
+func serverURL(path string) string {
+	root := os.Getenv("ADDRESS") + ":" + os.Getenv("PORT")
+	negotiate.Do(func() {
+		var warning string
+		apiBase, warning = negotiateAPI(root)
+		if warning != "" {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		}
+	})
+	return root + apiBase + path
+}
+
+// negotiateAPI returns the prefix of the routes of the server at root to use, and a warning if the server doesn't have apiVersion
+func negotiateAPI(root string) (base, warning string) {
+	res, err := apiClient.Get(root + "/api")
+	if err != nil {
+		// the request that follows reports it
+		return apiPrefix, ""
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		// a server from before the API was versioned only has the routes at the root
+		return "", "the server is older than this client and may not understand it, update the server"
+	}
+	var versions APIVersions
+	if res.StatusCode != http.StatusOK || json.NewDecoder(res.Body).Decode(&versions) != nil {
+		return apiPrefix, fmt.Sprintf("could not get the API versions of the server (%v)", res.Status)
+	}
+	for _, v := range versions.Versions {
+		if v == apiVersion {
+			return apiPrefix, ""
+		}
+	}
+	update := "the client"
+	if n := len(versions.Versions); n == 0 || versionNumber(versions.Versions[n-1]) < versionNumber(apiVersion) {
+		update = "the server"
+	}
+	return apiPrefix, fmt.Sprintf("the server has API versions %v but this client needs %v, update %v", versions.Versions, apiVersion, update)
+}
+
+// versionNumber returns the number of an API version like v1
+func versionNumber(v string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(v, "v"))
+	return n
+}
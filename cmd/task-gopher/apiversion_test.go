@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateAPI(t *testing.T) {
+	var tests = []struct {
+		name        string
+		status      int
+		body        string
+		wantBase    string
+		wantWarning string
+	}{
+		{"same version", http.StatusOK, `{"Versions": ["v1"]}`, apiPrefix, ""},
+		{"newer server", http.StatusOK, `{"Versions": ["v1", "v2"]}`, apiPrefix, ""},
+		{"server without the version", http.StatusOK, `{"Versions": ["v2", "v3"]}`, apiPrefix, "update the client"},
+		{"server older than the version", http.StatusOK, `{"Versions": ["v0"]}`, apiPrefix, "update the server"},
+		{"server from before versions", http.StatusNotFound, ``, "", "update the server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api" {
+					t.Errorf("got request for %v, want /api", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			base, warning := negotiateAPI(server.URL)
+			if base != tt.wantBase {
+				t.Errorf("got base %q, want %q", base, tt.wantBase)
+			}
+			if (warning == "") != (tt.wantWarning == "") || !strings.Contains(warning, tt.wantWarning) {
+				t.Errorf("got warning %q, want one with %q", warning, tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// scopes of the API tokens
+const (
+	scopeRead  = "read"  // read the tasks, fields, templates and views, and get notified of changes
+	scopeWrite = "write" // also change them
+)
+
+// tokenPrefix starts every API token, so they are easy to recognize, e.g. in a leaked file
+const tokenPrefix = "tg_"
+
+// A Token gives a client access to the API, only the hash of its secret is kept by the server
+type Token struct {
+	Name    string    // unique token name, e.g. the device it was made for
+	Scope   string    // what the token allows, scopeRead or scopeWrite
+	Created time.Time // timestamp of when the token was created
+}
+
+// validate checks that a token has a name and a known scope
+func (t Token) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("token name must not be empty")
+	}
+	if strings.ContainsAny(t.Name, " \t\n/") {
+		return fmt.Errorf("token name %q must not contain spaces or '/'", t.Name)
+	}
+	if t.Scope != scopeRead && t.Scope != scopeWrite {
+		return fmt.Errorf("unknown scope %q (expected %v or %v)", t.Scope, scopeRead, scopeWrite)
+	}
+	return nil
+}
+
+// allows reports whether the token may send a request with a given method
+func (t Token) allows(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return t.Scope == scopeWrite
+}
+
+// hashToken returns the hash of the secret of a token, as stored in the database
+// The secrets are random, so a fast hash is enough to keep them from being read back.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createToken adds a token to the database and returns its secret, which can't be recovered later
+func createToken(db *sql.DB, t Token) (string, error) {
+	if err := t.validate(); err != nil {
+		return "", err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	sqlStatement := `INSERT INTO tokens(name, hash, scope, created) values (?, ?, ?, ?);`
+	_, err := db.Exec(sqlStatement, t.Name, hashToken(secret), t.Scope, t.Created.UTC().Format(time.RFC3339))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return "", fmt.Errorf("a token named %q already exists", t.Name)
+	}
+	return secret, err
+}
+
+// revokeToken deletes a token from the database, the clients using it lose their access
+func revokeToken(db *sql.DB, name string) error {
+	res, err := db.Exec(`DELETE FROM tokens WHERE name = ?;`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// getTokens returns all the tokens, sorted by name
+func getTokens(db *sql.DB) ([]Token, error) {
+	rows, err := db.Query(`SELECT name, scope, created FROM tokens ORDER BY name ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens = []Token{}
+	for rows.Next() {
+		var t Token
+		var created string
+		if err := rows.Scan(&t.Name, &t.Scope, &created); err != nil {
+			return nil, err
+		}
+		if t.Created, err = time.Parse(time.RFC3339, created); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// lookupToken returns the token with a given secret, sql.ErrNoRows if there is none
+func lookupToken(db *sql.DB, secret string) (Token, error) {
+	var t Token
+	var created string
+	err := db.QueryRow(`SELECT name, scope, created FROM tokens WHERE hash = ?;`, hashToken(secret)).Scan(&t.Name, &t.Scope, &created)
+	if err != nil {
+		return t, err
+	}
+	t.Created, err = time.Parse(time.RFC3339, created)
+	return t, err
+}
+
+// authenticate only lets through the requests of an enrolled device, with its certificate, or with a valid token,
+// in the Authorization header as "Bearer <token>".
+// Browsers can't set headers on WebSocket requests, so the websockets of /ws and /graphql also take the token
+// as the access_token query parameter.
+// The device or the token is stored in the context under "device" or "token".
+func authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		d, ok, err := requestDevice(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if !(Token{Scope: d.Scope}).allows(scopeMethod(c)) {
+				return newAPIError(http.StatusForbidden, codeForbidden, fmt.Sprintf("The device %v has the %v scope, which doesn't allow changes", d.Name, d.Scope))
+			}
+			c.Set("device", d)
+			return next(c)
+		}
+		secret, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok && (strings.HasSuffix(c.Path(), "/ws") || strings.HasSuffix(c.Path(), "/graphql") && c.IsWebSocket()) {
+			secret = c.QueryParam("access_token")
+		}
+		if secret == "" {
+			return unauthorized(c, "You must provide an API token")
+		}
+		t, err := lookupToken(db, strings.TrimSpace(secret))
+		if err == sql.ErrNoRows {
+			return unauthorized(c, "The API token is invalid or was revoked")
+		}
+		if err != nil {
+			return internalError("Could not check the API token", err)
+		}
+		if !t.allows(scopeMethod(c)) {
+			return newAPIError(http.StatusForbidden, codeForbidden, fmt.Sprintf("The token %v has the %v scope, which doesn't allow changes", t.Name, t.Scope))
+		}
+		c.Set("token", t)
+		return next(c)
+	}
+}
+
+// scopeMethod returns the method a request is allowed by, see Token.allows
+// GraphQL queries are POSTed too, so the resolvers of the mutations check the scope instead.
+func scopeMethod(c echo.Context) string {
+	if strings.HasSuffix(c.Path(), "/graphql") {
+		return http.MethodGet
+	}
+	return c.Request().Method
+}
+
+// redactToken hides the access_token query parameter of a URI, to keep the tokens out of the logs
+func redactToken(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil || !u.Query().Has("access_token") {
+		return uri
+	}
+	q := u.Query()
+	q.Set("access_token", "REDACTED")
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// unauthorized returns the response for a request without a valid token
+func unauthorized(c echo.Context, msg string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="task-gopher"`)
+	return newAPIError(http.StatusUnauthorized, codeUnauthorized, msg)
+}
+
+// handleGetToken returns the token of the request, so clients can check it
+func handleGetToken(c echo.Context) error {
+	t, ok := c.Get("token").(Token)
+	if !ok {
+		return notFound("The request has no API token")
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+// apiClient sends the requests of the CLI to the server, with the token of the client config
+// and checking the certificate of servers using TLS with verifyServer.
+var apiClient = &http.Client{Transport: &tokenTransport{base: apiTransport()}}
+
+// apiTransport returns the default transport with the TLS dialer of the CLI
+func apiTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialTLSContext = dialTLS
+	return t
+}
+
+// A tokenTransport adds the token of the client config to the requests that don't have one, and the client ID
+// of the process, which tags the events of its changes, see checkClientID
+type tokenTransport struct {
+	base     http.RoundTripper
+	once     sync.Once
+	token    string
+	clientID string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(func() {
+		// a config that can't be read is reported by the commands that use it
+		cfg, _ := loadClientConfig()
+		t.token = cfg.Token
+		t.clientID = "cli-" + newClientID()
+	})
+	req = req.Clone(req.Context())
+	if t.token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	if req.Header.Get(clientIDHeader) == "" {
+		req.Header.Set(clientIDHeader, t.clientID)
+	}
+	return t.base.RoundTrip(req)
+}
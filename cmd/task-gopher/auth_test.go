@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateToken(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+
+	secret, err := createToken(db, Token{Name: "laptop", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		t.Errorf("got secret %q, want it to start with %q", secret, tokenPrefix)
+	}
+	// only the hash of the secret is stored
+	var hash string
+	if err = db.QueryRow(`SELECT hash FROM tokens WHERE name = 'laptop';`).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if hash == secret || hash != hashToken(secret) {
+		t.Errorf("got stored hash %q for secret %q", hash, secret)
+	}
+	got, err := lookupToken(db, secret)
+	if err != nil || got.Name != "laptop" || got.Scope != scopeWrite {
+		t.Errorf("lookupToken() = %+v, %v", got, err)
+	}
+
+	for _, invalid := range []Token{
+		{Name: "laptop", Scope: scopeRead},
+		{Name: "", Scope: scopeRead},
+		{Name: "my phone", Scope: scopeRead},
+		{Name: "phone", Scope: "admin"},
+	} {
+		if _, err := createToken(db, invalid); err == nil {
+			t.Errorf("createToken(%+v) succeeded, want an error", invalid)
+		}
+	}
+
+	if err = revokeToken(db, "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lookupToken(db, secret); err != sql.ErrNoRows {
+		t.Errorf("got %v for a revoked token, want sql.ErrNoRows", err)
+	}
+	if err = revokeToken(db, "laptop"); err != sql.ErrNoRows {
+		t.Errorf("got %v revoking a missing token, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	read, err := createToken(db, Token{Name: "reader", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write, err := createToken(db, Token{Name: "writer", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newServer()
+	var tests = []struct {
+		name     string
+		method   string
+		path     string
+		header   string
+		wantCode int
+	}{
+		{"no token", http.MethodGet, apiPrefix + "/tasks", "", http.StatusUnauthorized},
+		{"invalid token", http.MethodGet, apiPrefix + "/tasks", "Bearer " + tokenPrefix + "nope", http.StatusUnauthorized},
+		{"not a bearer token", http.MethodGet, apiPrefix + "/tasks", "Basic " + read, http.StatusUnauthorized},
+		{"read token", http.MethodGet, apiPrefix + "/tasks", "Bearer " + read, http.StatusOK},
+		{"read token changing a task", http.MethodPost, apiPrefix + "/tasks/add", "Bearer " + read, http.StatusForbidden},
+		{"write token changing a task", http.MethodPost, apiPrefix + "/tasks/add", "Bearer " + write, http.StatusOK},
+		{"deprecated route", http.MethodGet, "/tasks", "", http.StatusUnauthorized},
+		{"websocket", http.MethodGet, apiPrefix + "/ws", "", http.StatusUnauthorized},
+		// not a websocket handshake, but the token is accepted
+		{"websocket with the token in the query", http.MethodGet, apiPrefix + "/ws?access_token=" + read, "", http.StatusBadRequest},
+		{"documentation", http.MethodGet, apiPrefix + "/openapi.json", "", http.StatusOK},
+		{"versions", http.MethodGet, "/api", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"Name": "test"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %v, want %v: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("got no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestRedactToken(t *testing.T) {
+	var tests = []struct {
+		uri  string
+		want string
+	}{
+		{"/api/v1/ws?access_token=tg_secret", "/api/v1/ws?access_token=REDACTED"},
+		{"/api/v1/tasks?q=tag:work", "/api/v1/tasks?q=tag:work"},
+	}
+	for _, tt := range tests {
+		if got := redactToken(tt.uri); got != tt.want {
+			t.Errorf("redactToken(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
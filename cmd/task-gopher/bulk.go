@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A BulkRequest applies the same changes, or a deletion, to all the tasks that match a filter
+// Values that are not given are left unchanged; an empty Tag or Due clears it, like an empty field value
+type BulkRequest struct {
+	Filter string            // the tasks to change, e.g. "tag:sprint12 status:todo", see filter.go
+	IDs    []int64           `json:",omitempty"` // if given, only these matching tasks are changed, e.g. the previewed ones
+	DryRun bool              `json:",omitempty"` // only return the matching tasks, without changing them
+	Delete bool              `json:",omitempty"` // delete the matching tasks instead of changing them
+	Status string            `json:",omitempty"`
+	Type   string            `json:",omitempty"`
+	Tag    *string           `json:",omitempty"`
+	Due    *string           `json:",omitempty"`
+	Fields map[string]string `json:",omitempty"`
+}
+
+// A transitionError reports that the workflow doesn't allow a status change
+type transitionError struct {
+	Task     Task
+	From, To status
+}
+
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("Cannot move task %v from %q to %q", e.Task.ID, e.From, e.To)
+}
+
+// matchBulk returns the tasks a bulk request applies to
+func matchBulk(db queryer, req BulkRequest) ([]Task, error) {
+	if strings.TrimSpace(req.Filter) == "" {
+		return nil, &fieldError{"Filter", fmt.Errorf("the filter must not be empty")}
+	}
+	matched, err := getTasksByFilter(db, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if req.IDs == nil {
+		return matched, nil
+	}
+	var ids = map[int64]bool{}
+	for _, id := range req.IDs {
+		ids[id] = true
+	}
+	var selected []Task
+	for _, task := range matched {
+		if ids[task.ID] {
+			selected = append(selected, task)
+		}
+	}
+	return selected, nil
+}
+
+// applyBulk applies a bulk request and returns the changed tasks, or the deleted ones
+// It should run in a transaction, so that either all the tasks change or none.
+// Unless force is set, work-in-progress limits are checked as if the tasks were changed one by one.
+func applyBulk(db queryer, req BulkRequest, force bool) ([]Task, error) {
+	matched, err := matchBulk(db, req)
+	if err != nil || req.DryRun {
+		return matched, err
+	}
+	if req.Delete {
+		for _, task := range matched {
+			if err = delTask(db, task.ID); err != nil {
+				return nil, err
+			}
+		}
+		return matched, nil
+	}
+
+	// validate the changes once for all tasks
+	var patch = TaskPatch{Tag: req.Tag, Fields: req.Fields}
+	if req.Tag != nil {
+		if err = checkText("Tag", *req.Tag, maxTagLength); err != nil {
+			return nil, err
+		}
+	}
+	if req.Status != "" {
+		st, err := workflow.parse(req.Status)
+		if err != nil {
+			return nil, &fieldError{"Status", err}
+		}
+		patch.Status = &st
+	}
+	if req.Type != "" {
+		t, err := parseTaskType(req.Type)
+		if err != nil {
+			return nil, &fieldError{"Type", err}
+		}
+		patch.Type = &t
+	}
+	if req.Due != nil {
+		var due time.Time
+		if *req.Due != "" {
+			if due, err = parseDue(*req.Due, time.Now()); err != nil {
+				return nil, &fieldError{"Due", err}
+			}
+		}
+		patch.Due = &due
+	}
+	if patch.Fields, err = validateFields(db, req.Fields); err != nil {
+		return nil, err
+	}
+
+	all, err := getTasks(db)
+	if err != nil {
+		return nil, err
+	}
+	var updated []Task
+	for _, orig := range matched {
+		if patch.Status != nil && !workflow.canTransition(orig.Status, *patch.Status) {
+			return nil, &transitionError{orig, orig.Status, *patch.Status}
+		}
+		if !force {
+			next := patch.apply(orig)
+			if err = checkWIPLimit(all, next, &orig); err != nil {
+				return nil, err
+			}
+			// count the task in its new status for the next checks
+			for i := range all {
+				if all[i].ID == next.ID {
+					all[i] = next
+				}
+			}
+		}
+
+		task, err := updateTask(db, orig.ID, 0, patch)
+		if err != nil {
+			return nil, err
+		}
+		updated = append(updated, task)
+	}
+	return updated, nil
+}
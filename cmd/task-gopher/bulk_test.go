@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setupBulkTests creates four tasks, the first three tagged sprint12
+func setupBulkTests(t *testing.T) *sql.DB {
+	db := setupTests()
+	for _, task := range []Task{
+		{Name: "one", Tag: "sprint12", Status: todo},
+		{Name: "two", Tag: "sprint12", Status: todo},
+		{Name: "three", Tag: "sprint12", Status: done},
+		{Name: "four", Tag: "sprint13", Status: todo},
+	} {
+		if _, err := addTask(db, task.Name, "", task.Status, generic, task.Tag, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestApplyBulk(t *testing.T) {
+	var tests = []struct {
+		name       string
+		req        BulkRequest
+		wantIDs    []int64
+		wantStatus []status
+	}{
+		{"dry run changes nothing", BulkRequest{Filter: "tag:sprint12 status:todo", Status: "done", DryRun: true}, []int64{1, 2}, []status{todo, todo, done, todo}},
+		{"update by filter", BulkRequest{Filter: "tag:sprint12 status:todo", Status: "done"}, []int64{1, 2}, []status{done, done, done, todo}},
+		{"only the previewed tasks", BulkRequest{Filter: "tag:sprint12", Status: "in progress", IDs: []int64{2, 4}}, []int64{2}, []status{todo, inProgress, done, todo}},
+		{"filter expression", BulkRequest{Filter: "(tag:sprint13 or name:two) and not status:done", Status: "done"}, []int64{2, 4}, []status{todo, done, done, done}},
+		{"delete by filter", BulkRequest{Filter: "status:done", Delete: true}, []int64{3}, []status{todo, todo, todo}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db = setupBulkTests(t)
+			defer teardownTests(db)
+			var tasks []Task
+			err := withTx(db, func(tx *sql.Tx) (err error) {
+				tasks, err = applyBulk(tx, tt.req, false)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, task := range tasks {
+				ids = append(ids, task.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("got tasks %v, want %v", ids, tt.wantIDs)
+			}
+			all, err := getTasks(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statuses []status
+			for _, task := range all {
+				statuses = append(statuses, task.Status)
+			}
+			if !reflect.DeepEqual(statuses, tt.wantStatus) {
+				t.Errorf("got statuses %v, want %v", statuses, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestApplyBulkIsAtomic(t *testing.T) {
+	defer func() { workflow = defaultWorkflow }()
+	workflow = Workflow{
+		{ID: todo, Name: "todo", Category: categoryTodo},
+		{ID: inProgress, Name: "in progress", Category: categoryDoing, Limit: 1},
+		{ID: done, Name: "done", Category: categoryDone},
+	}
+	db = setupBulkTests(t)
+	defer teardownTests(db)
+
+	// the second task would exceed the limit, so the first one must not move either
+	err := withTx(db, func(tx *sql.Tx) error {
+		_, err := applyBulk(tx, BulkRequest{Filter: "status:todo", Status: "in progress"}, false)
+		return err
+	})
+	var wipErr *wipLimitError
+	if !errors.As(err, &wipErr) {
+		t.Fatalf("expected a WIP limit error, got %v", err)
+	}
+	tasks, err := getTasks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		if task.Status == inProgress {
+			t.Errorf("expected no task to move, got %v", task)
+		}
+	}
+}
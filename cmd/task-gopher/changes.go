@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// A changeFeed tells its subscribers that the tasks changed, e.g. to push them to the GraphQL subscriptions
+// Changes are coalesced: a subscriber that is still busy with the last one gets a single signal for the next ones.
+type changeFeed struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]bool
+}
+
+// changes is the feed of the changes made through any API of the server
+var changes = &changeFeed{subs: map[chan struct{}]bool{}}
+
+// subscribe returns a channel signaled after every change, and a function to stop it
+func (f *changeFeed) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	f.mu.Lock()
+	f.subs[ch] = true
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subs, ch)
+		f.mu.Unlock()
+	}
+}
+
+// publish signals all the subscribers, without waiting for them
+func (f *changeFeed) publish() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyChange tells the websocket clients, except the one the change comes from, and the subscribers of changes
+// that the tasks changed. The events say how, see Event.
+func notifyChange(origin changeOrigin, events ...Event) {
+	sendUpdateSockets(origin, events)
+	changes.publish()
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/table"
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/charmbracelet/kancli"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
@@ -25,6 +34,27 @@ var rootCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return cmd.Help()
 	},
+	// the errors past the arguments mostly come from the server, the usage doesn't help with them
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+	// errors are printed by main, see printError
+	SilenceErrors: true,
+}
+
+// printError prints an error of a command, naming the value of the request it is about if the message doesn't
+// and telling how to log in if the server wants a token.
+func printError(err error) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == codeUnauthorized {
+		fmt.Fprintf(os.Stderr, "Error: %v, log in with task-gopher login\n", err)
+		return
+	}
+	if errors.As(err, &apiErr) && apiErr.Field != "" && !strings.Contains(apiErr.Message, apiErr.Field) {
+		fmt.Fprintf(os.Stderr, "Error: %v: %v\n", apiErr.Field, err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Error:", err)
 }
 
 var serveCmd = &cobra.Command{
@@ -32,9 +62,43 @@ var serveCmd = &cobra.Command{
 	Aliases: []string{"server", "start"},
 	Short:   "create and start a server for the DB",
 	Args:    cobra.NoArgs,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		port := os.Getenv("PORT")
-		serve(port)
+		useTLS, err := cmd.Flags().GetBool("tls")
+		if err != nil {
+			return err
+		}
+		certFile, err := cmd.Flags().GetString("cert")
+		if err != nil {
+			return err
+		}
+		keyFile, err := cmd.Flags().GetString("key")
+		if err != nil {
+			return err
+		}
+		mtls, err := cmd.Flags().GetBool("mtls")
+		if err != nil {
+			return err
+		}
+		grpcPort, err := cmd.Flags().GetString("grpc-port")
+		if err != nil {
+			return err
+		}
+		if grpcPort == "" {
+			grpcPort = os.Getenv("GRPC_PORT")
+		}
+		if (certFile == "") != (keyFile == "") {
+			return fmt.Errorf("give both --cert and --key")
+		}
+		// without a certificate of its own, the server uses one signed by its own CA
+		if (useTLS || mtls) && certFile == "" {
+			certFile, keyFile, err = ensureCertificates(dataDir, serverHosts())
+			if err != nil {
+				return err
+			}
+		}
+		serve(port, grpcPort, certFile, keyFile, mtls)
+		return nil
 	},
 }
 
@@ -55,23 +119,37 @@ var addCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		fields, err := getSetFlag(cmd)
+		if err != nil {
+			return err
+		}
+		due, err := cmd.Flags().GetString("due")
+		if err != nil {
+			return err
+		}
 		// JSON body
-		body := []byte(fmt.Sprintf(`{
-			"Name": "%v",
-			"Desc": "%v",
-			"Status": "%v",
-			"Type": "%v",
-			"Tag": "%v"
-		}`, args[0], description, todo, generic, tag))
-
-		addr := os.Getenv("ADDRESS")
-		port := os.Getenv("PORT")
-		url := addr + ":" + port + "/tasks/add"
-		res, err := http.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(body))
+		body, err := json.Marshal(map[string]interface{}{
+			"Name":   args[0],
+			"Desc":   description,
+			"Status": "",
+			"Type":   generic.String(),
+			"Tag":    tag,
+			"Fields": fields,
+			"Due":    due,
+		})
+		if err != nil {
+			return err
+		}
+
+		url := serverURL("/tasks/add")
+		res, err := apiClient.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(body))
 		if err != nil {
 			return err
 		}
 		fmt.Println(res.Status)
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
 		jsonBody := make(map[string]interface{})
 		err = json.NewDecoder(res.Body).Decode(&jsonBody)
 		if err != nil {
@@ -83,101 +161,317 @@ var addCmd = &cobra.Command{
 }
 
 var updateCmd = &cobra.Command{
-	Use:   "update ID",
-	Short: "Update an existing task name, description, tag or completion status by its id",
-	Args:  cobra.ExactArgs(1),
+	Use:   "update [ID]",
+	Short: "Update an existing task name, description, tag or completion status by its id, or all tasks matching a filter",
+	Args:  cobra.RangeArgs(0, 1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		db := createDB()
 		defer db.Close()
 
-		var id, err = strconv.Atoi(args[0])
+		filter, err := cmd.Flags().GetString("filter")
 		if err != nil {
 			return err
 		}
+		if (filter == "") == (len(args) == 0) {
+			return fmt.Errorf("give either a task ID or --filter")
+		}
 
-		name, err := cmd.Flags().GetString("name")
+		// only the values given are changed, an empty value clears one
+		var changes = map[string]interface{}{}
+		for flag, key := range map[string]string{"name": "Name", "description": "Desc", "tag": "Tag", "status": "Status", "due": "Due"} {
+			if !cmd.Flags().Changed(flag) {
+				continue
+			}
+			value, err := cmd.Flags().GetString(flag)
+			if err != nil {
+				return err
+			}
+			changes[key] = value
+		}
+		if due, ok := changes["Due"]; ok && due == "" {
+			changes["Due"] = nil
+		}
+
+		fields, err := getSetFlag(cmd)
 		if err != nil {
 			return err
 		}
+		if len(fields) > 0 {
+			changes["Fields"] = fields
+		}
 
-		description, err := cmd.Flags().GetString("description")
+		force, err := cmd.Flags().GetBool("force")
 		if err != nil {
 			return err
 		}
-		tag, err := cmd.Flags().GetString("tag")
+
+		if filter != "" {
+			if cmd.Flags().Changed("name") || cmd.Flags().Changed("description") {
+				return fmt.Errorf("--name and --description can't be used with --filter")
+			}
+			req := BulkRequest{Filter: filter, Fields: fields}
+			req.Status, _ = changes["Status"].(string)
+			if cmd.Flags().Changed("tag") {
+				tag, _ := changes["Tag"].(string)
+				req.Tag = &tag
+			}
+			if cmd.Flags().Changed("due") {
+				due, _ := changes["Due"].(string)
+				req.Due = &due
+			}
+			return runBulk(cmd, req, force)
+		}
+		if len(changes) == 0 {
+			return fmt.Errorf("nothing to update, give at least one of the flags")
+		}
+
+		id, err := strconv.Atoi(args[0])
 		if err != nil {
 			return err
 		}
-		completed, err := cmd.Flags().GetInt("status")
+		_, err = updateTaskWithMerge(int64(id), force, changes, promptConflict)
 		if err != nil {
 			return err
 		}
+		fmt.Println("Updated task", id)
+		return nil
+	},
+}
 
-		var status status
-		switch completed {
-		case int(inProgress):
-			status = inProgress
-		case int(done):
-			status = done
-		case int(todo):
-			status = todo
-		default:
-			status = invalidStatus
-		}
+// updateTaskOnServer applies changes to a task and returns the updated task
+// The changes are sent as a JSON Merge Patch: values that are not given are left unchanged
+// and nil clears a value; force overrides the work-in-progress limits.
+// If version is set, the update only applies to that version of the task and
+// a *conflictError holding the current task is returned if it changed since.
+func updateTaskOnServer(id, version int64, force bool, changes map[string]interface{}) (Task, error) {
+	// JSON body
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return Task{}, err
+	}
 
-		// JSON body
-		body := []byte(fmt.Sprintf(`{
-			"Name": "%v",
-			"Desc": "%v",
-			"Status": "%v",
-			"Type": "%v",
-			"Tag": "%v"
-		}`, name, description, status, generic, tag))
-
-		addr := os.Getenv("ADDRESS")
-		port := os.Getenv("PORT")
-		url := addr + ":" + port + "/tasks/" + fmt.Sprint(id)
+	url := serverURL("/tasks/" + fmt.Sprint(id))
+	if force {
+		url += "?force=true"
+	}
 
-		// create a new PUT request
-		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
-		if err != nil {
-			return err
+	// create a new PATCH request
+	req, err := http.NewRequest("PATCH", url, bytes.NewBuffer(body))
+	if err != nil {
+		return Task{}, err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	if version != 0 {
+		req.Header.Set("If-Match", formatETag(version))
+	}
+
+	// send the request
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return Task{}, err
+	}
+	defer res.Body.Close()
+	// a conflict with a newer version comes with that version, other errors with a message
+	if res.StatusCode == http.StatusConflict {
+		var body errorResponse
+		if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+			return Task{}, err
 		}
+		if body.Current != nil {
+			return Task{}, &conflictError{*body.Current}
+		}
+		if body.Error != nil {
+			return Task{}, body.Error
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return Task{}, readError(res)
+	}
+	var updated Task
+	err = json.NewDecoder(res.Body).Decode(&updated)
+	return updated, err
+}
 
-		// send the request
-		client := &http.Client{}
-		res, err := client.Do(req)
-		if err != nil {
-			return err
+// getTaskFromServer fetches a task by its ID
+func getTaskFromServer(id int64) (Task, error) {
+	url := serverURL("/tasks/" + fmt.Sprint(id))
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return Task{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Task{}, readError(resp)
+	}
+	var task Task
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	return task, err
+}
+
+// updateTaskWithMerge applies changes to a task without overwriting the changes others made meanwhile
+// When the task changed on the server, the changes are merged with the current task, and
+// resolve picks the value of the fields both changed. It returns false to abort the update.
+func updateTaskWithMerge(id int64, force bool, changes map[string]interface{}, resolve func(fieldConflict) (keepMine, ok bool)) (Task, error) {
+	base, err := getTaskFromServer(id)
+	if err != nil {
+		return Task{}, err
+	}
+	for {
+		updated, err := updateTaskOnServer(id, base.Version, force, changes)
+		var conflict *conflictError
+		if !errors.As(err, &conflict) {
+			return updated, err
 		}
-		defer res.Body.Close()
-		fmt.Println(res.Status)
-		if res.StatusCode == 200 {
-			fmt.Println("Updated task", id)
-		} else {
-			fmt.Println("Something went wrong")
+		merged, conflicts := threeWayMerge(base, conflict.Current, changes)
+		for _, c := range conflicts {
+			keepMine, ok := resolve(c)
+			if !ok {
+				return Task{}, fmt.Errorf("update of task %v aborted", id)
+			}
+			if keepMine {
+				continue
+			}
+			if name, isField := strings.CutPrefix(c.Key, "Fields."); isField {
+				delete(merged["Fields"].(map[string]string), name)
+			} else {
+				delete(merged, c.Key)
+			}
 		}
+		base, changes = conflict.Current, merged
+	}
+}
+
+// promptConflict asks on the terminal whether to keep the local value of a field both sides changed
+func promptConflict(c fieldConflict) (keepMine, ok bool) {
+	fmt.Printf("%v was changed on the server from %q to %q, you changed it to %q.\n", c.Key, c.Base, c.Theirs, c.Mine)
+	fmt.Print("Keep [m]ine or [t]heirs, or [a]bort? ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "m", "mine":
+		return true, true
+	case "t", "theirs":
+		return false, true
+	}
+	return false, false
+}
+
+// moveTaskOnServer places a task between two others on the board and returns the moved task
+func moveTaskOnServer(id, after, before int64) (Task, error) {
+	body, err := json.Marshal(map[string]int64{"After": after, "Before": before})
+	if err != nil {
+		return Task{}, err
+	}
+
+	url := serverURL("/tasks/" + fmt.Sprint(id) + "/move")
+	res, err := apiClient.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(body))
+	if err != nil {
+		return Task{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Task{}, readError(res)
+	}
+	var task Task
+	err = json.NewDecoder(res.Body).Decode(&task)
+	return task, err
+}
+
+// runBulk shows the tasks a bulk request matches and, once confirmed, applies it
+func runBulk(cmd *cobra.Command, req BulkRequest, force bool) error {
+	yes, err := cmd.Flags().GetBool("yes")
+	if err != nil {
+		return err
+	}
+
+	// preview
+	req.DryRun = true
+	tasks, err := bulkOnServer(req, false)
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		fmt.Println("No tasks match", req.Filter)
 		return nil
-	},
+	}
+	if err = getWorkflowFromServer(); err != nil {
+		return err
+	}
+	verb := "Update"
+	if req.Delete {
+		verb = "Delete"
+	}
+	if !yes {
+		table := setupTable(tasks)
+		fmt.Println(table.View())
+		fmt.Printf("%v %v tasks? [y/N] ", verb, len(tasks))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println("Nothing changed")
+			return nil
+		}
+	}
+
+	// apply to the previewed tasks only
+	req.DryRun = false
+	req.IDs = []int64{}
+	for _, task := range tasks {
+		req.IDs = append(req.IDs, task.ID)
+	}
+	tasks, err = bulkOnServer(req, force)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%vd %v tasks\n", verb, len(tasks))
+	return nil
+}
+
+// bulkOnServer sends a bulk request to the server and returns the affected tasks
+func bulkOnServer(req BulkRequest, force bool) ([]Task, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	url := serverURL("/tasks/bulk")
+	if force {
+		url += "?force=true"
+	}
+	res, err := apiClient.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readError(res)
+	}
+	var tasks []Task
+	err = json.NewDecoder(res.Body).Decode(&tasks)
+	return tasks, err
 }
 
 var delCmd = &cobra.Command{
-	Use:   "del ID",
-	Short: "Delete a task by its ID",
-	Args:  cobra.ExactArgs(1),
+	Use:   "del [ID]",
+	Short: "Delete a task by its ID, or all tasks matching a filter",
+	Args:  cobra.RangeArgs(0, 1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// db := createDB()
 		// defer db.Close()
-		var id, err = strconv.Atoi(args[0])
+		filter, err := cmd.Flags().GetString("filter")
 		if err != nil {
 			return err
 		}
-		addr := os.Getenv("ADDRESS")
-		port := os.Getenv("PORT")
-		url := addr + ":" + port + "/tasks/" + fmt.Sprint(id)
+		if (filter == "") == (len(args) == 0) {
+			return fmt.Errorf("give either a task ID or --filter")
+		}
+		if filter != "" {
+			return runBulk(cmd, BulkRequest{Filter: filter, Delete: true}, false)
+		}
 
-		// create a new HTTP client
-		client := &http.Client{}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		url := serverURL("/tasks/" + fmt.Sprint(id))
 
 		// create a new DELETE request
 		req, err := http.NewRequest("DELETE", url, nil)
@@ -186,128 +480,393 @@ var delCmd = &cobra.Command{
 		}
 
 		// send the request
-		resp, err := client.Do(req)
+		resp, err := apiClient.Do(req)
 		if err != nil {
 			return err
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp)
+		}
 		return nil
 	},
 }
 
-func getTasksFromServer() ([]Task, error) {
-	addr := os.Getenv("ADDRESS")
-	port := os.Getenv("PORT")
-	url := addr + ":" + port + "/tasks"
+// getWorkflowFromServer fetches the workflow configured on the server and makes it the active one
+func getWorkflowFromServer() error {
+	url := serverURL("/workflow")
 
-	resp, err := http.Get(url)
+	resp, err := apiClient.Get(url)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// decode response into tasks array
-	var tasks []Task
-	err = json.NewDecoder(resp.Body).Decode(&tasks)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+	var w Workflow
+	err = json.NewDecoder(resp.Body).Decode(&w)
 	if err != nil {
+		return err
+	}
+	if len(w) > 0 {
+		workflow = w
+	}
+	return nil
+}
+
+// getTasksFromServer fetches the tasks matching a filter, or all the tasks if it is empty, in the given sort order,
+// along with the workflow needed to display their statuses
+// It pages through the results of the server until the last page.
+func getTasksFromServer(filter, sort string) ([]Task, error) {
+	if err := getWorkflowFromServer(); err != nil {
 		return nil, err
 	}
-	return tasks, nil
+	params := url.Values{}
+	params.Set("limit", strconv.Itoa(maxPageSize))
+	if filter != "" {
+		params.Set("q", filter)
+	}
+	if sort != "" {
+		params.Set("sort", sort)
+	}
+
+	var tasks = []Task{}
+	for {
+		url := serverURL("/tasks?" + params.Encode())
+		resp, err := apiClient.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = readError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		// decode response into tasks array
+		var page []Task
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, page...)
+		next := resp.Header.Get("X-Next-Cursor")
+		if next == "" {
+			return tasks, nil
+		}
+		params.Set("cursor", next)
+	}
 }
 
 var listCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List all your tasks",
-	Args:  cobra.NoArgs,
+	Use:   "list [FILTER...]",
+	Short: "List all your tasks, or those matching a filter",
+	Long: `List all your tasks, or those matching a filter such as
+
+  task-gopher list status:todo and '(tag:work or tag:ops)' created.after:-7d
+
+Terms are field:value or field.modifier:value, where the modifier is one of
+eq, ne, has, hasnt, before, after, any or none. Terms can be combined with
+and, or, not and parentheses; terms next to each other must all match.`,
+	Args: cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		tasks, err := getTasksFromServer()
+		filter, context, err := contextFilter(cmd, args)
+		if err != nil {
+			return err
+		}
+		sortKey, err := cmd.Flags().GetString("sort")
+		if err != nil {
+			return err
+		}
+		tasks, err := getTasksFromServer(filter, sortKey)
 		if err != nil {
 			return err
 		}
-		table := setupTable(tasks)
-		fmt.Print(table.View())
-		return nil
-	},
-}
 
-var dropDBCmd = &cobra.Command{
-	Use:   "deldb",
-	Short: "delete all your tasks",
-	Args:  cobra.NoArgs,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		db := createDB(true)
-		defer db.Close()
-		tasks, err := getTasks(db)
+		statusName, err := cmd.Flags().GetString("status")
+		if err != nil {
+			return err
+		}
+		if statusName != "" {
+			s, err := workflow.parse(statusName)
+			if err != nil {
+				return err
+			}
+			tasks = filterTasksByStatus(tasks, s)
+		}
+
+		whereArgs, err := cmd.Flags().GetStringArray("where")
 		if err != nil {
 			return err
 		}
+		where, err := parseFieldArgs(whereArgs)
+		if err != nil {
+			return err
+		}
+		if len(where) > 0 {
+			tasks = filterTasksByFields(tasks, where)
+		}
+
+		if context.Name != "" {
+			fmt.Println(contextTitle(context))
+		}
 		table := setupTable(tasks)
 		fmt.Print(table.View())
 		return nil
 	},
 }
 
-func calculateWidth(min, width int) int {
-	p := width / 10
-	switch min {
-	case XS:
-		if p < XS {
-			return XS
-		}
-		return p / 2
-
-	case SM:
-		if p < SM {
-			return SM
-		}
-		return p / 2
-	case MD:
-		if p < MD {
-			return MD
-		}
-		return p * 2
-	case LG:
-		if p < LG {
-			return LG
-		}
-		return p * 3
-	default:
-		return p
+// contextFilter returns the filter given on the command line, combined with the view
+// used as context unless --no-context is set, and that view
+func contextFilter(cmd *cobra.Command, args []string) (string, View, error) {
+	filter := strings.Join(args, " ")
+	noContext, err := cmd.Flags().GetBool("no-context")
+	if err != nil {
+		return "", View{}, err
+	}
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return "", View{}, err
+	}
+	if noContext || cfg.Context == "" {
+		return filter, View{}, nil
 	}
+	context, err := getViewFromServer(cfg.Context)
+	if err != nil {
+		return "", View{}, fmt.Errorf("context %v: %w (use 'task-gopher view use' to clear it)", cfg.Context, err)
+	}
+	return withContext(context, filter), context, nil
 }
 
-const (
-	XS int = 1
-	SM int = 3
-	MD int = 5
-	LG int = 10
-)
+// contextTitle returns the header shown above the tasks when a context is active
+func contextTitle(context View) string {
+	return lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("63")).Render("Context: "+context.Name) +
+		lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Render(" ("+context.Filter+")")
+}
 
-func setupTable(tasks []Task) table.Model {
-	// get term size
-	w, _, err := term.GetSize(int(os.Stdout.Fd()))
+// getSetFlag returns the user-defined field values given with --set key=value
+func getSetFlag(cmd *cobra.Command) (map[string]string, error) {
+	args, err := cmd.Flags().GetStringArray("set")
 	if err != nil {
-		// we don't really want to fail it...
-		log.Println("unable to calculate height and width of terminal")
+		return nil, err
 	}
+	return parseFieldArgs(args)
+}
 
-	columns := []table.Column{
-		{Title: "ID", Width: calculateWidth(XS, w)},
-		{Title: "Name", Width: calculateWidth(MD, w)},
-		{Title: "Tag", Width: calculateWidth(SM, w)},
-		{Title: "Status", Width: calculateWidth(MD, w)},
-		{Title: "Description", Width: calculateWidth(MD, w)},
-		{Title: "Created At", Width: calculateWidth(MD, w)},
+func getFieldsFromServer() (map[string]FieldDef, error) {
+	url := serverURL("/fields")
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return nil, err
 	}
-	var rows []table.Row
-	for _, task := range tasks {
-		rows = append(rows, table.Row{
-			fmt.Sprintf("%d", task.ID),
-			task.Name,
-			task.Tag,
-			task.Status.String(),
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+	var list []FieldDef
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+	var defs = map[string]FieldDef{}
+	for _, def := range list {
+		defs[def.Name] = def
+	}
+	return defs, nil
+}
+
+var fieldCmd = &cobra.Command{
+	Use:   "field",
+	Short: "Manage user-defined task fields",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var fieldAddCmd = &cobra.Command{
+	Use:   "add NAME TYPE [OPTION...]",
+	Short: "Declare a field of type string, number, date or enum (enum fields take their options as arguments)",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fieldType, err := parseFieldType(args[1])
+		if err != nil {
+			return err
+		}
+		def := FieldDef{Name: args[0], Type: fieldType, Options: args[2:]}
+		if err = def.validate(); err != nil {
+			return err
+		}
+		body, err := json.Marshal(def)
+		if err != nil {
+			return err
+		}
+
+		url := serverURL("/fields")
+		res, err := apiClient.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(body))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
+		fmt.Println("Added field", def.Name)
+		return nil
+	},
+}
+
+var fieldListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the user-defined fields",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defs, err := getFieldsFromServer()
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name := range defs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			def := defs[name]
+			if def.Type == fieldEnum {
+				fmt.Printf("%v\t%v\t%v\n", def.Name, def.Type, strings.Join(def.Options, ","))
+			} else {
+				fmt.Printf("%v\t%v\n", def.Name, def.Type)
+			}
+		}
+		return nil
+	},
+}
+
+var fieldDelCmd = &cobra.Command{
+	Use:   "del NAME",
+	Short: "Delete a user-defined field and its values from all tasks",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url := serverURL("/fields/" + url.PathEscape(args[0]))
+
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := apiClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return readError(resp)
+		}
+		return nil
+	},
+}
+
+var dropDBCmd = &cobra.Command{
+	Use:   "deldb",
+	Short: "delete all your tasks",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := createDB(true)
+		defer db.Close()
+		tasks, err := getTasks(db)
+		if err != nil {
+			return err
+		}
+		table := setupTable(tasks)
+		fmt.Print(table.View())
+		return nil
+	},
+}
+
+func calculateWidth(min, width int) int {
+	p := width / 10
+	switch min {
+	case XS:
+		if p < XS {
+			return XS
+		}
+		return p / 2
+
+	case SM:
+		if p < SM {
+			return SM
+		}
+		return p / 2
+	case MD:
+		if p < MD {
+			return MD
+		}
+		return p * 2
+	case LG:
+		if p < LG {
+			return LG
+		}
+		return p * 3
+	default:
+		return p
+	}
+}
+
+const (
+	XS int = 1
+	SM int = 3
+	MD int = 5
+	LG int = 10
+)
+
+func setupTable(tasks []Task) table.Model {
+	// get term size
+	w, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		// we don't really want to fail it...
+		log.Println("unable to calculate height and width of terminal")
+	}
+
+	columns := []table.Column{
+		{Title: "ID", Width: calculateWidth(XS, w)},
+		{Title: "Name", Width: calculateWidth(MD, w)},
+		{Title: "Tag", Width: calculateWidth(SM, w)},
+		{Title: "Status", Width: calculateWidth(MD, w)},
+		{Title: "Description", Width: calculateWidth(MD, w)},
+		{Title: "Created At", Width: calculateWidth(MD, w)},
+		{Title: "Due", Width: calculateWidth(MD, w)},
+	}
+	// add a column for each user-defined field that is set on any task
+	var fieldNames []string
+	for _, task := range tasks {
+		for name := range task.Fields {
+			if !slices.Contains(fieldNames, name) {
+				fieldNames = append(fieldNames, name)
+			}
+		}
+	}
+	sort.Strings(fieldNames)
+	for _, name := range fieldNames {
+		columns = append(columns, table.Column{Title: name, Width: calculateWidth(SM, w)})
+	}
+
+	var rows []table.Row
+	for _, task := range tasks {
+		row := table.Row{
+			fmt.Sprintf("%d", task.ID),
+			task.Name,
+			task.Tag,
+			task.Status.String(),
 			task.Desc,
 			task.Created.Format("2 Jan 2006"),
-		})
+			formatDueCell(task.Due),
+		}
+		for _, name := range fieldNames {
+			row = append(row, task.Fields[name])
+		}
+		rows = append(rows, row)
 	}
 	t := table.New(
 		table.WithColumns(columns),
@@ -325,49 +884,729 @@ func setupTable(tasks []Task) table.Model {
 	return t
 }
 
-// filterTasksByStatus returns a list of tasks that have the status s
-func filterTasksByStatus(tasks []Task, s status) []Task {
-	var filtered []Task
-	for _, task := range tasks {
-		if task.Status == s {
-			filtered = append(filtered, task)
+// formatDueCell returns a due date as shown in the table
+func formatDueCell(due time.Time) string {
+	if due.IsZero() {
+		return ""
+	}
+	return due.Format("2 Jan 2006")
+}
+
+// filterTasksByStatus returns a list of tasks that have the status s
+func filterTasksByStatus(tasks []Task, s status) []Task {
+	var filtered []Task
+	for _, task := range tasks {
+		if task.Status == s {
+			filtered = append(filtered, task)
+		}
+	}
+	return filtered
+}
+
+var kanbanCmd = &cobra.Command{
+	Use:   "kanban [FILTER...]",
+	Short: "Interact with your tasks, or those matching a filter, in a Kanban board",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		filter, context, err := contextFilter(cmd, args)
+		if err != nil {
+			return err
+		}
+		tasks, err := getTasksFromServer(filter, "")
+		if err != nil {
+			return err
+		}
+
+		board := newKanbanBoard(tasks)
+		if context.Name != "" {
+			board.title = contextTitle(context)
+		}
+		p := tea.NewProgram(board)
+		_, err = p.Run()
+		return err
+	},
+}
+
+// convert tasks to items for a list
+func tasksToItems(tasks []Task) []list.Item {
+	var items []list.Item
+	for _, t := range tasks {
+		items = append(items, t)
+	}
+	return items
+}
+
+var viewCmd = &cobra.Command{
+	Use:     "view",
+	Aliases: []string{"views"},
+	Short:   "Manage saved views and the context applied to list and kanban",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var viewSaveCmd = &cobra.Command{
+	Use:   "save NAME FILTER...",
+	Short: "Save a filter as a view shared by all clients",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		desc, err := cmd.Flags().GetString("description")
+		if err != nil {
+			return err
+		}
+		v := View{Name: args[0], Filter: strings.Join(args[1:], " "), Desc: desc}
+		body, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		url := serverURL("/views/" + url.PathEscape(v.Name))
+		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+		if err != nil {
+			return err
+		}
+		res, err := apiClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
+		fmt.Printf("Saved view %v\n", v.Name)
+		return nil
+	},
+}
+
+func getViewsFromServer() ([]View, error) {
+	url := serverURL("/views")
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+	var views []View
+	err = json.NewDecoder(resp.Body).Decode(&views)
+	return views, err
+}
+
+func getViewFromServer(name string) (View, error) {
+	url := serverURL("/views/" + url.PathEscape(name))
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return View{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return View{}, readError(resp)
+	}
+	var v View
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	return v, err
+}
+
+var viewUseCmd = &cobra.Command{
+	Use:   "use [NAME]",
+	Short: "Use a view as the context of list and kanban, or clear the context without NAME",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+		cfg.Context = ""
+		if len(args) == 1 {
+			v, err := getViewFromServer(args[0])
+			if err != nil {
+				return err
+			}
+			cfg.Context = v.Name
+		}
+		if err = cfg.save(); err != nil {
+			return err
+		}
+		if cfg.Context == "" {
+			fmt.Println("Cleared the context")
+		} else {
+			fmt.Printf("Using view %v as the context\n", cfg.Context)
+		}
+		return nil
+	},
+}
+
+var viewListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the saved views, the context is marked with a *",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		views, err := getViewsFromServer()
+		if err != nil {
+			return err
+		}
+		cfg, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+		for _, v := range views {
+			active := " "
+			if v.Name == cfg.Context {
+				active = "*"
+			}
+			fmt.Printf("%v %v\t%v\t%v\n", active, v.Name, v.Filter, v.Desc)
+		}
+		return nil
+	},
+}
+
+var viewDelCmd = &cobra.Command{
+	Use:     "delete NAME",
+	Aliases: []string{"del"},
+	Short:   "Delete a view by its name",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url := serverURL("/views/" + url.PathEscape(args[0]))
+
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := apiClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
+		// don't keep a context that no longer exists
+		cfg, err := loadClientConfig()
+		if err != nil || cfg.Context != args[0] {
+			return err
+		}
+		cfg.Context = ""
+		return cfg.save()
+	},
+}
+
+var loginCmd = &cobra.Command{
+	Use:   "login [TOKEN]",
+	Short: "Check an API token or a device certificate with the server and use it for every request, asks for the token without TOKEN",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		certFile, err := cmd.Flags().GetString("cert")
+		if err != nil {
+			return err
+		}
+		keyFile, err := cmd.Flags().GetString("key")
+		if err != nil {
+			return err
+		}
+		if certFile != "" || keyFile != "" {
+			return loginDevice(certFile, keyFile)
+		}
+		var secret string
+		if len(args) == 1 {
+			secret = args[0]
+		} else {
+			if secret, err = readSecret("Token: "); err != nil {
+				return err
+			}
+		}
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			return fmt.Errorf("no token given")
+		}
+		t, err := getTokenFromServer(secret)
+		if err != nil {
+			return err
+		}
+		cfg, err := loadClientConfig()
+		if err != nil {
+			return err
+		}
+		cfg.Token = secret
+		if err = cfg.save(); err != nil {
+			return err
+		}
+		fmt.Printf("Logged in with token %v, which has the %v scope\n", t.Name, t.Scope)
+		return nil
+	},
+}
+
+// loginDevice checks the certificate of this device with the server and keeps it in the client config
+func loginDevice(certFile, keyFile string) error {
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("give both --cert and --key")
+	}
+	var err error
+	if certFile, err = filepath.Abs(certFile); err != nil {
+		return err
+	}
+	if keyFile, err = filepath.Abs(keyFile); err != nil {
+		return err
+	}
+	if _, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return err
+	}
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return err
+	}
+	// the certificate is sent on the connections to the server once it is in the config
+	previous := cfg
+	cfg.CertFile, cfg.KeyFile = certFile, keyFile
+	if err = cfg.save(); err != nil {
+		return err
+	}
+	d, err := getDeviceFromServer()
+	if err != nil {
+		previous.save()
+		return err
+	}
+	fmt.Printf("Logged in as device %v, which has the %v scope\n", d.Name, d.Scope)
+	return nil
+}
+
+// readSecret asks for a secret, without echoing it if the input is a terminal
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(secret), err
+}
+
+// getTokenFromServer returns the token with a given secret, if the server accepts it
+func getTokenFromServer(secret string) (Token, error) {
+	req, err := http.NewRequest("GET", serverURL("/token"), nil)
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	resp, err := apiClient.Do(req)
+	if err != nil {
+		return Token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Token{}, readError(resp)
+	}
+	var t Token
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	return t, err
+}
+
+// getDeviceFromServer returns this device, if the server accepts its certificate
+func getDeviceFromServer() (Device, error) {
+	resp, err := apiClient.Get(serverURL("/device"))
+	if err != nil {
+		return Device{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Device{}, readError(resp)
+	}
+	var d Device
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	return d, err
+}
+
+var tokenCmd = &cobra.Command{
+	Use:     "token",
+	Aliases: []string{"tokens"},
+	Short:   "Manage the API tokens of the clients, on the server",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create NAME",
+	Short: "Create an API token, to give to a client with task-gopher login",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		scope, err := cmd.Flags().GetString("scope")
+		if err != nil {
+			return err
+		}
+		db := createDB()
+		defer db.Close()
+		secret, err := createToken(db, Token{Name: args[0], Scope: scope, Created: time.Now()})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created token %v with the %v scope, it won't be shown again:\n%v\n", args[0], scope, secret)
+		return nil
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the API tokens, without their secrets",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := createDB()
+		defer db.Close()
+		tokens, err := getTokens(db)
+		if err != nil {
+			return err
 		}
-	}
-	return filtered
+		for _, t := range tokens {
+			fmt.Printf("%v\t%v\t%v\n", t.Name, t.Scope, t.Created.Local().Format(time.DateTime))
+		}
+		return nil
+	},
 }
 
-var kanbanCmd = &cobra.Command{
-	Use:   "kanban",
-	Short: "Interact with your tasks in a Kanban board",
-	Args:  cobra.NoArgs,
+var tokenRevokeCmd = &cobra.Command{
+	Use:     "revoke NAME",
+	Aliases: []string{"delete", "del"},
+	Short:   "Revoke an API token by its name, the clients using it lose their access",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := createDB()
+		defer db.Close()
+		err := revokeToken(db, args[0])
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no token named %q", args[0])
+		}
+		return err
+	},
+}
+
+var deviceCmd = &cobra.Command{
+	Use:     "device",
+	Aliases: []string{"devices"},
+	Short:   "Manage the certificates of the devices, on the server",
+	Args:    cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
 
-		tasks, err := getTasksFromServer()
+var deviceEnrollCmd = &cobra.Command{
+	Use:   "enroll NAME",
+	Short: "Issue a certificate for a device, written to NAME.crt and NAME.key, to use with task-gopher login --cert",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		scope, err := cmd.Flags().GetString("scope")
+		if err != nil {
+			return err
+		}
+		out, err := cmd.Flags().GetString("out")
 		if err != nil {
 			return err
 		}
+		db := createDB()
+		defer db.Close()
+		certPEM, keyPEM, err := enrollDevice(db, dataDir, Device{Name: args[0], Scope: scope, Created: time.Now()})
+		if err != nil {
+			return err
+		}
+		certFile, keyFile := filepath.Join(out, args[0]+".crt"), filepath.Join(out, args[0]+".key")
+		if err = os.WriteFile(certFile, certPEM, 0o644); err != nil {
+			return err
+		}
+		if err = os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+			return err
+		}
+		fmt.Printf("Enrolled device %v with the %v scope, copy %v and %v to it\n", args[0], scope, certFile, keyFile)
+		return nil
+	},
+}
 
-		todos := filterTasksByStatus(tasks, todo)
-		ipr := filterTasksByStatus(tasks, inProgress)
-		finished := filterTasksByStatus(tasks, done)
+var deviceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the enrolled devices, and the revoked ones",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := createDB()
+		defer db.Close()
+		devices, err := getDevices(db)
+		if err != nil {
+			return err
+		}
+		for _, d := range devices {
+			revoked := ""
+			if !d.Revoked.IsZero() {
+				revoked = "revoked " + d.Revoked.Local().Format(time.DateTime)
+			}
+			fmt.Printf("%v\t%v\t%v\t%v\n", d.Name, d.Scope, d.Created.Local().Format(time.DateTime), revoked)
+		}
+		return nil
+	},
+}
 
-		todoCol := kancli.NewColumn(tasksToItems(todos), todo, true)
-		iprCol := kancli.NewColumn(tasksToItems(ipr), inProgress, false)
-		doneCol := kancli.NewColumn(tasksToItems(finished), done, false)
-		board := kancli.NewDefaultBoard([]kancli.Column{todoCol, iprCol, doneCol})
-		p := tea.NewProgram(board)
-		_, err = p.Run()
+var deviceRevokeCmd = &cobra.Command{
+	Use:   "revoke NAME",
+	Short: "Revoke the certificate of a device, adding it to the CRL of the server",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db := createDB()
+		defer db.Close()
+		err := revokeDevice(db, dataDir, args[0], time.Now())
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no enrolled device named %q", args[0])
+		}
 		return err
 	},
 }
 
-// convert tasks to items for a list
-func tasksToItems(tasks []Task) []list.Item {
-	var items []list.Item
-	for _, t := range tasks {
-		items = append(items, t)
+var templateCmd = &cobra.Command{
+	Use:     "template",
+	Aliases: []string{"templates"},
+	Short:   "Manage task templates, named sets of tasks that can be created together",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var templateSaveCmd = &cobra.Command{
+	Use:   "save NAME",
+	Short: "Save a template from a JSON file or from the tasks with a given tag",
+	Long: `Save a template from a JSON file or from the tasks with a given tag.
+
+The JSON file holds the template tasks, e.g.:
+
+	{
+		"Desc": "release checklist",
+		"Tasks": [
+			{"Name": "Tag v{{version}}", "Tag": "release", "Due": "0d"},
+			{"Name": "Announce v{{version}}", "Tag": "release", "Due": "2d", "Fields": {"customer": "all"}}
+		]
 	}
-	return items
+
+Placeholders like {{version}} are filled in with --var when the template is applied.
+Due is an offset from the day the template is applied, in days (d) or weeks (w).`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+		tag, err := cmd.Flags().GetString("tag")
+		if err != nil {
+			return err
+		}
+		desc, err := cmd.Flags().GetString("description")
+		if err != nil {
+			return err
+		}
+
+		var tmpl Template
+		switch {
+		case file != "" && tag != "":
+			return fmt.Errorf("use either --file or --tag")
+		case file != "":
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(data, &tmpl); err != nil {
+				return fmt.Errorf("%v: %w", file, err)
+			}
+		case tag != "":
+			tasks, err := getTasksFromServer("", "")
+			if err != nil {
+				return err
+			}
+			tmpl = templateFromTasks(args[0], "", filterTasksByFields(tasks, map[string]string{"tag": tag}), time.Now())
+		default:
+			return fmt.Errorf("use --file or --tag to give the template tasks")
+		}
+		tmpl.Name = args[0]
+		if desc != "" {
+			tmpl.Desc = desc
+		}
+		if err = tmpl.validate(); err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(tmpl)
+		if err != nil {
+			return err
+		}
+		url := serverURL("/templates/" + url.PathEscape(tmpl.Name))
+		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+		if err != nil {
+			return err
+		}
+		res, err := apiClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
+		fmt.Printf("Saved template %v with %v tasks\n", tmpl.Name, len(tmpl.Tasks))
+		return nil
+	},
+}
+
+func getTemplatesFromServer() ([]Template, error) {
+	url := serverURL("/templates")
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readError(resp)
+	}
+	var templates []Template
+	err = json.NewDecoder(resp.Body).Decode(&templates)
+	return templates, err
+}
+
+func getTemplateFromServer(name string) (Template, error) {
+	url := serverURL("/templates/" + url.PathEscape(name))
+
+	resp, err := apiClient.Get(url)
+	if err != nil {
+		return Template{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Template{}, readError(resp)
+	}
+	var tmpl Template
+	err = json.NewDecoder(resp.Body).Decode(&tmpl)
+	return tmpl, err
+}
+
+var templateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the task templates",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		templates, err := getTemplatesFromServer()
+		if err != nil {
+			return err
+		}
+		for _, tmpl := range templates {
+			fmt.Printf("%v\t%v tasks\t%v\n", tmpl.Name, len(tmpl.Tasks), tmpl.Desc)
+		}
+		return nil
+	},
+}
+
+var templateShowCmd = &cobra.Command{
+	Use:   "show NAME",
+	Short: "Show the tasks and variables of a template",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tmpl, err := getTemplateFromServer(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(tmpl.Name)
+		if tmpl.Desc != "" {
+			fmt.Println(tmpl.Desc)
+		}
+		if vars := tmpl.vars(); len(vars) > 0 {
+			fmt.Println("Variables:", strings.Join(vars, ", "))
+		}
+		for _, t := range tmpl.Tasks {
+			line := "- " + t.Name
+			if t.Tag != "" {
+				line += " [" + t.Tag + "]"
+			}
+			if t.Type != "" {
+				line += " (" + t.Type + ")"
+			}
+			if t.Due != "" {
+				line += " due +" + strings.TrimPrefix(t.Due, "+")
+			}
+			fmt.Println(line)
+			if t.Desc != "" {
+				fmt.Println("  " + t.Desc)
+			}
+		}
+		return nil
+	},
+}
+
+var templateDelCmd = &cobra.Command{
+	Use:     "delete NAME",
+	Aliases: []string{"del"},
+	Short:   "Delete a template by its name",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url := serverURL("/templates/" + url.PathEscape(args[0]))
+
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := apiClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
+		return nil
+	},
+}
+
+var templateApplyCmd = &cobra.Command{
+	Use:   "apply NAME",
+	Short: "Create the tasks of a template",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		varArgs, err := cmd.Flags().GetStringArray("var")
+		if err != nil {
+			return err
+		}
+		vars, err := parseFieldArgs(varArgs)
+		if err != nil {
+			return err
+		}
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(map[string]interface{}{"Vars": vars})
+		if err != nil {
+			return err
+		}
+
+		url := serverURL("/templates/" + url.PathEscape(args[0]) + "/apply")
+		if force {
+			url += "?force=true"
+		}
+		res, err := apiClient.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(body))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return readError(res)
+		}
+		var tasks []Task
+		if err = json.NewDecoder(res.Body).Decode(&tasks); err != nil {
+			return err
+		}
+		if err = getWorkflowFromServer(); err != nil {
+			return err
+		}
+		table := setupTable(tasks)
+		fmt.Print(table.View())
+		return nil
+	},
 }
 
 func init() {
@@ -384,6 +1623,51 @@ func init() {
 		"",
 		"specify a description for your task",
 	)
+	addCmd.Flags().String(
+		"due",
+		"",
+		"specify a due date for your task, as YYYY-MM-DD or an offset from today like 3d or 1w",
+	)
+	addCmd.Flags().StringArray(
+		"set",
+		nil,
+		"set a user-defined field as key=value, can be repeated",
+	)
+	// list cmd flags
+	listCmd.Flags().StringP(
+		"status",
+		"s",
+		"",
+		"only list tasks with the given status",
+	)
+	listCmd.Flags().StringArray(
+		"where",
+		nil,
+		"only list tasks whose field equals a value, as key=value, can be repeated",
+	)
+	listCmd.Flags().String(
+		"sort",
+		"",
+		"sort by fields, e.g. estimate or -created,name for descending order of creation then by name",
+	)
+	listCmd.Flags().Bool(
+		"no-context",
+		false,
+		"ignore the view used as context",
+	)
+	// kanban cmd flags
+	kanbanCmd.Flags().Bool(
+		"no-context",
+		false,
+		"ignore the view used as context",
+	)
+	// view cmd flags
+	viewSaveCmd.Flags().StringP(
+		"description",
+		"d",
+		"",
+		"describe the view",
+	)
 	// update cmd flags
 	updateCmd.Flags().StringP(
 		"name",
@@ -395,19 +1679,140 @@ func init() {
 		"tag",
 		"t",
 		"",
-		"specify a tag for your task",
+		"specify a tag for your task (an empty value clears it)",
 	)
 	updateCmd.Flags().StringP(
 		"description",
 		"d",
 		"",
-		"specify a description for your task",
+		"specify a description for your task (an empty value clears it)",
+	)
+	updateCmd.Flags().String(
+		"filter",
+		"",
+		"update all tasks matching a filter, e.g. 'tag:sprint12 status:todo' (see list --help)",
+	)
+	updateCmd.Flags().BoolP(
+		"yes",
+		"y",
+		false,
+		"don't ask for confirmation when using --filter",
+	)
+	updateCmd.Flags().String(
+		"due",
+		"",
+		"specify a due date for your task, as YYYY-MM-DD or an offset from today like 3d or 1w (an empty value clears it)",
+	)
+	updateCmd.Flags().BoolP(
+		"force",
+		"f",
+		false,
+		"move the task even if its status is at its work-in-progress limit",
 	)
-	updateCmd.Flags().IntP(
+	updateCmd.Flags().StringArray(
+		"set",
+		nil,
+		"set a user-defined field as key=value (an empty value clears it), can be repeated",
+	)
+	updateCmd.Flags().StringP(
 		"status",
 		"s",
-		int(invalidStatus),
-		"specify a completion status for your task (0/1/2 for todo/in progress/done)",
+		"",
+		"specify a status for your task, by name or ID (0/1/2 for todo/in progress/done by default)",
+	)
+	// del cmd flags
+	delCmd.Flags().String(
+		"filter",
+		"",
+		"delete all tasks matching a filter, e.g. 'tag:sprint12 status:done' (see list --help)",
+	)
+	delCmd.Flags().BoolP(
+		"yes",
+		"y",
+		false,
+		"don't ask for confirmation when using --filter",
+	)
+	// template cmd flags
+	templateSaveCmd.Flags().String(
+		"file",
+		"",
+		"read the template tasks from a JSON file",
+	)
+	templateSaveCmd.Flags().String(
+		"tag",
+		"",
+		"make the template from the existing tasks with this tag",
+	)
+	templateSaveCmd.Flags().StringP(
+		"description",
+		"d",
+		"",
+		"specify a description for the template",
+	)
+	templateApplyCmd.Flags().StringArray(
+		"var",
+		nil,
+		"set a template variable as key=value, can be repeated",
+	)
+	templateApplyCmd.Flags().BoolP(
+		"force",
+		"f",
+		false,
+		"create the tasks even if their status is at its work-in-progress limit",
+	)
+	// serve cmd flags
+	serveCmd.Flags().Bool(
+		"tls",
+		false,
+		"serve over HTTPS, with a certificate generated in the data directory unless --cert and --key are given",
+	)
+	serveCmd.Flags().Bool(
+		"mtls",
+		false,
+		"serve over HTTPS and only to the devices with a certificate from task-gopher device enroll",
+	)
+	serveCmd.Flags().String(
+		"cert",
+		"",
+		"serve over HTTPS with the certificate in this PEM file",
+	)
+	serveCmd.Flags().String(
+		"key",
+		"",
+		"the PEM file of the private key of --cert",
+	)
+	serveCmd.Flags().String(
+		"grpc-port",
+		"",
+		"also serve the gRPC API on this port, GRPC_PORT if not given",
+	)
+	// login cmd flags
+	loginCmd.Flags().String(
+		"cert",
+		"",
+		"log in with the certificate of this device instead of a token, from task-gopher device enroll",
+	)
+	loginCmd.Flags().String(
+		"key",
+		"",
+		"the private key of --cert",
+	)
+	// device cmd flags
+	deviceEnrollCmd.Flags().String(
+		"scope",
+		scopeWrite,
+		"what the device may do, read or write",
+	)
+	deviceEnrollCmd.Flags().String(
+		"out",
+		".",
+		"the directory to write the certificate and its key to",
+	)
+	// token cmd flags
+	tokenCreateCmd.Flags().String(
+		"scope",
+		scopeWrite,
+		"what the token allows, read or write",
 	)
 	// add all commands
 	rootCmd.AddCommand(addCmd)
@@ -417,4 +1822,28 @@ func init() {
 	rootCmd.AddCommand(kanbanCmd)
 	rootCmd.AddCommand(dropDBCmd)
 	rootCmd.AddCommand(serveCmd)
+	fieldCmd.AddCommand(fieldAddCmd)
+	fieldCmd.AddCommand(fieldListCmd)
+	fieldCmd.AddCommand(fieldDelCmd)
+	rootCmd.AddCommand(fieldCmd)
+	templateCmd.AddCommand(templateSaveCmd)
+	templateCmd.AddCommand(templateListCmd)
+	templateCmd.AddCommand(templateShowCmd)
+	templateCmd.AddCommand(templateDelCmd)
+	templateCmd.AddCommand(templateApplyCmd)
+	rootCmd.AddCommand(templateCmd)
+	viewCmd.AddCommand(viewSaveCmd)
+	viewCmd.AddCommand(viewUseCmd)
+	viewCmd.AddCommand(viewListCmd)
+	viewCmd.AddCommand(viewDelCmd)
+	rootCmd.AddCommand(viewCmd)
+	rootCmd.AddCommand(loginCmd)
+	tokenCmd.AddCommand(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+	rootCmd.AddCommand(tokenCmd)
+	deviceCmd.AddCommand(deviceEnrollCmd)
+	deviceCmd.AddCommand(deviceListCmd)
+	deviceCmd.AddCommand(deviceRevokeCmd)
+	rootCmd.AddCommand(deviceCmd)
 }
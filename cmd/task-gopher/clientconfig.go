@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// clientConfigPath is where a client keeps its own settings, unlike config.json which configures the server
+var clientConfigPath = projectDir + "/client.json"
+
+// A ClientConfig holds the settings of a client
+type ClientConfig struct {
+	Context string `json:",omitempty"` // the view applied to list and kanban, if any
+	Token   string `json:",omitempty"` // the API token sent to the server, see task-gopher login
+
+	// the certificate of this device and its key, issued by task-gopher device enroll
+	CertFile string `json:",omitempty"`
+	KeyFile  string `json:",omitempty"`
+
+	KnownServers map[string]string `json:",omitempty"` // fingerprints of the certificates of the servers by host:port, see verifyServer
+}
+
+// loadClientConfig reads the client config, a missing file returns the defaults
+func loadClientConfig() (ClientConfig, error) {
+	var cfg ClientConfig
+	data, err := os.ReadFile(clientConfigPath)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// save writes the client config
+func (cfg ClientConfig) save() error {
+	data, err := json.MarshalIndent(cfg, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(clientConfigPath, data, 0o600)
+}
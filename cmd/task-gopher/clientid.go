@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// clientIDHeader names the client sending a request, so it isn't told about its own changes, see notifyChange
+// Browsers can't set headers on WebSockets, so /ws also takes it as the client_id query parameter.
+const clientIDHeader = "X-Client-ID"
+
+const maxClientIDLength = 64
+
+// validateClientID checks that a client ID is short and only has letters, digits and ".-_:", like a UUID
+func validateClientID(id string) error {
+	if len(id) > maxClientIDLength {
+		return fmt.Errorf("the client ID must have at most %v characters", maxClientIDLength)
+	}
+	for _, r := range id {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune(".-_:", r)) {
+			return fmt.Errorf("the client ID must only have letters, digits and .-_:")
+		}
+	}
+	return nil
+}
+
+// checkClientID refuses the requests with an invalid client ID, and stores the client ID of the others in the
+// context under "clientID", "" if they have none
+func checkClientID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(clientIDHeader)
+		if id == "" && c.IsWebSocket() {
+			id = c.QueryParam("client_id")
+		}
+		if err := validateClientID(id); err != nil {
+			return &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: err.Error(), Field: clientIDHeader}
+		}
+		c.Set("clientID", id)
+		return next(c)
+	}
+}
+
+// clientID returns the client ID of a request, "" if it has none
+// The changes made without one are sent to all the clients.
+func clientID(c echo.Context) string {
+	id, _ := c.Get("clientID").(string)
+	return id
+}
+
+// A changeOrigin is the client that made a change, which isn't told about it, see wsHub
+// The client ID comes with the device or token of the client, so a client can't hide its changes from another
+// by sending its ID, which the events tell everyone.
+type changeOrigin struct {
+	clientID string // "" for the changes of the server, or of the clients without an ID
+	who      string // "device NAME" or "token NAME", see requester
+}
+
+// requestOrigin returns the origin of the changes made by a request
+func requestOrigin(c echo.Context) changeOrigin {
+	return changeOrigin{clientID(c), requester(c)}
+}
+
+// newClientID returns a random client ID, for the websocket clients that don't have one
+func newClientID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestValidateClientID(t *testing.T) {
+	var tests = []struct {
+		id      string
+		wantErr bool
+	}{
+		{"", false},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", false},
+		{"cli-1.host:2_a", false},
+		{strings.Repeat("a", maxClientIDLength), false},
+		{strings.Repeat("a", maxClientIDLength+1), true},
+		{"web 1", true},
+		{"web/1", true},
+		{"clé", true},
+	}
+	for _, tt := range tests {
+		if err := validateClientID(tt.id); (err != nil) != tt.wantErr {
+			t.Errorf("validateClientID(%q) = %v, want error %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClientIDSuppression(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "laptop", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone, err := createToken(db, Token{Name: "phone", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+
+	// the web app and a board on the same machine, so at the same address
+	dial := func(clientID string) (*websocket.Conn, Event) {
+		t.Helper()
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + apiPrefix + "/ws?access_token=" + token
+		if clientID != "" {
+			url += "&client_id=" + clientID
+		}
+		dialer := websocket.Dialer{Subprotocols: []string{eventsProtocol}}
+		ws, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var hello Event
+		if err = ws.ReadJSON(&hello); err != nil || hello.Type != eventConnected {
+			t.Fatalf("got hello %+v, %v", hello, err)
+		}
+		return ws, hello
+	}
+	web, hello := dial("web-1")
+	if hello.ClientID != "web-1" {
+		t.Errorf("got client ID %q in the hello, want web-1", hello.ClientID)
+	}
+	board, hello := dial("")
+	if hello.ClientID == "" {
+		t.Error("the connection without a client ID didn't get one")
+	}
+	waitForConnections(t, "token laptop", 2)
+
+	add := func(token, clientID, name string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, server.URL+apiPrefix+"/tasks/add", strings.NewReader(`{"Name": "`+name+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if clientID != "" {
+			req.Header.Set(clientIDHeader, clientID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	receive := func(ws *websocket.Conn, wantName, wantClientID string) {
+		t.Helper()
+		var event Event
+		if err := ws.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != eventTaskCreated || event.Task.Name != wantName || event.ClientID != wantClientID {
+			t.Fatalf("got event %+v, want %v created by %q", event, wantName, wantClientID)
+		}
+	}
+
+	// each client gets the changes of the other, but not its own, in order
+	if code := add(token, "web-1", "deploy"); code != http.StatusOK {
+		t.Fatalf("got status %v", code)
+	}
+	if code := add(token, "cli-1", "review"); code != http.StatusOK {
+		t.Fatalf("got status %v", code)
+	}
+	if code := add(token, "", "release"); code != http.StatusOK {
+		t.Fatalf("got status %v", code)
+	}
+	// the client ID of the web app, read from an event, doesn't hide the changes of another token from it
+	if code := add(phone, "web-1", "spoof"); code != http.StatusOK {
+		t.Fatalf("got status %v", code)
+	}
+	receive(web, "review", "cli-1")
+	receive(web, "release", "")
+	receive(web, "spoof", "web-1")
+	receive(board, "deploy", "web-1")
+	receive(board, "review", "cli-1")
+	receive(board, "release", "")
+	receive(board, "spoof", "web-1")
+
+	if code := add(token, "web 1", "invalid"); code != http.StatusBadRequest {
+		t.Errorf("got status %v for an invalid client ID, want %v", code, http.StatusBadRequest)
+	}
+}
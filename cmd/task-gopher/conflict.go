@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errVersionConflict reports that a task changed since the version an update was based on
+var errVersionConflict = errors.New("the task was changed by someone else")
+
+// A conflictError is returned by the server when an update is based on an old version of a task
+type conflictError struct {
+	Current Task // the task as it is on the server
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("task %v was changed by someone else (now at version %v)", e.Current.ID, e.Current.Version)
+}
+
+// formatETag returns the entity tag of a version of a task
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETag returns the version in an If-Match header, or 0 for "*" which matches any version
+func parseETag(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "*" {
+		return 0, nil
+	}
+	s = strings.TrimPrefix(s, "W/")
+	version, err := strconv.ParseInt(strings.Trim(s, `"`), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid entity tag %q", s)
+	}
+	return version, nil
+}
+
+// A fieldConflict is a field that both the client and someone else changed to different values
+type fieldConflict struct {
+	Key                string // the key of the field in the update, e.g. Status or Fields.estimate
+	Base, Theirs, Mine string
+}
+
+// updateKeys maps the keys of an update to the task values they change, see taskValue
+var updateKeys = map[string]string{"Name": "name", "Desc": "desc", "Status": "status", "Type": "type", "Tag": "tag", "Due": "due"}
+
+// threeWayMerge rebases the changes of an update, made to base, onto theirs, the current version of the task
+// Changes to values that only the client changed are kept, and those that end up as theirs are dropped.
+// The values that both changed to different values are returned as conflicts, and are left in the changes.
+func threeWayMerge(base, theirs Task, changes map[string]interface{}) (map[string]interface{}, []fieldConflict) {
+	var merged = map[string]interface{}{}
+	var conflicts []fieldConflict
+	check := func(key, value, mine string) bool {
+		b, t := taskValue(base, value), taskValue(theirs, value)
+		switch {
+		case t == b:
+			return true
+		case t == mine:
+			return false
+		}
+		conflicts = append(conflicts, fieldConflict{key, b, t, mine})
+		return true
+	}
+	for key, change := range changes {
+		if key == "Fields" {
+			fields, _ := change.(map[string]string)
+			var kept = map[string]string{}
+			for name, mine := range fields {
+				if check("Fields."+name, name, mine) {
+					kept[name] = mine
+				}
+			}
+			if len(kept) > 0 {
+				merged[key] = kept
+			}
+			continue
+		}
+		value, ok := updateKeys[key]
+		s, isString := change.(string)
+		if !ok || (!isString && change != nil) {
+			// not a change of a value
+			merged[key] = change
+			continue
+		}
+		// nil clears the value
+		if check(key, value, normalizeChange(key, s)) {
+			merged[key] = change
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Key < conflicts[j].Key })
+	return merged, conflicts
+}
+
+// normalizeChange returns a changed value as taskValue shows it, e.g. the name of a status given by ID
+func normalizeChange(key, s string) string {
+	if s == "" {
+		return ""
+	}
+	switch key {
+	case "Status":
+		if st, err := workflow.parse(s); err == nil {
+			return st.String()
+		}
+	case "Due":
+		if due, err := parseDue(s, time.Now()); err == nil {
+			return formatDue(due)
+		}
+	}
+	return s
+}
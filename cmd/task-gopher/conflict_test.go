@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUpdateTaskVersion(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	id, err := addTask(db, "test", "", todo, generic, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := "first", "second"
+	if _, err = updateTask(db, id, 1, TaskPatch{Name: &first}); err != nil {
+		t.Fatal(err)
+	}
+	// an update based on version 1 must not overwrite version 2
+	if _, err = updateTask(db, id, 1, TaskPatch{Name: &second}); err != errVersionConflict {
+		t.Errorf("expected errVersionConflict, got %v", err)
+	}
+	task, err := getTask(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Name != "first" || task.Version != 2 {
+		t.Errorf("got %q at version %v, want %q at version 2", task.Name, task.Version, "first")
+	}
+	// moving a task and changing its due date are changes too
+	if _, err = moveTask(db, id, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = setTaskDue(db, id, task.Created); err != nil {
+		t.Fatal(err)
+	}
+	if task, err = getTask(db, id); err != nil {
+		t.Fatal(err)
+	}
+	if task.Version != 4 {
+		t.Errorf("got version %v, want 4", task.Version)
+	}
+}
+
+func TestCreateTaskVersion(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	// a new task is at version 1, with or without a due date
+	for _, req := range []NewTask{{Name: "deploy"}, {Name: "release", Due: "2030-01-02"}} {
+		task, err := createTask(req, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.Version != 1 || formatDue(task.Due) != req.Due {
+			t.Errorf("got task %+v, want version 1 and due %q", task, req.Due)
+		}
+	}
+}
+
+func TestParseETag(t *testing.T) {
+	var tests = []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{`"3"`, 3, false},
+		{`W/"3"`, 3, false},
+		{"*", 0, false},
+		{formatETag(42), 42, false},
+		{`"0"`, 0, true},
+		{`"abc"`, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseETag(tt.input)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseETag(%q) = %v, %v, want %v", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestThreeWayMerge(t *testing.T) {
+	base := Task{ID: 1, Name: "deploy", Status: todo, Tag: "ops", Fields: map[string]string{"env": "dev"}, Version: 1}
+	var tests = []struct {
+		name          string
+		theirs        Task
+		changes       map[string]interface{}
+		want          map[string]interface{}
+		wantConflicts []fieldConflict
+	}{
+		{
+			"others changed other values",
+			Task{ID: 1, Name: "deploy v2", Status: todo, Tag: "ops", Version: 2},
+			map[string]interface{}{"Status": "in progress", "Desc": "steps"},
+			map[string]interface{}{"Status": "in progress", "Desc": "steps"},
+			nil,
+		},
+		{
+			"others made the same change",
+			Task{ID: 1, Name: "deploy", Status: inProgress, Tag: "ops", Version: 2},
+			map[string]interface{}{"Status": "1"},
+			map[string]interface{}{},
+			nil,
+		},
+		{
+			"both changed the status",
+			Task{ID: 1, Name: "deploy", Status: done, Tag: "ops", Version: 2},
+			map[string]interface{}{"Status": "in progress", "Tag": "infra"},
+			map[string]interface{}{"Status": "in progress", "Tag": "infra"},
+			[]fieldConflict{{"Status", "todo", "done", "in progress"}},
+		},
+		{
+			"others cleared the same value",
+			Task{ID: 1, Name: "deploy", Status: todo, Version: 2},
+			map[string]interface{}{"Tag": nil},
+			map[string]interface{}{},
+			nil,
+		},
+		{
+			"both changed a field",
+			Task{ID: 1, Name: "deploy", Status: todo, Tag: "ops", Fields: map[string]string{"env": "prod"}, Version: 2},
+			map[string]interface{}{"Fields": map[string]string{"env": "qa"}, "Tag": nil},
+			map[string]interface{}{"Fields": map[string]string{"env": "qa"}, "Tag": nil},
+			[]fieldConflict{{"Fields.env", "dev", "prod", "qa"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := threeWayMerge(base, tt.theirs, tt.changes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got changes %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("got conflicts %v, want %v", conflicts, tt.wantConflicts)
+			}
+		})
+	}
+}
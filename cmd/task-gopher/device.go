@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// crlFile lists the serial numbers of the revoked device certificates, in dataDir
+const crlFile = "crl.pem"
+
+// how long the certificate of a device is valid, it is enrolled again after that
+const deviceValidity = 2 * 365 * 24 * time.Hour
+
+// A Device is a client authenticated by a certificate issued by the CA of the server
+type Device struct {
+	Name    string    // the name of the device, the common name of its certificate
+	Scope   string    // what the device may do, scopeRead or scopeWrite
+	Serial  string    // the serial number of the certificate, in hexadecimal
+	Created time.Time // timestamp of when the device was enrolled
+	Revoked time.Time // timestamp of when the device was revoked, zero if it wasn't
+}
+
+// validate checks that a device has a name and a known scope
+func (d Device) validate() error {
+	return Token{Name: d.Name, Scope: d.Scope}.validate()
+}
+
+// enrollDevice issues a certificate for a device from the CA in dir, and records the device
+// It returns the certificate and its private key, both PEM encoded.
+func enrollDevice(db *sql.DB, dir string, d Device) (certPEM, keyPEM []byte, err error) {
+	if err = d.validate(); err != nil {
+		return nil, nil, err
+	}
+	if _, err = getDevice(db, d.Name); err == nil {
+		return nil, nil, fmt.Errorf("the device %q is already enrolled, revoke it first", d.Name)
+	} else if err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	caCert, caKey, err := ensureCA(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"task-gopher"}, CommonName: d.Name},
+		NotBefore:   d.Created.Add(-time.Hour),
+		NotAfter:    d.Created.Add(deviceValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := signCertificate(template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlStatement := `INSERT INTO devices(serial, name, scope, created) values (?, ?, ?, ?);`
+	_, err = db.Exec(sqlStatement, template.SerialNumber.Text(16), d.Name, d.Scope, d.Created.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodePEM("CERTIFICATE", der), encodePEM("EC PRIVATE KEY", keyDER), nil
+}
+
+// revokeDevice revokes the certificate of a device and writes the CRL of the revoked certificates in dir
+func revokeDevice(db *sql.DB, dir string, name string, now time.Time) error {
+	res, err := db.Exec(`UPDATE devices SET revoked = ? WHERE name = ? AND revoked IS NULL;`, now.UTC().Format(time.RFC3339), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return writeCRL(db, dir, now)
+}
+
+// writeCRL writes the list of the revoked device certificates, signed by the CA in dir
+func writeCRL(db *sql.DB, dir string, now time.Time) error {
+	devices, err := getDevices(db)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, err := ensureCA(dir)
+	if err != nil {
+		return err
+	}
+	var revoked []x509.RevocationListEntry
+	for _, d := range devices {
+		if d.Revoked.IsZero() {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(d.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial number %q of device %v", d.Serial, d.Name)
+		}
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: d.Revoked})
+	}
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: revoked,
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(deviceValidity),
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, crlFile), "X509 CRL", der, 0o644)
+}
+
+// revokedSerials returns the serial numbers in the CRL in dir, after checking it was signed by the CA
+// There are none if the file doesn't exist.
+func revokedSerials(dir string, ca *x509.Certificate) (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, crlFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, err
+	}
+	if err = crl.CheckSignatureFrom(ca); err != nil {
+		return nil, fmt.Errorf("%v is not signed by the CA: %v", crlFile, err)
+	}
+	serials := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		serials[entry.SerialNumber.Text(16)] = true
+	}
+	return serials, nil
+}
+
+// getDevice returns the enrolled device with a given name that is not revoked
+func getDevice(db *sql.DB, name string) (Device, error) {
+	return scanDevice(db.QueryRow(`SELECT serial, name, scope, created, revoked FROM devices WHERE name = ? AND revoked IS NULL;`, name))
+}
+
+// getDeviceBySerial returns the device with a given certificate, revoked or not
+func getDeviceBySerial(db *sql.DB, serial string) (Device, error) {
+	return scanDevice(db.QueryRow(`SELECT serial, name, scope, created, revoked FROM devices WHERE serial = ?;`, serial))
+}
+
+// getDevices returns all the devices, including the revoked ones, sorted by name
+func getDevices(db *sql.DB) ([]Device, error) {
+	rows, err := db.Query(`SELECT serial, name, scope, created, revoked FROM devices ORDER BY name ASC, created ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices = []Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// scanDevice reads a device from a row of the devices table
+func scanDevice(row interface{ Scan(dest ...any) error }) (Device, error) {
+	var d Device
+	var created string
+	var revoked sql.NullString
+	if err := row.Scan(&d.Serial, &d.Name, &d.Scope, &created, &revoked); err != nil {
+		return d, err
+	}
+	var err error
+	if d.Created, err = time.Parse(time.RFC3339, created); err != nil {
+		return d, err
+	}
+	if revoked.Valid {
+		d.Revoked, err = time.Parse(time.RFC3339, revoked.String)
+	}
+	return d, err
+}
+
+// mutualTLSConfig adds the verification of the device certificates to the TLS config of the server
+// Every connection needs a certificate issued by the CA in dir that is not in its CRL.
+func mutualTLSConfig(cfg *tls.Config, dir string) error {
+	ca, _, err := ensureCA(dir)
+	if err != nil {
+		return err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	cfg.ClientCAs.AddCert(ca)
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		// the CRL is read on every connection, so revoking a device doesn't need a restart of the server
+		revoked, err := revokedSerials(dir, ca)
+		if err != nil {
+			return err
+		}
+		for _, chain := range verifiedChains {
+			if revoked[chain[0].SerialNumber.Text(16)] {
+				return fmt.Errorf("the certificate of device %v was revoked", chain[0].Subject.CommonName)
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// requestDevice returns the device of the certificate of a request, if it has a valid one
+func requestDevice(c echo.Context) (Device, bool, error) {
+	d, ok, err := connectionDevice(c.Request().TLS)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusUnauthorized {
+		return d, false, unauthorized(c, apiErr.Message)
+	}
+	return d, ok, err
+}
+
+// connectionDevice returns the device of the certificate of a TLS connection, if it has a valid one
+func connectionDevice(state *tls.ConnectionState) (Device, bool, error) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return Device{}, false, nil
+	}
+	cert := state.VerifiedChains[0][0]
+	d, err := getDeviceBySerial(db, cert.SerialNumber.Text(16))
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, false, newAPIError(http.StatusUnauthorized, codeUnauthorized, fmt.Sprintf("The certificate of %v was not issued by this server", cert.Subject.CommonName))
+	}
+	if err != nil {
+		return d, false, internalError("Could not check the device certificate", err)
+	}
+	// the connection may have been opened before the device was revoked
+	if !d.Revoked.IsZero() {
+		return d, false, newAPIError(http.StatusUnauthorized, codeUnauthorized, fmt.Sprintf("The device %v was revoked", d.Name))
+	}
+	return d, true, nil
+}
+
+// handleGetDevice returns the device of the request, so clients can check their certificate
+func handleGetDevice(c echo.Context) error {
+	d, ok := c.Get("device").(Device)
+	if !ok {
+		return notFound("The request has no device certificate")
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
+// requester names who sent a request, for the logs: a device or a token
+func requester(c echo.Context) string {
+	if d, ok := c.Get("device").(Device); ok {
+		return "device " + d.Name
+	}
+	if t, ok := c.Get("token").(Token); ok {
+		return "token " + t.Name
+	}
+	return "anonymous"
+}
+
+// loadDeviceCertificate returns the certificate of this device in the client config, nil if it has none
+func loadDeviceCertificate() (*tls.Certificate, error) {
+	cfg, err := loadClientConfig()
+	if err != nil || cfg.CertFile == "" {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the device certificate: %v", err)
+	}
+	return &cert, nil
+}
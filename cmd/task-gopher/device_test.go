@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnrollDevice(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	dir := t.TempDir()
+
+	now := time.Now()
+	certPEM, keyPEM, err := enrollDevice(db, dir, Device{Name: "phone", Scope: scopeRead, Created: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("the certificate doesn't match its key: %v", err)
+	}
+	ca, err := readCertificate(filepath.Join(dir, caCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leaf.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("the certificate is not signed by the CA: %v", err)
+	}
+	if leaf.Subject.CommonName != "phone" {
+		t.Errorf("got common name %q, want phone", leaf.Subject.CommonName)
+	}
+	if _, _, err = enrollDevice(db, dir, Device{Name: "phone", Scope: scopeRead, Created: now}); err == nil {
+		t.Errorf("enrolled the same device twice")
+	}
+
+	if err = revokeDevice(db, dir, "phone", now); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := revokedSerials(dir, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked[leaf.SerialNumber.Text(16)] {
+		t.Errorf("got revoked serials %v, want %v", revoked, leaf.SerialNumber.Text(16))
+	}
+	if err = revokeDevice(db, dir, "phone", now); err != sql.ErrNoRows {
+		t.Errorf("got %v revoking a revoked device, want sql.ErrNoRows", err)
+	}
+	// a revoked device can be enrolled again, with a new certificate
+	if _, _, err = enrollDevice(db, dir, Device{Name: "phone", Scope: scopeRead, Created: now}); err != nil {
+		t.Errorf("could not enroll a revoked device again: %v", err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	dir := t.TempDir()
+
+	certFile, keyFile, err := ensureCertificates(dir, []string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(newServer())
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	if err = mutualTLSConfig(server.TLS, dir); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	certPEM, keyPEM, err := enrollDevice(db, dir, Device{Name: "laptop", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+		}}
+	}
+
+	res, err := client(deviceCert).Get(server.URL + apiPrefix + "/device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d Device
+	err = json.NewDecoder(res.Body).Decode(&d)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusOK || d.Name != "laptop" {
+		t.Errorf("got device %+v, status %v, error %v, want laptop", d, res.StatusCode, err)
+	}
+
+	// connections without a certificate are refused
+	if _, err = client().Get(server.URL + apiPrefix + "/tasks"); err == nil {
+		t.Errorf("got a response without a certificate")
+	}
+
+	// and so are those of revoked devices
+	if err = revokeDevice(db, dir, "laptop", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client(deviceCert).Get(server.URL + apiPrefix + "/tasks"); err == nil {
+		t.Errorf("got a response with a revoked certificate")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// eventsProtocol is the websocket subprotocol of /ws sending typed JSON events, see Event
+// The clients that don't ask for it on connect get the text message "UPDATE" instead, for any change.
+const eventsProtocol = "task-gopher.events.v1"
+
+// the types of the events
+const (
+	eventConnected     = "connected"
+	eventTaskCreated   = "task.created"
+	eventTaskUpdated   = "task.updated"
+	eventTaskDeleted   = "task.deleted"
+	eventDailiesReset  = "dailies.reset"
+	eventFieldsChanged = "fields.changed"
+	eventTasksBulk     = "tasks.bulk"
+)
+
+// An Event tells the websocket clients of eventsProtocol how the tasks changed
+type Event struct {
+	ID      int64     // increasing in the order the events are sent, see sendUpdateSockets
+	Type    string    // one of connected, task.created, task.updated, task.deleted, dailies.reset, fields.changed or tasks.bulk
+	Time    time.Time // when the change was made
+	Task    *Task     `json:",omitempty"` // the task after the change, or before its deletion
+	Changed []string  `json:",omitempty"` // the values of an updated task that changed, e.g. Status or Fields.points, or of any task of tasks.bulk
+	Tasks   []Task    `json:",omitempty"` // the tasks reset by dailies.reset
+	Field   string    `json:",omitempty"` // the field created, changed or deleted by fields.changed
+	IDs     []int64   `json:",omitempty"` // the tasks changed or deleted by tasks.bulk
+	Deleted bool      `json:",omitempty"` // whether tasks.bulk deleted the tasks instead of changing them
+
+	// the client that made the change, see checkClientID, or the ID of the connection for connected
+	ClientID string `json:",omitempty"`
+}
+
+// lastEventID is the ID of the last event sent, the IDs start over with the server
+// The IDs are shared by all the connections and a client isn't sent the events of its own changes, so the IDs
+// a client gets have gaps; a client that reconnects fetches the tasks again instead of replaying the events.
+var lastEventID atomic.Int64
+
+// newEvent returns an event of a type, it gets its ID when it is sent
+func newEvent(eventType string) Event {
+	return Event{Type: eventType, Time: time.Now().UTC()}
+}
+
+// connected returns the first event of a connection, with the ID of the last event instead of a new one
+// and the client ID of the connection, which the client sends with its requests.
+func connected(clientID string) Event {
+	return Event{ID: lastEventID.Load(), Type: eventConnected, Time: time.Now().UTC(), ClientID: clientID}
+}
+
+// taskCreated returns the event of a new task
+func taskCreated(task Task) Event {
+	e := newEvent(eventTaskCreated)
+	e.Task = &task
+	return e
+}
+
+// taskUpdated returns the event of a changed task
+func taskUpdated(task Task, changed []string) Event {
+	e := newEvent(eventTaskUpdated)
+	e.Task, e.Changed = &task, changed
+	return e
+}
+
+// taskDeleted returns the event of a deleted task
+func taskDeleted(task Task) Event {
+	e := newEvent(eventTaskDeleted)
+	e.Task = &task
+	return e
+}
+
+// dailiesReset returns the event of the daily tasks reset to the initial status
+func dailiesReset(tasks []Task) Event {
+	e := newEvent(eventDailiesReset)
+	e.Tasks = tasks
+	return e
+}
+
+// fieldsChanged returns the event of a field definition created, changed or deleted
+func fieldsChanged(name string) Event {
+	e := newEvent(eventFieldsChanged)
+	e.Field = name
+	return e
+}
+
+// tasksBulk returns the event of a bulk change, a single one however many tasks it changed or deleted
+// so the clients' queues don't fill up; the clients fetch the changed tasks if they need them.
+func tasksBulk(before, after []Task, deleted bool) Event {
+	e := newEvent(eventTasksBulk)
+	e.Deleted = deleted
+	seen := map[string]bool{}
+	for i, task := range after {
+		e.IDs = append(e.IDs, task.ID)
+		if deleted {
+			continue
+		}
+		for _, name := range changedValues(before[i], task) {
+			if !seen[name] {
+				seen[name] = true
+				e.Changed = append(e.Changed, name)
+			}
+		}
+	}
+	return e
+}
+
+// changedValues returns the names of the values that differ between two versions of a task, in the order of Task
+// The changed fields are named like Fields.points, in order.
+func changedValues(before, after Task) []string {
+	var changed []string
+	for _, v := range []struct {
+		name string
+		same bool
+	}{
+		{"Name", before.Name == after.Name},
+		{"Desc", before.Desc == after.Desc},
+		{"Status", before.Status == after.Status},
+		{"Type", before.Type == after.Type},
+		{"Tag", before.Tag == after.Tag},
+		{"Rank", before.Rank == after.Rank},
+		{"Due", before.Due.Equal(after.Due)},
+	} {
+		if !v.same {
+			changed = append(changed, v.name)
+		}
+	}
+	var fields []string
+	for name, value := range before.Fields {
+		if after.Fields[name] != value {
+			fields = append(fields, "Fields."+name)
+		}
+	}
+	for name := range after.Fields {
+		if _, ok := before.Fields[name]; !ok {
+			fields = append(fields, "Fields."+name)
+		}
+	}
+	sort.Strings(fields)
+	return append(changed, fields...)
+}
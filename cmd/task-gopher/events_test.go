@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChangedValues(t *testing.T) {
+	due := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+	before := Task{ID: 1, Name: "deploy", Status: todo, Tag: "work", Due: due, Version: 3, Fields: map[string]string{"points": "3", "owner": "ann"}}
+	var tests = []struct {
+		name   string
+		change func(t Task) Task
+		want   []string
+	}{
+		{"nothing", func(t Task) Task { t.Version++; return t }, nil},
+		{"values", func(t Task) Task { t.Status, t.Tag = inProgress, ""; return t }, []string{"Status", "Tag"}},
+		{"same due date in another zone", func(t Task) Task { t.Due = due.In(time.FixedZone("", 3600)); return t }, nil},
+		{"cleared due date", func(t Task) Task { t.Due = time.Time{}; return t }, []string{"Due"}},
+		{"fields", func(t Task) Task {
+			t.Fields = map[string]string{"points": "5", "sprint": "12"}
+			return t
+		}, []string{"Fields.owner", "Fields.points", "Fields.sprint"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedValues(before, tt.change(before)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebsocketEvents(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "board", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newServer()
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + apiPrefix + "/ws?access_token=" + token
+	dialer := websocket.Dialer{Subprotocols: []string{eventsProtocol}}
+	events, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	legacy, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	events.SetReadDeadline(time.Now().Add(5 * time.Second))
+	legacy.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	receive := func(wantType string) Event {
+		t.Helper()
+		var event Event
+		if err := events.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != wantType {
+			t.Fatalf("got event %+v, want %v", event, wantType)
+		}
+		return event
+	}
+	hello := receive(eventConnected)
+	if _, msg, err := legacy.ReadMessage(); err != nil || string(msg) != "Websocket connected!" {
+		t.Fatalf("got hello %q, %v", msg, err)
+	}
+
+	// the changes are made from another address, which the clients are told about
+	request := func(method, path, body string) {
+		t.Helper()
+		req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%v %v: got status %v: %s", method, path, rec.Code, rec.Body)
+		}
+		// the legacy client is told about each change, without the details
+		if _, msg, err := legacy.ReadMessage(); err != nil || string(msg) != "UPDATE" {
+			t.Fatalf("got message %q, %v, want UPDATE", msg, err)
+		}
+	}
+	request(http.MethodPost, "/tasks/add", `{"Name": "deploy", "Tag": "work"}`)
+	created := receive(eventTaskCreated)
+	if created.ID != hello.ID+1 || created.Task == nil || created.Task.Name != "deploy" || created.Time.IsZero() {
+		t.Errorf("got created event %+v after %+v", created, hello)
+	}
+	id := created.Task.ID
+
+	request(http.MethodPatch, "/tasks/"+fmt.Sprint(id), `{"Tag": "ops", "Name": "deploy"}`)
+	updated := receive(eventTaskUpdated)
+	if updated.ID != created.ID+1 || updated.Task.Tag != "ops" || !reflect.DeepEqual(updated.Changed, []string{"Tag"}) {
+		t.Errorf("got updated event %+v, want the new tag", updated)
+	}
+
+	request(http.MethodDelete, "/tasks/"+fmt.Sprint(id), "")
+	if deleted := receive(eventTaskDeleted); deleted.Task.ID != id {
+		t.Errorf("got deleted event %+v, want task %v", deleted, id)
+	}
+}
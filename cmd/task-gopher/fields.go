@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field type enum, the declared type of a user-defined field
+type fieldType string
+
+const (
+	fieldString fieldType = "string"
+	fieldNumber fieldType = "number"
+	fieldDate   fieldType = "date"
+	fieldEnum   fieldType = "enum"
+)
+
+// fieldDateLayout is the format date fields are stored and displayed in
+const fieldDateLayout = "2006-01-02"
+
+// A FieldDef is the declaration of a user-defined task field
+type FieldDef struct {
+	Name    string    // unique field name, used as the key in Task.Fields
+	Type    fieldType // the type of the field, one of {string, number, date, enum}
+	Options []string  `json:",omitempty"` // allowed values of an enum field
+}
+
+// parseFieldType returns the fieldType named by s
+func parseFieldType(s string) (fieldType, error) {
+	switch t := fieldType(strings.ToLower(s)); t {
+	case fieldString, fieldNumber, fieldDate, fieldEnum:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown field type %q (expected string, number, date or enum)", s)
+}
+
+// validate checks that a field definition is complete
+func (def FieldDef) validate() error {
+	if def.Name == "" {
+		return &fieldError{"Name", fmt.Errorf("field name must not be empty")}
+	}
+	if strings.ContainsAny(def.Name, "= \t\n") {
+		return &fieldError{"Name", fmt.Errorf("field name %q must not contain spaces or '='", def.Name)}
+	}
+	if _, err := parseFieldType(string(def.Type)); err != nil {
+		return &fieldError{"Type", err}
+	}
+	if def.Type == fieldEnum && len(def.Options) == 0 {
+		return &fieldError{"Options", fmt.Errorf("enum field %q needs at least one option", def.Name)}
+	}
+	return nil
+}
+
+// normalize checks that value has the type of the field and returns it in its stored form
+func (def FieldDef) normalize(value string) (string, error) {
+	switch def.Type {
+	case fieldNumber:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("field %q expects a number, got %q", def.Name, value)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case fieldDate:
+		d, err := time.Parse(fieldDateLayout, value)
+		if err != nil {
+			return "", fmt.Errorf("field %q expects a date (YYYY-MM-DD), got %q", def.Name, value)
+		}
+		return d.Format(fieldDateLayout), nil
+	case fieldEnum:
+		for _, o := range def.Options {
+			if strings.EqualFold(o, value) {
+				return o, nil
+			}
+		}
+		return "", fmt.Errorf("field %q expects one of %v, got %q", def.Name, def.Options, value)
+	}
+	return value, nil
+}
+
+// addField inserts or replaces a field definition in the database
+func addField(db *sql.DB, def FieldDef) error {
+	if err := def.validate(); err != nil {
+		return err
+	}
+	sqlStatement := `INSERT OR REPLACE INTO fields(name, type, options) values (?, ?, ?);`
+	_, err := db.Exec(sqlStatement, def.Name, def.Type, strings.Join(def.Options, ","))
+	return err
+}
+
+// delField deletes a field definition and all the values tasks hold for it
+func delField(db *sql.DB, name string) error {
+	sqlStatement := `
+        DELETE FROM task_fields WHERE name = ?;
+        DELETE FROM fields WHERE name = ?;`
+	_, err := db.Exec(sqlStatement, name, name)
+	return err
+}
+
+// getFields returns all the field definitions, by name
+func getFields(db queryer) (map[string]FieldDef, error) {
+	rows, err := db.Query(`SELECT name, type, options FROM fields ORDER BY name ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var defs = map[string]FieldDef{}
+	for rows.Next() {
+		var def FieldDef
+		var options string
+		if err := rows.Scan(&def.Name, &def.Type, &options); err != nil {
+			return nil, err
+		}
+		if options != "" {
+			def.Options = strings.Split(options, ",")
+		}
+		defs[def.Name] = def
+	}
+	return defs, rows.Err()
+}
+
+// validateFields checks the given field values against their definitions
+// It returns the values in their stored form; an empty value means the field is cleared
+func validateFields(db queryer, fields map[string]string) (map[string]string, error) {
+	if len(fields) == 0 {
+		return fields, nil
+	}
+	defs, err := getFields(db)
+	if err != nil {
+		return nil, err
+	}
+	var normalized = map[string]string{}
+	for name, value := range fields {
+		def, ok := defs[name]
+		if !ok {
+			return nil, &fieldError{"Fields." + name, fmt.Errorf("unknown field %q", name)}
+		}
+		if value == "" {
+			normalized[name] = ""
+			continue
+		}
+		normalized[name], err = def.normalize(value)
+		if err != nil {
+			return nil, &fieldError{"Fields." + name, err}
+		}
+	}
+	return normalized, nil
+}
+
+// setTaskFields stores the field values of a task, removing the fields with empty values
+func setTaskFields(db queryer, id int64, fields map[string]string) error {
+	fields, err := validateFields(db, fields)
+	if err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if value == "" {
+			_, err = db.Exec(`DELETE FROM task_fields WHERE task_id = ? AND name = ?;`, id, name)
+		} else {
+			_, err = db.Exec(`INSERT OR REPLACE INTO task_fields(task_id, name, value) values (?, ?, ?);`, id, name, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTaskFields returns the field values of a task, or nil if it has none
+func getTaskFields(db queryer, id int64) (map[string]string, error) {
+	rows, err := db.Query(`SELECT name, value FROM task_fields WHERE task_id = ?;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fields map[string]string
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		fields[name] = value
+	}
+	return fields, rows.Err()
+}
+
+// loadTaskFieldsBatch is the number of tasks whose fields loadTaskFields reads at once, below the limit of SQLite
+// on the parameters of a query
+const loadTaskFieldsBatch = 500
+
+// loadTaskFields fills in the field values of the given tasks, reading only theirs
+func loadTaskFields(db queryer, tasks []Task) error {
+	var byID = map[int64]map[string]string{}
+	for start := 0; start < len(tasks); start += loadTaskFieldsBatch {
+		batch := tasks[start:min(start+loadTaskFieldsBatch, len(tasks))]
+		var args []interface{}
+		for _, task := range batch {
+			args = append(args, task.ID)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+		if err := readTaskFields(db, byID, `SELECT task_id, name, value FROM task_fields WHERE task_id IN (`+placeholders+`);`, args...); err != nil {
+			return err
+		}
+	}
+	for i := range tasks {
+		tasks[i].Fields = byID[tasks[i].ID]
+	}
+	return nil
+}
+
+// readTaskFields adds the field values selected by a query to byID, by task ID
+func readTaskFields(db queryer, byID map[int64]map[string]string, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name, value string
+		if err := rows.Scan(&id, &name, &value); err != nil {
+			return err
+		}
+		if byID[id] == nil {
+			byID[id] = map[string]string{}
+		}
+		byID[id][name] = value
+	}
+	return rows.Err()
+}
+
+// parseFieldArgs parses a list of key=value arguments, as given to --set and --where
+func parseFieldArgs(args []string) (map[string]string, error) {
+	var fields = map[string]string{}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		fields[key] = value
+	}
+	return fields, nil
+}
+
+// taskValue returns the value of a built-in or user-defined field of a task, as a string
+func taskValue(t Task, key string) string {
+	switch strings.ToLower(key) {
+	case "id":
+		return fmt.Sprint(t.ID)
+	case "name":
+		return t.Name
+	case "desc", "description":
+		return t.Desc
+	case "tag":
+		return t.Tag
+	case "status":
+		return t.Status.String()
+	case "type":
+		return t.Type.String()
+	case "created":
+		return t.Created.Format(time.RFC3339)
+	case "due":
+		return formatDue(t.Due)
+	}
+	return t.Fields[key]
+}
+
+// filterTasksByFields returns the tasks whose fields equal all the given values
+func filterTasksByFields(tasks []Task, where map[string]string) []Task {
+	var filtered []Task
+	for _, task := range tasks {
+		matches := true
+		for key, value := range where {
+			if !strings.EqualFold(taskValue(task, key), value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, task)
+		}
+	}
+	return filtered
+}
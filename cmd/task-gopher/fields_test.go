@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetTaskFields(t *testing.T) {
+	var tests = []struct {
+		name    string
+		input   map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"string field", map[string]string{"customer": "acme"}, map[string]string{"customer": "acme"}, false},
+		{"number field is normalized", map[string]string{"estimate": "1.50"}, map[string]string{"estimate": "1.5"}, false},
+		{"date field", map[string]string{"due": "2023-11-18"}, map[string]string{"due": "2023-11-18"}, false},
+		{"enum field takes the declared case", map[string]string{"env": "PROD"}, map[string]string{"env": "prod"}, false},
+		{"invalid number", map[string]string{"estimate": "soon"}, nil, true},
+		{"invalid date", map[string]string{"due": "18/11/2023"}, nil, true},
+		{"invalid enum option", map[string]string{"env": "qa"}, nil, true},
+		{"unknown field", map[string]string{"foo": "bar"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db = setupTests()
+			defer teardownTests(db)
+			defs := []FieldDef{
+				{Name: "customer", Type: fieldString},
+				{Name: "estimate", Type: fieldNumber},
+				{Name: "due", Type: fieldDate},
+				{Name: "env", Type: fieldEnum, Options: []string{"dev", "prod"}},
+			}
+			for _, def := range defs {
+				if err := addField(db, def); err != nil {
+					t.Fatal(err)
+				}
+			}
+			id, err := addTask(db, "test", "", todo, generic, "", time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = setTaskFields(db, id, tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			ans, err := getTask(db, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ans.Fields, tt.want) {
+				t.Errorf("got %v, want %v", ans.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelFieldClearsValues(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	if err := addField(db, FieldDef{Name: "customer", Type: fieldString}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := addTask(db, "test", "", todo, generic, "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setTaskFields(db, id, map[string]string{"customer": "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = delField(db, "customer"); err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := getTasks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks[0].Fields != nil {
+		t.Errorf("expected no fields, got %v", tasks[0].Fields)
+	}
+}
+
+func TestLoadTaskFields(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	if err := addField(db, FieldDef{Name: "customer", Type: fieldString}); err != nil {
+		t.Fatal(err)
+	}
+	for _, customer := range []string{"acme", "", "globex"} {
+		id, err := addTask(db, "test", "", todo, generic, "", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = setTaskFields(db, id, map[string]string{"customer": customer}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the fields of the given tasks are read
+	tasks := []Task{{ID: 3}, {ID: 2}, {ID: 1}}
+	if err := loadTaskFields(db, tasks); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{{"customer": "globex"}, nil, {"customer": "acme"}}
+	for i, task := range tasks {
+		if !reflect.DeepEqual(task.Fields, want[i]) {
+			t.Errorf("task %v: got fields %v, want %v", task.ID, task.Fields, want[i])
+		}
+	}
+	if err := loadTaskFields(db, nil); err != nil {
+		t.Errorf("got error %v for no tasks", err)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filters select tasks with terms of the form field:value or field.modifier:value,
+// combined with and, or, not and parentheses. Terms next to each other are and-ed. E.g.:
+//
+//	status:todo and (tag:work or tag:ops) and created.after:-7d
+//	customer:acme estimate.gt:3 not due.none:
+//
+// The modifiers are eq (the default), ne, has, hasnt, before (or lt), after (or gt), any and none.
+// Dates can be given as YYYY-MM-DD, today, yesterday, tomorrow or an offset from today like -7d or 2w.
+// Filters are parsed into an AST, which the server compiles to SQL.
+
+// a filterNode is a node of the AST of a filter
+type filterNode interface {
+	String() string
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+// a filterTerm compares a field of a task to a value
+type filterTerm struct {
+	Field string
+	Op    string
+	Value string
+}
+
+func (n filterAnd) String() string { return "(" + n.left.String() + " and " + n.right.String() + ")" }
+func (n filterOr) String() string  { return "(" + n.left.String() + " or " + n.right.String() + ")" }
+func (n filterNot) String() string { return "not " + n.node.String() }
+func (n filterTerm) String() string {
+	return n.Field + "." + n.Op + ":" + strconv.Quote(n.Value)
+}
+
+// filterOps maps the modifiers and their aliases to the operators of filterTerm
+var filterOps = map[string]string{
+	"eq": "eq", "is": "eq",
+	"ne": "ne", "isnt": "ne", "not": "ne",
+	"has": "has", "contains": "has",
+	"hasnt":  "hasnt",
+	"before": "before", "lt": "before", "below": "before",
+	"after": "after", "gt": "after", "above": "after",
+	"any":  "any",
+	"none": "none",
+}
+
+// filter token kinds
+const (
+	tokWord = iota
+	tokTerm
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind int
+	text string // the word, or the field part of a term
+	val  string // the value part of a term
+}
+
+// lexFilter splits a filter into tokens
+// Values can be quoted with double or single quotes to include spaces or parentheses.
+func lexFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	i := 0
+	for i < len(s) {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{kind: tokLParen, text: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{kind: tokRParen, text: ")"})
+			i++
+		default:
+			var word strings.Builder
+			quoted := false
+			for i < len(s) && !strings.ContainsRune(" \t\n()", rune(s[i])) {
+				if s[i] == '"' || s[i] == '\'' {
+					end := strings.IndexByte(s[i+1:], s[i])
+					if end < 0 {
+						return nil, fmt.Errorf("unterminated quote in filter %q", s)
+					}
+					word.WriteString(s[i+1 : i+1+end])
+					i += end + 2
+					quoted = true
+					continue
+				}
+				word.WriteByte(s[i])
+				i++
+			}
+			w := word.String()
+			if field, value, ok := strings.Cut(w, ":"); ok && field != "" {
+				tokens = append(tokens, filterToken{kind: tokTerm, text: field, val: value})
+			} else if !quoted {
+				tokens = append(tokens, filterToken{kind: tokWord, text: w})
+			} else {
+				return nil, fmt.Errorf("invalid filter term %q (expected field:value)", w)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// maxFilterDepth is how deep the parentheses and nots of a filter may nest, so a filter can't exhaust the stack
+const maxFilterDepth = 64
+
+// a filterParser is a recursive descent parser for filters
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	depth  int // of the parentheses and nots being parsed
+}
+
+// enter goes one level deeper into the filter, leave must be called after the level is parsed
+func (p *filterParser) enter() error {
+	p.depth++
+	if p.depth > maxFilterDepth {
+		return fmt.Errorf("the filter nests more than %v levels deep", maxFilterDepth)
+	}
+	return nil
+}
+
+func (p *filterParser) leave() {
+	p.depth--
+}
+
+// parseFilter parses a filter into its AST, an empty filter returns nil
+func parseFilter(s string) (filterNode, error) {
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &filterParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+func (p *filterParser) peekWord(w string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokWord && strings.EqualFold(p.tokens[p.pos].text, w)
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekWord("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.tokens) && !p.peekWord("or") && p.tokens[p.pos].kind != tokRParen {
+		// "and" is optional between terms
+		if p.peekWord("and") {
+			p.pos++
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.peekWord("not") {
+		p.pos++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case tokLParen:
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokRParen {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		p.pos++
+		return node, nil
+	case tokTerm:
+		field, mod, _ := strings.Cut(tok.text, ".")
+		op := "eq"
+		if mod != "" {
+			var ok bool
+			if op, ok = filterOps[strings.ToLower(mod)]; !ok {
+				return nil, fmt.Errorf("unknown modifier %q in %q", mod, tok.text+":"+tok.val)
+			}
+		}
+		return filterTerm{Field: field, Op: op, Value: tok.val}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in filter (expected field:value)", tok.text)
+}
+
+// parseFilterDate parses a date in a filter, relative dates are relative to now
+func parseFilterDate(s string, now time.Time) (time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch strings.ToLower(s) {
+	case "now":
+		return now.UTC(), nil
+	case "today":
+		return today, nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return parseDue(s, now)
+}
+
+// a filterColumn is how a field is read in SQL
+type filterColumn struct {
+	expr string        // the SQL expression of the field value
+	args []interface{} // the arguments of expr
+	kind fieldType     // how values are compared
+}
+
+// builtinFilterColumns are the columns of the tasks table that filters can use
+var builtinFilterColumns = map[string]filterColumn{
+	"id":          {expr: "tasks.id", kind: fieldNumber},
+	"name":        {expr: "IFNULL(tasks.name, '')", kind: fieldString},
+	"desc":        {expr: "IFNULL(tasks.description, '')", kind: fieldString},
+	"description": {expr: "IFNULL(tasks.description, '')", kind: fieldString},
+	"tag":         {expr: "IFNULL(tasks.tag, '')", kind: fieldString},
+	"status":      {expr: "tasks.status", kind: fieldEnum},
+	"type":        {expr: "tasks.type", kind: fieldEnum},
+	"created":     {expr: "datetime(tasks.created)", kind: fieldDate},
+	"due":         {expr: "IFNULL(tasks.due, '')", kind: fieldDate},
+}
+
+// compileFilter compiles the AST of a filter to an SQL condition on the tasks table and its arguments
+// defs are the user-defined fields that can be used in the filter
+func compileFilter(node filterNode, defs map[string]FieldDef, now time.Time) (string, []interface{}, error) {
+	switch n := node.(type) {
+	case nil:
+		return "1", nil, nil
+	case filterAnd, filterOr:
+		var left, right filterNode
+		op := " AND "
+		if and, ok := n.(filterAnd); ok {
+			left, right = and.left, and.right
+		} else {
+			or := n.(filterOr)
+			left, right, op = or.left, or.right, " OR "
+		}
+		l, largs, err := compileFilter(left, defs, now)
+		if err != nil {
+			return "", nil, err
+		}
+		r, rargs, err := compileFilter(right, defs, now)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + l + op + r + ")", append(largs, rargs...), nil
+	case filterNot:
+		sql, args, err := compileFilter(n.node, defs, now)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT " + sql, args, nil
+	case filterTerm:
+		return compileFilterTerm(n, defs, now)
+	}
+	return "", nil, fmt.Errorf("unknown filter node %T", node)
+}
+
+func compileFilterTerm(t filterTerm, defs map[string]FieldDef, now time.Time) (string, []interface{}, error) {
+	col, ok := builtinFilterColumns[strings.ToLower(t.Field)]
+	if !ok {
+		def, ok := defs[t.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown field %q in filter", t.Field)
+		}
+		col = filterColumn{
+			expr: "IFNULL((SELECT value FROM task_fields WHERE task_fields.task_id = tasks.id AND task_fields.name = ?), '')",
+			args: []interface{}{def.Name},
+			kind: def.Type,
+		}
+	}
+	args := append([]interface{}{}, col.args...)
+
+	switch t.Op {
+	case "any":
+		return col.expr + " != ''", args, nil
+	case "none":
+		return col.expr + " = ''", args, nil
+	case "has", "hasnt":
+		value := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(t.Value)
+		sql := col.expr + ` LIKE ? ESCAPE '\'`
+		if t.Op == "hasnt" {
+			sql = "NOT " + sql
+		}
+		return sql, append(args, "%"+value+"%"), nil
+	}
+
+	// the value to compare to, in the form the column holds it
+	var value interface{} = t.Value
+	expr := col.expr
+	field := strings.ToLower(t.Field)
+	switch {
+	case field == "status":
+		s, err := workflow.parse(t.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		value = int(s)
+	case field == "type":
+		tt, err := parseTaskType(t.Value)
+		if err != nil {
+			return "", nil, err
+		}
+		value = int(tt)
+	case col.kind == fieldNumber:
+		f, err := strconv.ParseFloat(t.Value, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("field %q expects a number, got %q", t.Field, t.Value)
+		}
+		value = f
+		if field != "id" {
+			expr = "CAST(NULLIF(" + col.expr + ", '') AS REAL)"
+		}
+	case col.kind == fieldDate:
+		d, err := parseFilterDate(t.Value, now)
+		if err != nil {
+			return "", nil, fmt.Errorf("field %q expects a date, got %q", t.Field, t.Value)
+		}
+		if field == "created" {
+			value = d.Format("2006-01-02 15:04:05")
+			if t.Op == "eq" || t.Op == "ne" {
+				// compare days, not instants
+				expr = "date(tasks.created)"
+				value = d.Format(dueLayout)
+			}
+		} else {
+			value = d.Format(dueLayout)
+			// tasks without a date are neither before nor after any date
+			expr = "NULLIF(" + col.expr + ", '')"
+		}
+	}
+
+	if col.kind == fieldString || col.kind == fieldEnum && field != "status" && field != "type" {
+		expr += " COLLATE NOCASE"
+	}
+	var sql string
+	switch t.Op {
+	case "eq":
+		sql = expr + " = ?"
+	case "ne":
+		sql = "IFNULL(" + expr + " != ?, 1)"
+	case "before":
+		sql = expr + " < ?"
+	case "after":
+		sql = expr + " > ?"
+	default:
+		return "", nil, fmt.Errorf("unknown operator %q", t.Op)
+	}
+	return sql, append(args, value), nil
+}
+
+// A queryError reports an invalid query, e.g. its filter, as opposed to a failure to run it
+type queryError struct {
+	err error
+}
+
+func (e *queryError) Error() string { return e.err.Error() }
+func (e *queryError) Unwrap() error { return e.err }
+
+// getTasksByFilter returns the tasks matching a filter, all the tasks if it is empty
+func getTasksByFilter(db queryer, filter string) ([]Task, error) {
+	node, err := parseFilter(filter)
+	if err != nil {
+		return nil, &queryError{fmt.Errorf("invalid filter: %w", err)}
+	}
+	defs, err := getFields(db)
+	if err != nil {
+		return nil, err
+	}
+	where, args, err := compileFilter(node, defs, time.Now())
+	if err != nil {
+		return nil, &queryError{fmt.Errorf("invalid filter: %w", err)}
+	}
+	return queryTasks(db, where, args...)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	var tests = []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"", "<nil>", false},
+		{"tag:work", `tag.eq:"work"`, false},
+		{"tag:work status:todo", `(tag.eq:"work" and status.eq:"todo")`, false},
+		{"tag:work AND status:todo or due.none:", `((tag.eq:"work" and status.eq:"todo") or due.none:"")`, false},
+		{"tag:work (status:todo or status:done)", `(tag.eq:"work" and (status.eq:"todo" or status.eq:"done"))`, false},
+		{"not name.has:'a (b)' created.after:-7d", `(not name.has:"a (b)" and created.after:"-7d")`, false},
+		{`status:"in progress"`, `status.eq:"in progress"`, false},
+		{"sprint12", "", true},
+		{"tag:work or", "", true},
+		{"(tag:work", "", true},
+		{"tag:work)", "", true},
+		{"tag.like:work", "", true},
+		{`name:"unterminated`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			node, err := parseFilter(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := "<nil>"
+			if node != nil {
+				got = node.String()
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterDepth(t *testing.T) {
+	nest := func(n int) string {
+		return strings.Repeat("(", n) + "tag:work" + strings.Repeat(")", n)
+	}
+	var tests = []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"parentheses at the limit", nest(maxFilterDepth), false},
+		{"parentheses over the limit", nest(maxFilterDepth + 1), true},
+		{"nots at the limit", strings.Repeat("not ", maxFilterDepth) + "tag:work", false},
+		{"nots over the limit", strings.Repeat("not ", maxFilterDepth+1) + "tag:work", true},
+		{"nots in parentheses", strings.Repeat("not (", maxFilterDepth/2+1) + "tag:work" + strings.Repeat(")", maxFilterDepth/2+1), true},
+		// a body of the size limit
+		{"parentheses of a large body", strings.Repeat("(", 1<<20), true},
+		{"long and", strings.Repeat("tag:work ", 1000), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseFilter(tt.input); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetTasksByFilter(t *testing.T) {
+	var tests = []struct {
+		filter  string
+		want    []int64
+		wantErr bool
+	}{
+		{"", []int64{1, 2, 3, 4}, false},
+		{"tag:WORK", []int64{1, 2}, false},
+		{"tag:work status:done", []int64{2}, false},
+		{"tag:ops or (tag:work and not status:done)", []int64{1, 3}, false},
+		{"tag.ne:work", []int64{3, 4}, false},
+		{"tag.none:", []int64{4}, false},
+		{"name.has:report", []int64{1, 3}, false},
+		{"name.hasnt:report", []int64{2, 4}, false},
+		{"name.has:%", nil, false},
+		{"created.after:-7d", []int64{2, 3, 4}, false},
+		{"created.before:2023-01-01", []int64{1}, false},
+		{"due.before:1w", []int64{3}, false},
+		{"due.any:", []int64{3, 4}, false},
+		{"estimate.gt:2", []int64{2}, false},
+		{"estimate.lt:2.5", []int64{1}, false},
+		{"env:PROD", []int64{1}, false},
+		{"env.ne:prod", []int64{2, 3, 4}, false},
+		{"id.gt:2", []int64{3, 4}, false},
+		{"type:generic", []int64{1, 2, 3, 4}, false},
+		{"foo:bar", nil, true},
+		{"estimate.gt:soon", nil, true},
+		{"due.after:someday", nil, true},
+		{"status:nope", nil, true},
+	}
+	db = setupTests()
+	defer teardownTests(db)
+	for _, def := range []FieldDef{
+		{Name: "estimate", Type: fieldNumber},
+		{Name: "env", Type: fieldEnum, Options: []string{"dev", "prod"}},
+	} {
+		if err := addField(db, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for _, task := range []Task{
+		{Name: "weekly report", Tag: "work", Status: todo, Fields: map[string]string{"estimate": "1", "env": "prod"}},
+		{Name: "deploy", Tag: "work", Status: done, Fields: map[string]string{"estimate": "3", "env": "dev"}},
+		{Name: "incident report", Tag: "ops", Status: inProgress, Due: now.AddDate(0, 0, 2)},
+		{Name: "groceries", Status: todo, Due: now.AddDate(0, 0, 30)},
+	} {
+		id, err := addTask(db, task.Name, "", task.Status, generic, task.Tag, task.Due)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = setTaskFields(db, id, task.Fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`UPDATE tasks SET created = ? WHERE id = 1;`, "2022-06-01T10:00:00+02:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			tasks, err := getTasksByFilter(db, tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var qerr *queryError
+			if err != nil && !errors.As(err, &qerr) {
+				t.Errorf("expected a queryError, got %v", err)
+			}
+			var ids []int64
+			for _, task := range tasks {
+				ids = append(ids, task.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got tasks %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
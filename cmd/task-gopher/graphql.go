@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/labstack/echo/v4"
+)
+
+// graphQLSchemaSource is the GraphQL schema of the API, served at /graphql next to the REST routes
+//
+//go:embed schema.graphql
+var graphQLSchemaSource string
+
+// graphQLSchema resolves the operations of the schema with the same functions as the REST handlers,
+// so they are validated and notified to the websocket clients the same way
+var graphQLSchema = graphql.MustParseSchema(graphQLSchemaSource, &graphQLResolver{}, graphql.UseFieldResolvers(), graphql.MaxDepth(10))
+
+// A graphQLRequest is what the resolvers know of the request of an operation, it is in the context of the operation
+type graphQLRequest struct {
+	method string       // the HTTP method, mutations can't be sent with GET
+	scope  string       // the scope of the device or the token, scopeRead or scopeWrite
+	origin changeOrigin // the client of the request, which isn't told about its own changes
+}
+
+type graphQLRequestKey struct{}
+
+// newGraphQLContext returns the context of the operations of a request
+func newGraphQLContext(c echo.Context) context.Context {
+	req := graphQLRequest{method: c.Request().Method, origin: requestOrigin(c)}
+	if d, ok := c.Get("device").(Device); ok {
+		req.scope = d.Scope
+	} else if t, ok := c.Get("token").(Token); ok {
+		req.scope = t.Scope
+	}
+	return context.WithValue(c.Request().Context(), graphQLRequestKey{}, req)
+}
+
+// A graphQLParams is an operation sent to /graphql, in the body of a POST or in the query of a GET
+type graphQLParams struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions"` // not used, but sent by some clients
+}
+
+// handleGraphQL runs a GraphQL operation, or the subscriptions of a websocket with handleGraphQLWebsocket
+// Errors of the operation are in the errors of the response, with the code of the API error in their extensions.
+func handleGraphQL(c echo.Context) error {
+	if c.IsWebSocket() {
+		return handleGraphQLWebsocket(c)
+	}
+	var params graphQLParams
+	if c.Request().Method == http.MethodGet {
+		params.Query = c.QueryParam("query")
+		params.OperationName = c.QueryParam("operationName")
+		if vars := c.QueryParam("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &params.Variables); err != nil {
+				return &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "variables must be a JSON object", Field: "variables"}
+			}
+		}
+	} else if err := decodeBody(c, &params); err != nil {
+		return err
+	}
+	if params.Query == "" {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "You must provide a query", Field: "query"}
+	}
+	res := graphQLSchema.Exec(newGraphQLContext(c), params.Query, params.OperationName, params.Variables)
+	return c.JSON(http.StatusOK, res)
+}
+
+// A graphQLError is an error of a resolver, with the code of its API error in the extensions of the response
+type graphQLError struct {
+	*APIError
+	current *Task // the current task, when an update conflicts with it
+}
+
+func (e graphQLError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.Code}
+	if e.Field != "" {
+		ext["field"] = e.Field
+	}
+	if e.current != nil {
+		ext["current"] = e.current
+	}
+	return ext
+}
+
+// toGraphQLError returns the error of a resolver for an error of the shared task functions
+func toGraphQLError(err error) error {
+	e := graphQLError{APIError: toAPIError(err)}
+	if e.cause != nil {
+		log.Println("graphql:", e.Message+":", e.cause)
+	}
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		e.current = &conflict.Current
+	}
+	return e
+}
+
+// checkWrite returns an error unless the request of a mutation may change the tasks
+func checkWrite(ctx context.Context) error {
+	req, _ := ctx.Value(graphQLRequestKey{}).(graphQLRequest)
+	if req.method == http.MethodGet {
+		return toGraphQLError(newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "Mutations must be sent with POST"))
+	}
+	if req.scope != scopeWrite {
+		return toGraphQLError(newAPIError(http.StatusForbidden, codeForbidden, fmt.Sprintf("The %v scope doesn't allow changes", req.scope)))
+	}
+	return nil
+}
+
+// notifyGraphQLChange tells the other clients that a mutation changed the tasks
+func notifyGraphQLChange(ctx context.Context, events ...Event) {
+	req, _ := ctx.Value(graphQLRequestKey{}).(graphQLRequest)
+	notifyChange(req.origin, events...)
+}
+
+// parseGraphQLID returns the task ID of an ID argument
+func parseGraphQLID(name string, id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, toGraphQLError(&fieldError{name, fmt.Errorf("Invalid task id %q", id)})
+	}
+	return n, nil
+}
+
+// graphQLResolver resolves the root operations of the schema
+type graphQLResolver struct{}
+
+type tasksArgs struct {
+	Filter *string
+	Sort   *string
+	Limit  int32
+	Cursor *string
+}
+
+func (r *graphQLResolver) Tasks(args tasksArgs) (*taskPageResolver, error) {
+	q := TaskQuery{Filter: deref(args.Filter), Sort: deref(args.Sort), Limit: int(args.Limit), Cursor: deref(args.Cursor)}
+	tasks, next, err := getTaskPage(db, q)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	page := &taskPageResolver{tasks: taskResolvers(tasks)}
+	if next != "" {
+		page.next = &next
+	}
+	return page, nil
+}
+
+func (r *graphQLResolver) Task(args struct{ ID graphql.ID }) (*taskResolver, error) {
+	id, err := parseGraphQLID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	task, err := fetchTask(id)
+	if err != nil && toAPIError(err).Code == codeNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	return &taskResolver{task}, nil
+}
+
+func (r *graphQLResolver) Workflow() []*statusResolver {
+	statuses := make([]*statusResolver, len(workflow))
+	for i, def := range workflow {
+		statuses[i] = &statusResolver{def}
+	}
+	return statuses
+}
+
+// A graphQLFieldValue is the value of a user-defined field, in the results and the arguments of the operations
+type graphQLFieldValue struct {
+	Name  string
+	Value string
+}
+
+type newTaskInput struct {
+	Name   string
+	Desc   *string
+	Status *string
+	Type   *string
+	Tag    *string
+	Due    *string
+	Fields *[]graphQLFieldValue
+}
+
+func (r *graphQLResolver) AddTask(ctx context.Context, args struct {
+	Task  newTaskInput
+	Force bool
+}) (*taskResolver, error) {
+	if err := checkWrite(ctx); err != nil {
+		return nil, err
+	}
+	in := args.Task
+	req := NewTask{Name: in.Name, Desc: deref(in.Desc), Status: deref(in.Status), Type: deref(in.Type), Tag: deref(in.Tag), Due: deref(in.Due)}
+	if in.Fields != nil {
+		req.Fields = fieldValuesBody(*in.Fields)
+	}
+	task, err := createTask(req, args.Force)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	notifyGraphQLChange(ctx, taskCreated(task))
+	return &taskResolver{task}, nil
+}
+
+type taskPatchInput struct {
+	Name   *string
+	Desc   *string
+	Status *string
+	Type   *string
+	Tag    *string
+	Due    *string
+	Fields *[]graphQLFieldValue
+}
+
+func (r *graphQLResolver) UpdateTask(ctx context.Context, args struct {
+	ID      graphql.ID
+	Patch   taskPatchInput
+	Version *int32
+	Force   bool
+}) (*taskResolver, error) {
+	if err := checkWrite(ctx); err != nil {
+		return nil, err
+	}
+	id, err := parseGraphQLID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	// the patch is parsed like a JSON Merge Patch of PATCH /tasks/:id, an empty due date clears it
+	body := map[string]interface{}{}
+	for key, value := range map[string]*string{"Name": args.Patch.Name, "Desc": args.Patch.Desc, "Status": args.Patch.Status, "Type": args.Patch.Type, "Tag": args.Patch.Tag} {
+		if value != nil {
+			body[key] = *value
+		}
+	}
+	if due := args.Patch.Due; due != nil && *due == "" {
+		body["Due"] = nil
+	} else if due != nil {
+		body["Due"] = *due
+	}
+	if args.Patch.Fields != nil {
+		body["Fields"] = fieldValuesBody(*args.Patch.Fields)
+	}
+	patch, err := parseTaskPatch(body, time.Now())
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	var version int64
+	if args.Version != nil {
+		version = int64(*args.Version)
+	}
+	task, changed, err := changeTask(id, version, patch, args.Force)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	notifyGraphQLChange(ctx, taskUpdated(task, changed))
+	return &taskResolver{task}, nil
+}
+
+func (r *graphQLResolver) DeleteTask(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+	if err := checkWrite(ctx); err != nil {
+		return "", err
+	}
+	id, err := parseGraphQLID("id", args.ID)
+	if err != nil {
+		return "", err
+	}
+	task, err := removeTask(id)
+	if err != nil {
+		return "", toGraphQLError(err)
+	}
+	notifyGraphQLChange(ctx, taskDeleted(task))
+	return args.ID, nil
+}
+
+func (r *graphQLResolver) MoveTask(ctx context.Context, args struct {
+	ID     graphql.ID
+	After  *graphql.ID
+	Before *graphql.ID
+}) (*taskResolver, error) {
+	if err := checkWrite(ctx); err != nil {
+		return nil, err
+	}
+	id, err := parseGraphQLID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	var after, before int64
+	if args.After != nil {
+		if after, err = parseGraphQLID("after", *args.After); err != nil {
+			return nil, err
+		}
+	}
+	if args.Before != nil {
+		if before, err = parseGraphQLID("before", *args.Before); err != nil {
+			return nil, err
+		}
+	}
+	task, err := placeTask(id, after, before)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	notifyGraphQLChange(ctx, taskUpdated(task, []string{"Rank"}))
+	return &taskResolver{task}, nil
+}
+
+// WatchTasks sends the tasks matching a filter, then again after every change, until the subscription ends
+func (r *graphQLResolver) WatchTasks(ctx context.Context, args struct {
+	Filter *string
+	Sort   *string
+}) (<-chan []*taskResolver, error) {
+	q := TaskQuery{Filter: deref(args.Filter), Sort: deref(args.Sort), Limit: maxPageSize}
+	// an invalid filter is an error of the subscription, not of its first result
+	tasks, err := getAllTasks(q)
+	if err != nil {
+		return nil, toGraphQLError(err)
+	}
+	changed, stop := changes.subscribe()
+	ch := make(chan []*taskResolver)
+	go func() {
+		defer close(ch)
+		defer stop()
+		for {
+			select {
+			case ch <- taskResolvers(tasks):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+			if tasks, err = getAllTasks(q); err != nil {
+				log.Println("graphql: could not fetch the watched tasks:", err)
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// getAllTasks returns all the tasks of a query, a page at a time
+func getAllTasks(q TaskQuery) ([]Task, error) {
+	var all []Task
+	for {
+		tasks, next, err := getTaskPage(db, q)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, tasks...)
+		if next == "" {
+			return all, nil
+		}
+		q.Cursor = next
+	}
+}
+
+// fieldValuesBody returns field values in the form of the Fields of a request body, see getBodyFields
+func fieldValuesBody(values []graphQLFieldValue) map[string]interface{} {
+	body := make(map[string]interface{}, len(values))
+	for _, v := range values {
+		body[v.Name] = v.Value
+	}
+	return body
+}
+
+// deref returns the value of an optional argument, "" if it is not given
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+type taskPageResolver struct {
+	tasks []*taskResolver
+	next  *string
+}
+
+func (p *taskPageResolver) Tasks() []*taskResolver { return p.tasks }
+func (p *taskPageResolver) NextCursor() *string    { return p.next }
+
+// taskResolvers returns the resolvers of some tasks
+func taskResolvers(tasks []Task) []*taskResolver {
+	resolvers := make([]*taskResolver, len(tasks))
+	for i, t := range tasks {
+		resolvers[i] = &taskResolver{t}
+	}
+	return resolvers
+}
+
+type taskResolver struct {
+	t Task
+}
+
+func (r *taskResolver) ID() graphql.ID        { return graphql.ID(strconv.FormatInt(r.t.ID, 10)) }
+func (r *taskResolver) Name() string          { return r.t.Name }
+func (r *taskResolver) Desc() string          { return r.t.Desc }
+func (r *taskResolver) Type() string          { return r.t.Type.String() }
+func (r *taskResolver) Created() graphql.Time { return graphql.Time{Time: r.t.Created} }
+func (r *taskResolver) Tag() string           { return r.t.Tag }
+func (r *taskResolver) Rank() string          { return r.t.Rank }
+func (r *taskResolver) Version() int32        { return int32(r.t.Version) }
+func (r *taskResolver) Status() *statusResolver {
+	def, ok := workflow.lookup(r.t.Status)
+	if !ok {
+		// a status that was removed from the workflow
+		def = StatusDef{ID: r.t.Status, Name: r.t.Status.String()}
+	}
+	return &statusResolver{def}
+}
+
+func (r *taskResolver) Due() *graphql.Time {
+	if r.t.Due.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: r.t.Due}
+}
+
+// Fields returns the values of the user-defined fields, sorted by name
+func (r *taskResolver) Fields() []graphQLFieldValue {
+	values := make([]graphQLFieldValue, 0, len(r.t.Fields))
+	for name, value := range r.t.Fields {
+		values = append(values, graphQLFieldValue{name, value})
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values
+}
+
+type statusResolver struct {
+	def StatusDef
+}
+
+func (r *statusResolver) ID() int32        { return int32(r.def.ID) }
+func (r *statusResolver) Name() string     { return r.def.Name }
+func (r *statusResolver) Category() string { return string(r.def.Category) }
+func (r *statusResolver) Limit() *int32 {
+	if r.def.Limit == 0 {
+		return nil
+	}
+	limit := int32(r.def.Limit)
+	return &limit
+}
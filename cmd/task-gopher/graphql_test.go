@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// graphQLResult is the result of an operation, with the codes of its errors
+type graphQLResult struct {
+	Data   map[string]json.RawMessage
+	Errors []struct {
+		Message    string
+		Extensions map[string]interface{}
+	}
+}
+
+// postGraphQL runs an operation through the server with a token
+func postGraphQL(t *testing.T, e http.Handler, token, query string, vars map[string]interface{}) graphQLResult {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": vars})
+	req := httptest.NewRequest(http.MethodPost, apiPrefix+"/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var res graphQLResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestGraphQL(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	read, err := createToken(db, Token{Name: "dashboard", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write, err := createToken(db, Token{Name: "service", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newServer()
+
+	const add = `mutation($name: String!) { addTask(task: {name: $name, tag: "work", due: "2030-01-02", fields: []}) { id name tag due version status { name } } }`
+	res := postGraphQL(t, e, write, add, map[string]interface{}{"name": "write docs"})
+	if len(res.Errors) > 0 {
+		t.Fatalf("addTask failed: %+v", res.Errors)
+	}
+	var added struct {
+		ID      string
+		Name    string
+		Tag     string
+		Due     time.Time
+		Version int
+		Status  struct{ Name string }
+	}
+	if err = json.Unmarshal(res.Data["addTask"], &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Name != "write docs" || added.Tag != "work" || added.Status.Name != "todo" || added.Due.Format("2006-01-02") != "2030-01-02" {
+		t.Errorf("got added task %+v", added)
+	}
+
+	// the queries see the task, with a read token too
+	res = postGraphQL(t, e, read, `{ tasks(filter: "tag:work") { tasks { id name } nextCursor } workflow { name } }`, nil)
+	if len(res.Errors) > 0 {
+		t.Fatalf("tasks failed: %+v", res.Errors)
+	}
+	if got := string(res.Data["tasks"]); !strings.Contains(got, `"name":"write docs"`) || !strings.Contains(got, `"nextCursor":null`) {
+		t.Errorf("got tasks %v", got)
+	}
+
+	var tests = []struct {
+		name     string
+		token    string
+		query    string
+		wantCode string
+	}{
+		{"read token", read, `mutation { deleteTask(id: "` + added.ID + `") }`, codeForbidden},
+		{"invalid value", write, `mutation { addTask(task: {name: ""}) { id } }`, codeInvalidValue},
+		{"unknown status", write, `mutation { updateTask(id: "` + added.ID + `", patch: {status: "later"}) { id } }`, codeInvalidValue},
+		{"old version", write, `mutation { updateTask(id: "` + added.ID + `", patch: {name: "x"}, version: 99) { id } }`, codeVersionConflict},
+		{"missing task", write, `mutation { deleteTask(id: "999") }`, codeNotFound},
+		{"invalid filter", read, `{ tasks(filter: "(tag:work") { tasks { id } } }`, codeInvalidQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := postGraphQL(t, e, tt.token, tt.query, nil)
+			if len(res.Errors) != 1 || res.Errors[0].Extensions["code"] != tt.wantCode {
+				t.Errorf("got errors %+v, want one with code %v", res.Errors, tt.wantCode)
+			}
+		})
+	}
+
+	res = postGraphQL(t, e, write, `mutation { updateTask(id: "`+added.ID+`", patch: {tag: "", due: ""}, version: `+strconv.Itoa(added.Version)+`) { tag due version } }`, nil)
+	if got := string(res.Data["updateTask"]); len(res.Errors) > 0 || got != `{"tag":"","due":null,"version":`+strconv.Itoa(added.Version+1)+`}` {
+		t.Errorf("updateTask() = %v, %+v", got, res.Errors)
+	}
+	res = postGraphQL(t, e, write, `mutation { deleteTask(id: "`+added.ID+`") }`, nil)
+	if len(res.Errors) > 0 {
+		t.Errorf("deleteTask failed: %+v", res.Errors)
+	}
+	res = postGraphQL(t, e, read, `{ task(id: "`+added.ID+`") { id } }`, nil)
+	if got := string(res.Data["task"]); got != "null" {
+		t.Errorf("got deleted task %v, want null", got)
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "dashboard", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + apiPrefix + "/graphql?access_token=" + token
+	dialer := websocket.Dialer{Subprotocols: []string{graphQLWSProtocol}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	receive := func(wantType string) graphQLMessage {
+		t.Helper()
+		var msg graphQLMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != wantType {
+			t.Fatalf("got message %v %s, want %v", msg.Type, msg.Payload, wantType)
+		}
+		return msg
+	}
+	ws.WriteJSON(graphQLMessage{Type: "connection_init"})
+	receive("connection_ack")
+	payload, _ := json.Marshal(graphQLParams{Query: `subscription { watchTasks(filter: "tag:work") { name } }`})
+	ws.WriteJSON(graphQLMessage{ID: "1", Type: "subscribe", Payload: payload})
+	if msg := receive("next"); !strings.Contains(string(msg.Payload), `"watchTasks":[]`) {
+		t.Errorf("got first result %s, want no tasks", msg.Payload)
+	}
+
+	// a change by another client is pushed to the subscription
+	if _, err = createTask(NewTask{Name: "deploy", Tag: "work"}, false); err != nil {
+		t.Fatal(err)
+	}
+	notifyChange(changeOrigin{})
+	if msg := receive("next"); !strings.Contains(string(msg.Payload), `"watchTasks":[{"name":"deploy"}]`) {
+		t.Errorf("got result %s, want the new task", msg.Payload)
+	}
+
+	// an invalid subscription ends with an error, the others keep running
+	payload, _ = json.Marshal(graphQLParams{Query: `subscription { watchTasks(filter: "(tag:work") { name } }`})
+	ws.WriteJSON(graphQLMessage{ID: "2", Type: "subscribe", Payload: payload})
+	if msg := receive("error"); msg.ID != "2" {
+		t.Errorf("got an error for %q, want it for 2", msg.ID)
+	}
+	ws.WriteJSON(graphQLMessage{ID: "1", Type: "complete"})
+	ws.WriteJSON(graphQLMessage{Type: "ping"})
+	receive("pong")
+
+	// the connection stops counting in the websocket limits once closed
+	ws.Close()
+	waitForConnections(t, "token dashboard", 0)
+}
+
+func TestGraphQLWebsocketDropsDeadClients(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "dashboard", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(pongWait, pingInterval time.Duration) { wsPongWait, wsPingInterval = pongWait, pingInterval }(wsPongWait, wsPingInterval)
+	wsPongWait, wsPingInterval = 300*time.Millisecond, 100*time.Millisecond
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+
+	// the client subscribes, then never reads again so it doesn't answer the pings, like a half-open connection
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + apiPrefix + "/graphql?access_token=" + token
+	dialer := websocket.Dialer{Subprotocols: []string{graphQLWSProtocol}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ws.WriteJSON(graphQLMessage{Type: "connection_init"})
+	var ack graphQLMessage
+	if err = ws.ReadJSON(&ack); err != nil || ack.Type != "connection_ack" {
+		t.Fatalf("got %+v, %v, want connection_ack", ack, err)
+	}
+	payload, _ := json.Marshal(graphQLParams{Query: `subscription { watchTasks { name } }`})
+	ws.WriteJSON(graphQLMessage{ID: "1", Type: "subscribe", Payload: payload})
+	waitForConnections(t, "token dashboard", 1)
+
+	waitForConnections(t, "token dashboard", 0)
+}
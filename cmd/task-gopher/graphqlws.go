@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/labstack/echo/v4"
+)
+
+// graphQLWSProtocol is the websocket subprotocol of the GraphQL subscriptions,
+// see https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphQLWSProtocol = "graphql-transport-ws"
+
+// how long a client has to send connection_init after connecting
+const graphQLInitTimeout = 10 * time.Second
+
+var graphQLUpgrader = websocket.Upgrader{Subprotocols: []string{graphQLWSProtocol}}
+
+// A graphQLMessage is a message of the graphql-transport-ws protocol, both ways
+type graphQLMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// A graphQLConn is a websocket connection running GraphQL operations, subscriptions or not
+// Its connection is registered with the hub like those of /ws, which counts it in the limits, and queues and writes
+// its messages with pings; the subscriptions get the changes from changes instead of the broadcasts of the hub.
+type graphQLConn struct {
+	conn *wsConn
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc // the running operations by ID
+}
+
+// handleGraphQLWebsocket runs the GraphQL operations sent over a websocket, with the graphql-transport-ws protocol
+// It has the same limits as /ws, and the operations have the scope of the device or token of the connection.
+func handleGraphQLWebsocket(c echo.Context) error {
+	if err := checkWebsocketLimits(requester(c)); err != nil {
+		return err
+	}
+	ws, err := graphQLUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	if ws.Subprotocol() != graphQLWSProtocol {
+		closeWebsocket(ws, 4406, "Subprotocol not acceptable")
+		ws.Close()
+		return nil
+	}
+	ws.SetReadLimit(limits.MaxWebsocketMessageSize)
+
+	client := wsClient{id: clientID(c), addr: ws.RemoteAddr().String(), who: requester(c), protocol: graphQLWSProtocol}
+	log.Println("GraphQL WS connection from", client.addr, "by", client.who)
+	conn := newWSConn(ws, client)
+	if err := hub.add(conn); err != nil {
+		// other connections took the last places since checkWebsocketLimits
+		closeWebsocket(ws, websocket.CloseTryAgainLater, toAPIError(err).Message)
+		ws.Close()
+		return nil
+	}
+	// remove connection from the hub when done, which closes it
+	defer hub.remove(conn)
+	go conn.writePump(wsWriteWait, wsPingInterval)
+
+	ctx, cancel := context.WithCancel(newGraphQLContext(c))
+	defer cancel()
+	g := &graphQLConn{conn: conn, subs: map[string]context.CancelFunc{}}
+	g.serve(ctx)
+	return nil
+}
+
+// serve reads the messages of the client until it disconnects, breaks the protocol or stops answering the pings
+func (g *graphQLConn) serve(ctx context.Context) {
+	ws := g.conn.ws
+	initialized := false
+	ws.SetReadDeadline(time.Now().Add(graphQLInitTimeout))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok && !initialized {
+				g.conn.close(4408, "Connection initialisation timeout")
+			}
+			return
+		}
+		if initialized {
+			ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+		var msg graphQLMessage
+		if err = json.Unmarshal(data, &msg); err != nil {
+			g.conn.close(4400, "Invalid message")
+			return
+		}
+		switch msg.Type {
+		case "connection_init":
+			if initialized {
+				g.conn.close(4429, "Too many initialisation requests")
+				return
+			}
+			// the client was authenticated by the handshake, with its certificate or token
+			initialized = true
+			// from then on, every message or pong shows the client is still there
+			pongWait := wsPongWait
+			ws.SetReadDeadline(time.Now().Add(pongWait))
+			ws.SetPongHandler(func(string) error {
+				return ws.SetReadDeadline(time.Now().Add(pongWait))
+			})
+			g.send(graphQLMessage{Type: "connection_ack"})
+		case "ping":
+			g.send(graphQLMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !initialized {
+				g.conn.close(4401, "Unauthorized")
+				return
+			}
+			var params graphQLParams
+			if err := json.Unmarshal(msg.Payload, &params); err != nil || msg.ID == "" {
+				g.conn.close(4400, "Invalid subscribe message")
+				return
+			}
+			if !g.start(ctx, msg.ID, params) {
+				g.conn.close(4409, fmt.Sprintf("Subscriber for %v already exists", msg.ID))
+				return
+			}
+		case "complete":
+			g.stop(msg.ID)
+		default:
+			g.conn.close(4400, fmt.Sprintf("Unknown message type %q", msg.Type))
+			return
+		}
+	}
+}
+
+// start runs an operation in its own goroutine and sends its results, unless one with the same ID is running
+func (g *graphQLConn) start(ctx context.Context, id string, params graphQLParams) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.subs[id]; ok {
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	g.subs[id] = cancel
+	go func() {
+		defer g.stop(id)
+		results, err := graphQLSchema.Subscribe(ctx, params.Query, params.OperationName, params.Variables)
+		if err != nil {
+			g.sendErrors(id, err)
+			return
+		}
+		for result := range results {
+			res := result.(*graphql.Response)
+			// errors before the operation started, like an invalid query or filter, end it
+			if res.Data == nil && len(res.Errors) > 0 {
+				payload, _ := json.Marshal(res.Errors)
+				g.send(graphQLMessage{ID: id, Type: "error", Payload: payload})
+				return
+			}
+			payload, _ := json.Marshal(res)
+			g.send(graphQLMessage{ID: id, Type: "next", Payload: payload})
+		}
+		// the client that completed an operation isn't told it completed
+		if ctx.Err() == nil {
+			g.send(graphQLMessage{ID: id, Type: "complete"})
+		}
+	}()
+	return true
+}
+
+// stop ends a running operation
+func (g *graphQLConn) stop(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if cancel, ok := g.subs[id]; ok {
+		cancel()
+		delete(g.subs, id)
+	}
+}
+
+// send queues a message for the client, which is dropped if its queue is full like the slow clients of /ws
+func (g *graphQLConn) send(msg graphQLMessage) {
+	data, _ := json.Marshal(msg)
+	if !g.conn.enqueue(data) {
+		g.conn.close(websocket.CloseTryAgainLater, "Too slow to keep up with the results")
+	}
+}
+
+// sendErrors sends an error ending an operation
+func (g *graphQLConn) sendErrors(id string, err error) {
+	payload, _ := json.Marshal([]map[string]string{{"message": err.Error()}})
+	g.send(graphQLMessage{ID: id, Type: "error", Payload: payload})
+}
+
+// closeWebsocket closes a websocket with a status code and a reason, before its writer goroutine is started
+func closeWebsocket(ws *websocket.Conn, code int, reason string) {
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
@@ -0,0 +1,381 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative taskpb/task.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"task-gopher/cmd/task-gopher/taskpb"
+)
+
+// grpcWriteMethods are the calls of TaskService that change the tasks, they need the write scope
+var grpcWriteMethods = map[string]bool{
+	taskpb.TaskService_CreateTask_FullMethodName: true,
+	taskpb.TaskService_UpdateTask_FullMethodName: true,
+	taskpb.TaskService_DeleteTask_FullMethodName: true,
+	taskpb.TaskService_MoveTask_FullMethodName:   true,
+}
+
+// serveGRPC serves TaskService on a port, over TLS with the config of the HTTP server if it has one
+func serveGRPC(port string, cfg *tls.Config) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	if cfg != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+	log.Println("Serving gRPC on port", port)
+	return newGRPCServer(opts...).Serve(lis)
+}
+
+// newGRPCServer returns a gRPC server of TaskService, with the authentication and the limits of the HTTP API
+func newGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.MaxRecvMsgSize(int(limits.MaxBodySize)),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			ctx, err := authenticateGRPC(ctx, info.FullMethod)
+			var res any
+			if err == nil {
+				res, err = handler(ctx, req)
+			}
+			logGRPC(ctx, info.FullMethod, err)
+			return res, err
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authenticateGRPC(ss.Context(), info.FullMethod)
+			if err == nil {
+				err = handler(srv, &grpcStream{ss, ctx})
+			}
+			logGRPC(ctx, info.FullMethod, err)
+			return err
+		}),
+	)
+	s := grpc.NewServer(opts...)
+	taskpb.RegisterTaskServiceServer(s, &taskServer{})
+	return s
+}
+
+// grpcStream is a server stream with the context of its caller
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcStream) Context() context.Context {
+	return s.ctx
+}
+
+// A grpcCaller is the device or token of a call, in its context
+type grpcCaller struct {
+	who    string       // "device NAME" or "token NAME", see requester
+	origin changeOrigin // the client of the call, which isn't told about its own changes
+}
+
+type grpcCallerKey struct{}
+
+// authenticateGRPC checks the device certificate or the token of a call like authenticate, and limits the rates of
+// its address and its device or token, shared with the HTTP API. The caller is stored in the returned context.
+func authenticateGRPC(ctx context.Context, method string) (context.Context, error) {
+	caller := grpcCaller{who: "anonymous"}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, grpcstatus.Error(codes.Internal, "the call has no peer")
+	}
+	host, _, _ := net.SplitHostPort(p.Addr.String())
+	if wait := clientLimiter.wait("ip:"+host, limits.ClientRate, time.Now()); wait > 0 {
+		return ctx, rateLimitedGRPC(wait)
+	}
+
+	var state *tls.ConnectionState
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		state = &info.State
+	}
+	var name, scope string
+	d, ok, err := connectionDevice(state)
+	if err != nil {
+		return ctx, toGRPCError(err)
+	}
+	if ok {
+		name, scope, caller.who = d.Name, d.Scope, "device "+d.Name
+	} else {
+		var secret string
+		if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+			secret, _ = strings.CutPrefix(values[0], "Bearer ")
+		}
+		if secret == "" {
+			return ctx, toGRPCError(newAPIError(http.StatusUnauthorized, codeUnauthorized, "You must provide an API token"))
+		}
+		t, err := lookupToken(db, strings.TrimSpace(secret))
+		if err == sql.ErrNoRows {
+			return ctx, toGRPCError(newAPIError(http.StatusUnauthorized, codeUnauthorized, "The API token is invalid or was revoked"))
+		}
+		if err != nil {
+			return ctx, toGRPCError(internalError("Could not check the API token", err))
+		}
+		name, scope, caller.who = t.Name, t.Scope, "token "+t.Name
+	}
+	if values := metadata.ValueFromIncomingContext(ctx, strings.ToLower(clientIDHeader)); len(values) > 0 {
+		if err := validateClientID(values[0]); err != nil {
+			return ctx, toGRPCError(&APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: err.Error(), Field: clientIDHeader})
+		}
+		caller.origin = changeOrigin{values[0], caller.who}
+	}
+	ctx = context.WithValue(ctx, grpcCallerKey{}, caller)
+	if grpcWriteMethods[method] && scope != scopeWrite {
+		return ctx, toGRPCError(newAPIError(http.StatusForbidden, codeForbidden, fmt.Sprintf("The %v has the %v scope, which doesn't allow changes", caller.who, scope)))
+	}
+
+	if wait := tokenLimiter.wait(caller.who, tokenRate(name), time.Now()); wait > 0 {
+		return ctx, rateLimitedGRPC(wait)
+	}
+	return ctx, nil
+}
+
+// logGRPC logs a call like the HTTP requests
+func logGRPC(ctx context.Context, method string, err error) {
+	caller, ok := ctx.Value(grpcCallerKey{}).(grpcCaller)
+	if !ok {
+		caller.who = "anonymous"
+	}
+	log.Printf("gRPC %v by %v. Status: %v\n", method, caller.who, grpcstatus.Code(err))
+}
+
+// notifyGRPCChange tells the other clients that a call changed the tasks
+func notifyGRPCChange(ctx context.Context, events ...Event) {
+	caller, _ := ctx.Value(grpcCallerKey{}).(grpcCaller)
+	notifyChange(caller.origin, events...)
+}
+
+// grpcCodes are the gRPC codes of the statuses of the API errors
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+}
+
+// toGRPCError returns the status of an error of the shared task functions
+// The code of the API error and its field are in an ErrorInfo detail, and a version conflict also has the current task.
+func toGRPCError(err error) error {
+	apiErr := toAPIError(err)
+	if apiErr.cause != nil {
+		log.Println("gRPC:", apiErr.Message+":", apiErr.cause)
+	}
+	code, ok := grpcCodes[apiErr.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	// the client should get the task again and retry
+	if apiErr.Code == codeVersionConflict {
+		code = codes.Aborted
+	}
+	info := &errdetails.ErrorInfo{Reason: apiErr.Code, Domain: "task-gopher"}
+	if apiErr.Field != "" {
+		info.Metadata = map[string]string{"field": apiErr.Field}
+	}
+	st, _ := grpcstatus.New(code, apiErr.Message).WithDetails(info)
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		st, _ = st.WithDetails(taskToProto(conflict.Current))
+	}
+	return st.Err()
+}
+
+// rateLimitedGRPC returns the status of a call over the rate of its client, with how long to wait
+func rateLimitedGRPC(wait time.Duration) error {
+	st := grpcstatus.New(codes.ResourceExhausted, fmt.Sprintf("Too many requests, retry in %v", wait.Round(time.Second)))
+	st, _ = st.WithDetails(&errdetails.ErrorInfo{Reason: codeRateLimited, Domain: "task-gopher"}, &errdetails.RetryInfo{RetryDelay: durationpb.New(wait)})
+	return st.Err()
+}
+
+// taskServer implements TaskService with the same functions as the HTTP handlers
+type taskServer struct {
+	taskpb.UnimplementedTaskServiceServer
+}
+
+func (s *taskServer) ListTasks(ctx context.Context, req *taskpb.ListTasksRequest) (*taskpb.ListTasksResponse, error) {
+	q := TaskQuery{Filter: req.Filter, Sort: req.Sort, Limit: int(req.Limit), Cursor: req.Cursor}
+	if q.Limit == 0 {
+		q.Limit = defaultPageSize
+	}
+	tasks, next, err := getTaskPage(db, q)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &taskpb.ListTasksResponse{Tasks: tasksToProto(tasks), NextCursor: next}, nil
+}
+
+func (s *taskServer) GetTask(ctx context.Context, req *taskpb.GetTaskRequest) (*taskpb.Task, error) {
+	task, err := fetchTask(req.Id)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return taskToProto(task), nil
+}
+
+func (s *taskServer) CreateTask(ctx context.Context, req *taskpb.CreateTaskRequest) (*taskpb.Task, error) {
+	taskType, err := protoTaskType(req.Type)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	newTask := NewTask{Name: req.Name, Desc: req.Desc, Status: req.Status, Type: taskType, Tag: req.Tag, Due: req.Due}
+	if len(req.Fields) > 0 {
+		newTask.Fields = fieldsBody(req.Fields)
+	}
+	task, err := createTask(newTask, req.Force)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	notifyGRPCChange(ctx, taskCreated(task))
+	return taskToProto(task), nil
+}
+
+func (s *taskServer) UpdateTask(ctx context.Context, req *taskpb.UpdateTaskRequest) (*taskpb.Task, error) {
+	// the request is parsed like a JSON Merge Patch of PATCH /tasks/:id, an empty due date clears it
+	body := map[string]interface{}{}
+	for key, value := range map[string]*string{"Name": req.Name, "Desc": req.Desc, "Status": req.Status, "Tag": req.Tag} {
+		if value != nil {
+			body[key] = *value
+		}
+	}
+	if req.Type != nil {
+		taskType, err := protoTaskType(*req.Type)
+		if err != nil {
+			return nil, toGRPCError(err)
+		}
+		body["Type"] = taskType
+	}
+	if req.Due != nil && *req.Due == "" {
+		body["Due"] = nil
+	} else if req.Due != nil {
+		body["Due"] = *req.Due
+	}
+	if len(req.Fields) > 0 {
+		body["Fields"] = fieldsBody(req.Fields)
+	}
+	patch, err := parseTaskPatch(body, time.Now())
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	task, changed, err := changeTask(req.Id, req.Version, patch, req.Force)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	notifyGRPCChange(ctx, taskUpdated(task, changed))
+	return taskToProto(task), nil
+}
+
+func (s *taskServer) DeleteTask(ctx context.Context, req *taskpb.DeleteTaskRequest) (*taskpb.DeleteTaskResponse, error) {
+	task, err := removeTask(req.Id)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	notifyGRPCChange(ctx, taskDeleted(task))
+	return &taskpb.DeleteTaskResponse{Id: req.Id}, nil
+}
+
+func (s *taskServer) MoveTask(ctx context.Context, req *taskpb.MoveTaskRequest) (*taskpb.Task, error) {
+	task, err := placeTask(req.Id, req.After, req.Before)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	notifyGRPCChange(ctx, taskUpdated(task, []string{"Rank"}))
+	return taskToProto(task), nil
+}
+
+// WatchTasks sends the tasks matching a filter, then again after every change, until the client cancels the call
+func (s *taskServer) WatchTasks(req *taskpb.WatchTasksRequest, stream taskpb.TaskService_WatchTasksServer) error {
+	q := TaskQuery{Filter: req.Filter, Sort: req.Sort, Limit: maxPageSize}
+	// subscribe first, so a change made while the tasks are read is sent too
+	changed, stop := changes.subscribe()
+	defer stop()
+	for {
+		tasks, err := getAllTasks(q)
+		if err != nil {
+			return toGRPCError(err)
+		}
+		if err = stream.Send(&taskpb.WatchTasksResponse{Tasks: tasksToProto(tasks)}); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// protoTaskType returns the name of a task type of the gRPC API
+func protoTaskType(t taskpb.TaskType) (string, error) {
+	if t < taskpb.TaskType_TASK_TYPE_GENERIC || t > taskpb.TaskType_TASK_TYPE_HABIT {
+		return "", &fieldError{"Type", fmt.Errorf("unknown task type %v", t)}
+	}
+	return task_type(t).String(), nil
+}
+
+// fieldsBody returns field values in the form of the Fields of a request body, see getBodyFields
+func fieldsBody(fields map[string]string) map[string]interface{} {
+	body := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		body[name] = value
+	}
+	return body
+}
+
+// taskToProto returns a task of the gRPC API
+func taskToProto(t Task) *taskpb.Task {
+	def, ok := workflow.lookup(t.Status)
+	if !ok {
+		// a status that was removed from the workflow
+		def = StatusDef{ID: t.Status, Name: t.Status.String()}
+	}
+	pb := &taskpb.Task{
+		Id:      t.ID,
+		Name:    t.Name,
+		Desc:    t.Desc,
+		Status:  &taskpb.Status{Id: int32(def.ID), Name: def.Name, Category: string(def.Category)},
+		Type:    taskpb.TaskType(t.Type),
+		Created: timestamppb.New(t.Created),
+		Tag:     t.Tag,
+		Rank:    t.Rank,
+		Version: t.Version,
+		Fields:  t.Fields,
+	}
+	if !t.Due.IsZero() {
+		pb.Due = timestamppb.New(t.Due)
+	}
+	return pb
+}
+
+// tasksToProto returns tasks of the gRPC API
+func tasksToProto(tasks []Task) []*taskpb.Task {
+	pbs := make([]*taskpb.Task, len(tasks))
+	for i, t := range tasks {
+		pbs[i] = taskToProto(t)
+	}
+	return pbs
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"task-gopher/cmd/task-gopher/taskpb"
+)
+
+// dialGRPC starts a gRPC server in memory and returns a client of it
+func dialGRPC(t *testing.T) taskpb.TaskServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return taskpb.NewTaskServiceClient(conn)
+}
+
+// withToken returns a context authenticating the calls with a token
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+// errorReason returns the code of the API error of a call, see toGRPCError
+func errorReason(err error) string {
+	for _, detail := range grpcstatus.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestGRPC(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	read, err := createToken(db, Token{Name: "dashboard", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write, err := createToken(db, Token{Name: "service", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialGRPC(t)
+
+	added, err := client.CreateTask(withToken(write), &taskpb.CreateTaskRequest{Name: "write docs", Tag: "work", Due: "2030-01-02", Type: taskpb.TaskType_TASK_TYPE_DAILY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.Name != "write docs" || added.Status.Name != "todo" || added.Type != taskpb.TaskType_TASK_TYPE_DAILY || added.Due.AsTime().Format("2006-01-02") != "2030-01-02" {
+		t.Errorf("got added task %v", added)
+	}
+
+	page, err := client.ListTasks(withToken(read), &taskpb.ListTasksRequest{Filter: "tag:work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Tasks) != 1 || page.Tasks[0].Id != added.Id || page.NextCursor != "" {
+		t.Errorf("got page %v", page)
+	}
+
+	name := "x"
+	var tests = []struct {
+		name       string
+		call       func() error
+		wantCode   codes.Code
+		wantReason string
+	}{
+		{"no token", func() error {
+			_, err := client.GetTask(context.Background(), &taskpb.GetTaskRequest{Id: added.Id})
+			return err
+		}, codes.Unauthenticated, codeUnauthorized},
+		{"invalid token", func() error {
+			_, err := client.GetTask(withToken("tg_nope"), &taskpb.GetTaskRequest{Id: added.Id})
+			return err
+		}, codes.Unauthenticated, codeUnauthorized},
+		{"read token", func() error {
+			_, err := client.DeleteTask(withToken(read), &taskpb.DeleteTaskRequest{Id: added.Id})
+			return err
+		}, codes.PermissionDenied, codeForbidden},
+		{"invalid value", func() error {
+			_, err := client.CreateTask(withToken(write), &taskpb.CreateTaskRequest{})
+			return err
+		}, codes.InvalidArgument, codeInvalidValue},
+		{"unknown type", func() error {
+			_, err := client.CreateTask(withToken(write), &taskpb.CreateTaskRequest{Name: "x", Type: 7})
+			return err
+		}, codes.InvalidArgument, codeInvalidValue},
+		{"old version", func() error {
+			_, err := client.UpdateTask(withToken(write), &taskpb.UpdateTaskRequest{Id: added.Id, Name: &name, Version: 99})
+			return err
+		}, codes.Aborted, codeVersionConflict},
+		{"missing task", func() error {
+			_, err := client.GetTask(withToken(read), &taskpb.GetTaskRequest{Id: 999})
+			return err
+		}, codes.NotFound, codeNotFound},
+		{"invalid filter", func() error {
+			_, err := client.ListTasks(withToken(read), &taskpb.ListTasksRequest{Filter: "(tag:work"})
+			return err
+		}, codes.InvalidArgument, codeInvalidQuery},
+		{"invalid client ID", func() error {
+			ctx := metadata.AppendToOutgoingContext(withToken(read), "x-client-id", "web 1")
+			_, err := client.GetTask(ctx, &taskpb.GetTaskRequest{Id: added.Id})
+			return err
+		}, codes.InvalidArgument, codeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if code := grpcstatus.Code(err); code != tt.wantCode || errorReason(err) != tt.wantReason {
+				t.Errorf("got error %v (%v), want code %v with reason %v", err, errorReason(err), tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+
+	empty := ""
+	updated, err := client.UpdateTask(withToken(write), &taskpb.UpdateTaskRequest{Id: added.Id, Tag: &empty, Due: &empty, Version: added.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Tag != "" || updated.Due != nil || updated.Name != "write docs" || updated.Version != added.Version+1 {
+		t.Errorf("got updated task %v", updated)
+	}
+	if _, err = client.DeleteTask(withToken(write), &taskpb.DeleteTaskRequest{Id: added.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetTask(withToken(read), &taskpb.GetTaskRequest{Id: added.Id}); grpcstatus.Code(err) != codes.NotFound {
+		t.Errorf("got %v for the deleted task, want NotFound", err)
+	}
+}
+
+func TestGRPCWatchTasks(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "dashboard", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dialGRPC(t)
+
+	ctx, cancel := context.WithTimeout(withToken(token), 5*time.Second)
+	defer cancel()
+	stream, err := client.WatchTasks(ctx, &taskpb.WatchTasksRequest{Filter: "tag:work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tasks) != 0 {
+		t.Errorf("got first tasks %v, want none", res.Tasks)
+	}
+
+	// a change by another client is sent to the stream
+	if _, err = createTask(NewTask{Name: "deploy", Tag: "work"}, false); err != nil {
+		t.Fatal(err)
+	}
+	notifyChange(changeOrigin{})
+	res, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tasks) != 1 || res.Tasks[0].Name != "deploy" {
+		t.Errorf("got tasks %v, want the new task", res.Tasks)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// the timing of the websockets of /ws, variables so the tests can shorten them
+var (
+	wsWriteWait    = 10 * time.Second // how long a write may take before the client is dropped
+	wsPongWait     = 60 * time.Second // how long the server waits for a message or a pong before dropping the client
+	wsPingInterval = wsPongWait * 9 / 10
+)
+
+// A wsConn is a websocket connection of /ws with its queue of messages to send
+// Only its writer goroutine writes to the websocket, see writePump, so the messages are queued with enqueue.
+type wsConn struct {
+	ws     *websocket.Conn
+	client wsClient
+
+	mu          sync.Mutex
+	send        chan []byte
+	closed      bool
+	closeCode   int // sent to the client when its queue is closed
+	closeReason string
+}
+
+// newWSConn returns a connection with a queue of limits.MaxWebsocketQueue messages
+func newWSConn(ws *websocket.Conn, client wsClient) *wsConn {
+	return &wsConn{ws: ws, client: client, send: make(chan []byte, limits.MaxWebsocketQueue)}
+}
+
+// enqueue queues a message for the client, it returns false if the queue is full or closed
+func (c *wsConn) enqueue(msg []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the queue, the writer goroutine then sends the rest of it and closes the websocket
+func (c *wsConn) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.closeCode, c.closeReason = code, reason
+		close(c.send)
+	}
+}
+
+// writePump writes the queued messages to the websocket and pings the client, until the queue is closed
+// or a write fails. It closes the websocket, which ends the reads of the connection too.
+func (c *wsConn) writePump(writeWait, pingInterval time.Duration) {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.mu.Lock()
+				code, reason := c.closeCode, c.closeReason
+				c.mu.Unlock()
+				c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+				return
+			}
+			if err := c.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Println("websocket: could not write to", c.client.who+":", err)
+				return
+			}
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// A wsBroadcast is a change to tell the clients of /ws about, except the one it comes from
+type wsBroadcast struct {
+	origin changeOrigin
+	events [][]byte // the JSON of the events, for the clients of eventsProtocol
+}
+
+// A wsRegister asks the hub to add a connection, the reply is nil or the limit it would exceed
+type wsRegister struct {
+	conn  *wsConn
+	reply chan error
+}
+
+// A wsCount asks the hub for the number of connections, and those of a device or token
+type wsCount struct {
+	who   string
+	reply chan [2]int
+}
+
+// A wsHub owns the websocket connections of /ws and /graphql: a single goroutine registers them, counts them and queues the broadcasts
+// to them. The clients too slow to keep up with their queue are dropped, instead of holding up the others.
+type wsHub struct {
+	register   chan wsRegister
+	unregister chan *wsConn
+	broadcast  chan wsBroadcast
+	count      chan wsCount
+}
+
+// hub is the hub of the connections of /ws
+var hub = newWSHub()
+
+// newWSHub returns a hub with its goroutine running
+func newWSHub() *wsHub {
+	h := &wsHub{
+		register:   make(chan wsRegister),
+		unregister: make(chan *wsConn),
+		broadcast:  make(chan wsBroadcast, 64),
+		count:      make(chan wsCount),
+	}
+	go h.run()
+	return h
+}
+
+func (h *wsHub) run() {
+	conns := map[*wsConn]bool{}
+	for {
+		select {
+		case req := <-h.register:
+			// checked here, so the connections opened at the same time can't all pass the limits
+			if err := websocketLimitError(len(conns), countConns(conns, req.conn.client.who)); err != nil {
+				req.reply <- err
+				continue
+			}
+			conns[req.conn] = true
+			req.reply <- nil
+		case c := <-h.unregister:
+			if conns[c] {
+				delete(conns, c)
+				c.close(websocket.CloseNormalClosure, "")
+			}
+		case b := <-h.broadcast:
+			for c := range conns {
+				// the GraphQL subscriptions get the changes from changes instead
+				if c.client.protocol == graphQLWSProtocol {
+					continue
+				}
+				// Don't update the client that sent the message, the same client ID of the same device or token
+				if b.origin.clientID != "" && c.client.id == b.origin.clientID && c.client.who == b.origin.who {
+					continue
+				}
+				msgs := [][]byte{[]byte("UPDATE")}
+				if c.client.protocol == eventsProtocol {
+					msgs = b.events
+				}
+				for _, msg := range msgs {
+					if !c.enqueue(msg) {
+						log.Println("websocket: dropping", c.client.who, "at", c.client.addr+", it is too slow")
+						delete(conns, c)
+						c.close(websocket.CloseTryAgainLater, "Too slow to keep up with the changes")
+						break
+					}
+				}
+			}
+		case req := <-h.count:
+			req.reply <- [2]int{len(conns), countConns(conns, req.who)}
+		}
+	}
+}
+
+// countConns returns the number of connections of a device or token
+func countConns(conns map[*wsConn]bool, who string) int {
+	var n int
+	for c := range conns {
+		if c.client.who == who {
+			n++
+		}
+	}
+	return n
+}
+
+// add registers a connection, it gets the broadcasts from then on
+// It returns an error instead if the server or the client has too many connections already.
+func (h *wsHub) add(c *wsConn) error {
+	reply := make(chan error)
+	h.register <- wsRegister{c, reply}
+	return <-reply
+}
+
+// remove unregisters a connection and closes its queue
+func (h *wsHub) remove(c *wsConn) {
+	h.unregister <- c
+}
+
+// send queues the events of a change for the clients, except the one it comes from
+func (h *wsHub) send(origin changeOrigin, events [][]byte) {
+	h.broadcast <- wsBroadcast{origin, events}
+}
+
+// connections returns the number of connections, and those of a device or token
+func (h *wsHub) connections(who string) (total, mine int) {
+	reply := make(chan [2]int)
+	h.count <- wsCount{who, reply}
+	n := <-reply
+	return n[0], n[1]
+}
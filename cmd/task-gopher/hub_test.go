@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitForConnections waits until a device or token has n websocket connections in the hub
+func waitForConnections(t *testing.T, who string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, mine := hub.connections(who); mine == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v doesn't have %v connections", who, n)
+		}
+	}
+}
+
+func TestHubBroadcast(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "board", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+	var conns []*websocket.Conn
+	for i := 0; i < 4; i++ {
+		conns = append(conns, dialWebsocket(t, server.URL, token))
+	}
+
+	// changes notified at once from many goroutines reach every client, each once and in order
+	const changes = 50
+	var wg sync.WaitGroup
+	for i := 0; i < changes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notifyChange(changeOrigin{"cli-1", "token board"}, fieldsChanged("points"))
+		}()
+	}
+	wg.Wait()
+	for i, ws := range conns {
+		var last int64
+		for n := 0; n < changes; n++ {
+			var event Event
+			if err := ws.ReadJSON(&event); err != nil {
+				t.Fatalf("client %v, event %v: %v", i, n, err)
+			}
+			if event.Type != eventFieldsChanged || event.ID <= last {
+				t.Fatalf("client %v: got event %+v after %v", i, event, last)
+			}
+			last = event.ID
+		}
+	}
+	for _, ws := range conns {
+		ws.Close()
+	}
+	waitForConnections(t, "token board", 0)
+}
+
+func TestHubDropsSlowClients(t *testing.T) {
+	defer func() { limits = defaultLimits }()
+	limits = Limits{MaxWebsocketQueue: 2}.withDefaults()
+	// nothing sends the queue of the connection, like a client that stopped reading
+	conn := newWSConn(nil, wsClient{addr: "198.51.100.7:4321", who: "token slow"})
+	if err := hub.add(conn); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.remove(conn)
+
+	for i := 0; i < 3; i++ {
+		sendUpdateSockets(changeOrigin{"cli-1", "token board"}, nil)
+	}
+	waitForConnections(t, "token slow", 0)
+	if conn.enqueue([]byte("UPDATE")) {
+		t.Error("the queue of the dropped client is still open")
+	}
+	var queued int
+	for range conn.send {
+		queued++
+	}
+	if queued != 2 || conn.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("got %v queued messages and close code %v, want 2 and %v", queued, conn.closeCode, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestHubDropsDeadClients(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	token, err := createToken(db, Token{Name: "laptop", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(pongWait, pingInterval time.Duration) { wsPongWait, wsPingInterval = pongWait, pingInterval }(wsPongWait, wsPingInterval)
+	wsPongWait, wsPingInterval = 300*time.Millisecond, 100*time.Millisecond
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+
+	// a client answers the pings while it reads, the other never reads again
+	alive := dialWebsocket(t, server.URL, token)
+	alive.SetReadDeadline(time.Time{})
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	dialWebsocket(t, server.URL, token)
+	waitForConnections(t, "token laptop", 2)
+
+	waitForConnections(t, "token laptop", 1)
+	time.Sleep(3 * wsPongWait)
+	if _, mine := hub.connections("token laptop"); mine != 1 {
+		t.Errorf("got %v connections, want the client answering the pings", mine)
+	}
+	alive.Close()
+	waitForConnections(t, "token laptop", 0)
+}
+
+func TestHubBulkChange(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	defer func() { limits = defaultLimits }()
+	limits = Limits{MaxWebsocketQueue: 4}.withDefaults()
+	token, err := createToken(db, Token{Name: "board", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	for i := 0; i < n; i++ {
+		if _, err = addTask(db, fmt.Sprint("task ", i), "", todo, generic, "sprint12", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+	ws := dialWebsocket(t, server.URL, token)
+
+	// a bulk change of more tasks than the queue holds is a single event, so the client isn't dropped as too slow
+	req, _ := http.NewRequest(http.MethodPost, server.URL+apiPrefix+"/tasks/bulk", strings.NewReader(`{"Filter": "tag:sprint12", "Status": "done"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v", res.StatusCode)
+	}
+	var event Event
+	if err = ws.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventTasksBulk || len(event.IDs) != n || !reflect.DeepEqual(event.Changed, []string{"Status"}) || event.Deleted {
+		t.Fatalf("got event %+v, want the %v tasks changed in bulk", event, n)
+	}
+
+	// the client keeps getting the changes
+	notifyChange(changeOrigin{}, fieldsChanged("points"))
+	if err = ws.ReadJSON(&event); err != nil || event.Type != eventFieldsChanged {
+		t.Fatalf("got event %+v, %v after the bulk change", event, err)
+	}
+}
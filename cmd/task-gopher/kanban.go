@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/charmbracelet/bubbles/help"
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// The kanban board is adapted from kancli (github.com/charmbracelet/kancli),
+// with one column per status of the configured workflow instead of a fixed three.
+
+type kanbanKeyMap struct {
+	Up       key.Binding
+	Down     key.Binding
+	Right    key.Binding
+	Left     key.Binding
+	Next     key.Binding
+	Prev     key.Binding
+	MoveUp   key.Binding
+	MoveDown key.Binding
+	Help     key.Binding
+	Quit     key.Binding
+
+	// resolving a conflict
+	KeepMine   key.Binding
+	KeepTheirs key.Binding
+}
+
+// ShortHelp returns keybindings to be shown in the mini help view. It's part
+// of the key.Map interface.
+func (k kanbanKeyMap) ShortHelp() []key.Binding {
+	return []key.Binding{k.Help, k.Quit}
+}
+
+// FullHelp returns keybindings for the expanded help view. It's part of the
+// key.Map interface.
+func (k kanbanKeyMap) FullHelp() [][]key.Binding {
+	return [][]key.Binding{
+		{k.Up, k.Down, k.Left, k.Right},        // first column
+		{k.Next, k.Prev, k.MoveUp, k.MoveDown}, // second column
+		{k.Help, k.Quit},                       // third column
+	}
+}
+
+var kanbanKeys = kanbanKeyMap{
+	Up: key.NewBinding(
+		key.WithKeys("up", "k"),
+		key.WithHelp("↑/k", "select up"),
+	),
+	Down: key.NewBinding(
+		key.WithKeys("down", "j"),
+		key.WithHelp("↓/j", "select down"),
+	),
+	Right: key.NewBinding(
+		key.WithKeys("right", "l"),
+		key.WithHelp("→/l", "focus right"),
+	),
+	Left: key.NewBinding(
+		key.WithKeys("left", "h"),
+		key.WithHelp("←/h", "focus left"),
+	),
+	Next: key.NewBinding(
+		key.WithKeys("enter", ">"),
+		key.WithHelp("enter/>", "move to next status"),
+	),
+	Prev: key.NewBinding(
+		key.WithKeys("<"),
+		key.WithHelp("<", "move to previous status"),
+	),
+	MoveUp: key.NewBinding(
+		key.WithKeys("shift+up", "K"),
+		key.WithHelp("shift+↑/K", "move card up"),
+	),
+	MoveDown: key.NewBinding(
+		key.WithKeys("shift+down", "J"),
+		key.WithHelp("shift+↓/J", "move card down"),
+	),
+	Help: key.NewBinding(
+		key.WithKeys("?"),
+		key.WithHelp("?", "toggle help"),
+	),
+	Quit: key.NewBinding(
+		key.WithKeys("q", "ctrl+c"),
+		key.WithHelp("q/ctrl+c", "quit"),
+	),
+	KeepMine: key.NewBinding(
+		key.WithKeys("m"),
+		key.WithHelp("m", "keep my move"),
+	),
+	KeepTheirs: key.NewBinding(
+		key.WithKeys("t"),
+		key.WithHelp("t", "take theirs"),
+	),
+}
+
+// a kanbanColumn lists the tasks in one status of the workflow
+type kanbanColumn struct {
+	def   StatusDef
+	list  list.Model
+	width int
+}
+
+// a kanbanBoard is the bubbletea model for the kanban command
+type kanbanBoard struct {
+	title    string // shown above the columns, e.g. the context
+	cols     []kanbanColumn
+	focused  int
+	help     help.Model
+	loaded   bool
+	err      error
+	quitting bool
+	conflict *taskConflictMsg // the conflict to resolve, if any
+}
+
+// taskMovedMsg reports that the server accepted moving a task to a new status
+type taskMovedMsg struct {
+	task Task
+	from status
+}
+
+// taskRankedMsg reports that the server accepted moving a task within its column
+type taskRankedMsg struct {
+	task Task
+}
+
+// kanbanErrMsg reports an error to be shown under the board
+type kanbanErrMsg struct{ err error }
+
+// taskConflictMsg reports that a task was moved by someone else while it was being moved
+type taskConflictMsg struct {
+	task   Task   // the task as shown on the board
+	theirs Task   // the task as it is on the server
+	to     status // the status the task was being moved to
+}
+
+// newKanbanBoard creates a board with a column for each workflow status
+func newKanbanBoard(tasks []Task) *kanbanBoard {
+	h := help.New()
+	h.ShowAll = true
+	b := &kanbanBoard{help: h}
+	for _, def := range workflow {
+		l := list.New(tasksToItems(filterTasksByStatus(tasks, def.ID)), list.NewDefaultDelegate(), 0, 0)
+		l.SetShowHelp(false)
+		col := kanbanColumn{def: def, list: l}
+		col.updateTitle()
+		b.cols = append(b.cols, col)
+	}
+	return b
+}
+
+// updateTitle shows the status name and its work-in-progress limit, highlighted when the column is full
+func (c *kanbanColumn) updateTitle() {
+	c.list.Title = c.def.Name
+	c.list.Styles.Title = list.DefaultStyles().Title
+	if c.def.Limit == 0 {
+		return
+	}
+	n := len(c.list.Items())
+	c.list.Title = fmt.Sprintf("%v %v/%v", c.def.Name, n, c.def.Limit)
+	if n >= c.def.Limit {
+		c.list.Styles.Title = c.list.Styles.Title.Background(lipgloss.Color("160"))
+	}
+}
+
+func (b *kanbanBoard) Init() tea.Cmd {
+	return nil
+}
+
+func (b *kanbanBoard) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		b.help.Width = msg.Width
+		width := msg.Width / len(b.cols)
+		for i := range b.cols {
+			b.cols[i].width = width - 2
+			b.cols[i].list.SetSize(width-6, msg.Height/2)
+		}
+		b.loaded = true
+		return b, nil
+	case taskMovedMsg:
+		b.err = nil
+		from := workflow.index(msg.from)
+		to := workflow.index(msg.task.Status)
+		if from < 0 || to < 0 {
+			return b, nil
+		}
+		b.cols[from].remove(msg.task.ID)
+		_, cmd := b.cols[to].insert(msg.task)
+		b.cols[from].updateTitle()
+		b.cols[to].updateTitle()
+		return b, cmd
+	case taskRankedMsg:
+		b.err = nil
+		col := workflow.index(msg.task.Status)
+		if col < 0 {
+			return b, nil
+		}
+		b.cols[col].remove(msg.task.ID)
+		i, cmd := b.cols[col].insert(msg.task)
+		b.cols[col].list.Select(i)
+		return b, cmd
+	case kanbanErrMsg:
+		b.err = msg.err
+		return b, nil
+	case taskConflictMsg:
+		b.conflict = &msg
+		return b, nil
+	case tea.KeyMsg:
+		if b.conflict != nil {
+			return b, b.resolveConflict(msg)
+		}
+		switch {
+		case key.Matches(msg, kanbanKeys.Quit):
+			b.quitting = true
+			return b, tea.Quit
+		case key.Matches(msg, kanbanKeys.Left):
+			b.focused = (b.focused + len(b.cols) - 1) % len(b.cols)
+			return b, nil
+		case key.Matches(msg, kanbanKeys.Right):
+			b.focused = (b.focused + 1) % len(b.cols)
+			return b, nil
+		case key.Matches(msg, kanbanKeys.Next):
+			return b, b.moveSelected(true)
+		case key.Matches(msg, kanbanKeys.Prev):
+			return b, b.moveSelected(false)
+		case key.Matches(msg, kanbanKeys.MoveUp):
+			return b, b.rankSelected(-1)
+		case key.Matches(msg, kanbanKeys.MoveDown):
+			return b, b.rankSelected(1)
+		case key.Matches(msg, kanbanKeys.Help):
+			b.help.ShowAll = !b.help.ShowAll
+			return b, nil
+		}
+	}
+	var cmd tea.Cmd
+	b.cols[b.focused].list, cmd = b.cols[b.focused].list.Update(msg)
+	return b, cmd
+}
+
+// moveSelected asks the server to move the selected task of the focused column
+// to the next (or previous) status of the workflow
+func (b *kanbanBoard) moveSelected(forward bool) tea.Cmd {
+	item := b.cols[b.focused].list.SelectedItem()
+	if item == nil {
+		return nil
+	}
+	task := item.(Task)
+	from := task.Status
+	to := from.Prev()
+	if forward {
+		to = from.Next()
+	}
+	if !workflow.canTransition(from, to) {
+		b.err = fmt.Errorf("cannot move %q from %q to %q", task.Name, from, to)
+		return nil
+	}
+	return func() tea.Msg {
+		return moveOnServer(task, task, to)
+	}
+}
+
+// moveOnServer moves a task to a status, as long as the task is still at the version of base
+// If it changed, a change of status by someone else is a conflict to resolve,
+// other changes are merged and the move is retried.
+func moveOnServer(base, task Task, to status) tea.Msg {
+	changes := map[string]interface{}{"Status": to.String()}
+	for {
+		updated, err := updateTaskOnServer(task.ID, base.Version, false, changes)
+		var conflict *conflictError
+		if !errors.As(err, &conflict) {
+			if err != nil {
+				return kanbanErrMsg{err}
+			}
+			return taskMovedMsg{updated, task.Status}
+		}
+		merged, conflicts := threeWayMerge(base, conflict.Current, changes)
+		if len(conflicts) > 0 {
+			return taskConflictMsg{task, conflict.Current, to}
+		}
+		if len(merged) == 0 {
+			// someone else made the same move
+			return taskMovedMsg{conflict.Current, task.Status}
+		}
+		base = conflict.Current
+	}
+}
+
+// resolveConflict keeps the move of the task, or takes the status someone else moved it to
+func (b *kanbanBoard) resolveConflict(msg tea.KeyMsg) tea.Cmd {
+	c := *b.conflict
+	switch {
+	case key.Matches(msg, kanbanKeys.KeepMine):
+		b.conflict = nil
+		return func() tea.Msg {
+			return moveOnServer(c.theirs, c.task, c.to)
+		}
+	case key.Matches(msg, kanbanKeys.KeepTheirs):
+		b.conflict = nil
+		return func() tea.Msg {
+			return taskMovedMsg{c.theirs, c.task.Status}
+		}
+	case key.Matches(msg, kanbanKeys.Quit):
+		b.quitting = true
+		return tea.Quit
+	}
+	return nil
+}
+
+// rankSelected asks the server to move the selected task of the focused column
+// up (offset -1) or down (offset 1) within the column
+func (b *kanbanBoard) rankSelected(offset int) tea.Cmd {
+	l := b.cols[b.focused].list
+	items := l.Items()
+	i := l.Index()
+	j := i + offset
+	if l.SelectedItem() == nil || l.FilterState() != list.Unfiltered || j < 0 || j >= len(items) {
+		return nil
+	}
+	task := items[i].(Task)
+	// the tasks the moved task goes between
+	var after, before int64
+	if offset < 0 {
+		before = items[j].(Task).ID
+		if j > 0 {
+			after = items[j-1].(Task).ID
+		}
+	} else {
+		after = items[j].(Task).ID
+		if j+1 < len(items) {
+			before = items[j+1].(Task).ID
+		}
+	}
+	return func() tea.Msg {
+		moved, err := moveTaskOnServer(task.ID, after, before)
+		if err != nil {
+			return kanbanErrMsg{err}
+		}
+		return taskRankedMsg{moved}
+	}
+}
+
+// insert adds a task to the column in rank order and returns its index
+func (c *kanbanColumn) insert(task Task) (int, tea.Cmd) {
+	items := c.list.Items()
+	i := 0
+	for i < len(items) && items[i].(Task).Rank <= task.Rank {
+		i++
+	}
+	return i, c.list.InsertItem(i, task)
+}
+
+// remove deletes the task with the given ID from the column
+func (c *kanbanColumn) remove(id int64) {
+	for i, item := range c.list.Items() {
+		if item.(Task).ID == id {
+			c.list.RemoveItem(i)
+			return
+		}
+	}
+}
+
+func (c kanbanColumn) View(focused bool) string {
+	style := lipgloss.NewStyle().
+		Padding(1, 2).
+		Width(c.width)
+	if focused {
+		style = style.Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("62"))
+	} else {
+		style = style.Border(lipgloss.HiddenBorder())
+	}
+	return style.Render(c.list.View())
+}
+
+func (b *kanbanBoard) View() string {
+	if b.quitting {
+		return ""
+	}
+	if !b.loaded {
+		return "loading..."
+	}
+	var cols []string
+	for i, c := range b.cols {
+		cols = append(cols, c.View(i == b.focused))
+	}
+	board := lipgloss.JoinHorizontal(lipgloss.Left, cols...)
+	var errLine string
+	if b.err != nil {
+		errLine = lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Render(b.err.Error())
+	}
+	if c := b.conflict; c != nil {
+		errLine = lipgloss.NewStyle().Foreground(lipgloss.Color("214")).Render(fmt.Sprintf(
+			"%q was moved from %q to %q by someone else. Move it to %q anyway? [m] keep my move, [t] take theirs",
+			c.task.Name, c.task.Status, c.theirs.Status, c.to))
+	}
+	if b.title != "" {
+		return lipgloss.JoinVertical(lipgloss.Left, b.title, board, errLine, b.help.View(kanbanKeys))
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, board, errLine, b.help.View(kanbanKeys))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// A Rate is how many requests a client may send: PerMinute on average, and up to Burst at once
+// A negative PerMinute doesn't limit the requests.
+type Rate struct {
+	PerMinute int
+	Burst     int `json:",omitempty"` // PerMinute / 6 if 0
+}
+
+// Limits protect the server from misbehaving clients, they are set in the Limits of config.json
+// The values that are not set take the defaults of defaultLimits.
+type Limits struct {
+	ClientRate Rate            `json:",omitempty"` // requests of each client address, before they are authenticated
+	TokenRate  Rate            `json:",omitempty"` // requests of each token or device
+	TokenRates map[string]Rate `json:",omitempty"` // requests of some tokens or devices by name, instead of TokenRate
+
+	MaxBodySize             int64 `json:",omitempty"` // bytes of a request body
+	MaxWebsocketMessageSize int64 `json:",omitempty"` // bytes of a message sent by a websocket client
+	MaxWebsockets           int   `json:",omitempty"` // open websocket connections of the server
+	MaxWebsocketsPerClient  int   `json:",omitempty"` // open websocket connections of each token or device
+	MaxWebsocketQueue       int   `json:",omitempty"` // messages waiting to be sent to a websocket client, which is dropped when it is full
+}
+
+// defaultLimits are the limits of a server without a config
+var defaultLimits = Limits{
+	ClientRate:              Rate{PerMinute: 1200, Burst: 200},
+	TokenRate:               Rate{PerMinute: 600, Burst: 100},
+	MaxBodySize:             1 << 20,
+	MaxWebsocketMessageSize: 64 << 10,
+	MaxWebsockets:           256,
+	MaxWebsocketsPerClient:  16,
+	MaxWebsocketQueue:       256,
+}
+
+// limits are the active limits of the server
+var limits = defaultLimits
+
+// withDefaults returns the limits with the defaults in place of the values that are not set
+func (l Limits) withDefaults() Limits {
+	if l.ClientRate.PerMinute == 0 {
+		l.ClientRate = defaultLimits.ClientRate
+	}
+	if l.TokenRate.PerMinute == 0 {
+		l.TokenRate = defaultLimits.TokenRate
+	}
+	if l.MaxBodySize == 0 {
+		l.MaxBodySize = defaultLimits.MaxBodySize
+	}
+	if l.MaxWebsocketMessageSize == 0 {
+		l.MaxWebsocketMessageSize = defaultLimits.MaxWebsocketMessageSize
+	}
+	if l.MaxWebsockets == 0 {
+		l.MaxWebsockets = defaultLimits.MaxWebsockets
+	}
+	if l.MaxWebsocketsPerClient == 0 {
+		l.MaxWebsocketsPerClient = defaultLimits.MaxWebsocketsPerClient
+	}
+	if l.MaxWebsocketQueue == 0 {
+		l.MaxWebsocketQueue = defaultLimits.MaxWebsocketQueue
+	}
+	return l
+}
+
+// validate checks that the limits are not negative, except for the rates that are turned off
+func (l Limits) validate() error {
+	rates := map[string]Rate{"ClientRate": l.ClientRate, "TokenRate": l.TokenRate}
+	for name, r := range l.TokenRates {
+		rates["TokenRates."+name] = r
+	}
+	for name, r := range rates {
+		if r.Burst < 0 {
+			return fmt.Errorf("limits: %v: Burst must not be negative", name)
+		}
+		if r.PerMinute == 0 && name != "ClientRate" && name != "TokenRate" {
+			return fmt.Errorf("limits: %v: PerMinute must be set", name)
+		}
+	}
+	if l.MaxBodySize < 0 || l.MaxWebsocketMessageSize < 0 || l.MaxWebsockets < 0 || l.MaxWebsocketsPerClient < 0 || l.MaxWebsocketQueue < 0 {
+		return fmt.Errorf("limits: sizes and connection counts must not be negative")
+	}
+	return nil
+}
+
+// A rateLimiter keeps a token bucket for each client, refilled at the rate of the client
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// A bucket holds the requests a client may send right away
+type bucket struct {
+	tokens float64
+	last   time.Time // when the tokens were counted
+	full   time.Time // when the bucket is full again, after which it can be forgotten
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// clientLimiter and tokenLimiter limit the requests of each client address and of each token or device,
+// with the same buckets for the HTTP API, the requests sent over /ws and the gRPC calls
+var clientLimiter, tokenLimiter = newRateLimiter(), newRateLimiter()
+
+// wait takes a request from the bucket of a client and returns zero,
+// or how long the client must wait before its next request if the bucket is empty
+func (l *rateLimiter) wait(key string, r Rate, now time.Time) time.Duration {
+	if r.PerMinute < 0 {
+		return 0
+	}
+	perSecond := float64(r.PerMinute) / 60
+	burst := float64(r.Burst)
+	if burst == 0 {
+		burst = math.Max(1, float64(r.PerMinute/6))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((burst - b.tokens) / perSecond * float64(time.Second)))
+	return 0
+}
+
+// sweep forgets the full buckets once a minute, a full bucket is the same as a new one
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimited returns the response for a request over the rate of its client
+func rateLimited(c echo.Context, wait time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return newAPIError(http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("Too many requests, retry in %v", wait.Round(time.Second)))
+}
+
+// limitClients limits the requests of each client address to limits.ClientRate
+func limitClients(l *rateLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if wait := l.wait("ip:"+c.RealIP(), limits.ClientRate, time.Now()); wait > 0 {
+				return rateLimited(c, wait)
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitTokens limits the requests of each token or device to its rate, it comes after authenticate
+func limitTokens(l *rateLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var name string
+			if d, ok := c.Get("device").(Device); ok {
+				name = d.Name
+			} else if t, ok := c.Get("token").(Token); ok {
+				name = t.Name
+			} else {
+				return next(c)
+			}
+			if wait := l.wait(requester(c), tokenRate(name), time.Now()); wait > 0 {
+				return rateLimited(c, wait)
+			}
+			return next(c)
+		}
+	}
+}
+
+// tokenRate returns the rate of a token or device by name, see Limits.TokenRates
+func tokenRate(name string) Rate {
+	if r, ok := limits.TokenRates[name]; ok {
+		return r
+	}
+	return limits.TokenRate
+}
+
+// limitBody refuses the request bodies larger than limits.MaxBodySize with 413
+func limitBody() echo.MiddlewareFunc {
+	return middleware.BodyLimit(strconv.FormatInt(limits.MaxBodySize, 10))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"task-gopher/cmd/task-gopher/taskpb"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+	r := Rate{PerMinute: 60, Burst: 3}
+	now := time.Date(2023, 11, 18, 12, 0, 0, 0, time.UTC)
+	// the burst is allowed right away
+	for i := 0; i < 3; i++ {
+		if wait := l.wait("a", r, now); wait != 0 {
+			t.Fatalf("request %v: got wait %v, want none", i, wait)
+		}
+	}
+	if wait := l.wait("a", r, now); wait != time.Second {
+		t.Errorf("got wait %v after the burst, want 1s", wait)
+	}
+	// other clients have their own bucket
+	if wait := l.wait("b", r, now); wait != 0 {
+		t.Errorf("got wait %v for another client, want none", wait)
+	}
+	// the bucket refills at the rate
+	if wait := l.wait("a", r, now.Add(time.Second)); wait != 0 {
+		t.Errorf("got wait %v a second later, want none", wait)
+	}
+	if wait := l.wait("a", Rate{PerMinute: -1}, now.Add(time.Second)); wait != 0 {
+		t.Errorf("got wait %v without a limit, want none", wait)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	defer func() { limits = defaultLimits }()
+	limits = Limits{
+		TokenRate:   Rate{PerMinute: 60, Burst: 2},
+		TokenRates:  map[string]Rate{"script": {PerMinute: 60, Burst: 1}},
+		MaxBodySize: 100,
+	}.withDefaults()
+	laptop, err := createToken(db, Token{Name: "laptop", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := createToken(db, Token{Name: "script", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newServer()
+	send := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, apiPrefix+"/tasks/add", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send(laptop, `{"Name": "`+strings.Repeat("a", 100)+`"}`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v for a large body, want 413", rec.Code)
+	}
+	var tests = []struct {
+		token    string
+		wantCode int
+	}{
+		{script, http.StatusOK},
+		{script, http.StatusTooManyRequests},
+		// the large body was refused before the token was checked
+		{laptop, http.StatusOK},
+		{laptop, http.StatusOK},
+		{laptop, http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		rec := send(tt.token, `{"Name": "test"}`)
+		if rec.Code != tt.wantCode {
+			t.Errorf("request %v: got status %v, want %v", i, rec.Code, tt.wantCode)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("request %v: got Retry-After %q, want 1", i, rec.Header().Get("Retry-After"))
+		}
+	}
+
+	// the requests over /ws and gRPC count in the same rate
+	client := wsClient{id: "cli-1", who: "token script", name: "script", scope: scopeWrite}
+	if res := answerRequest(client, []byte(`{"RequestID": "1", "Action": "list"}`)); res.Error == nil || res.Error.Code != codeRateLimited {
+		t.Errorf("got websocket response %+v, want %v", res, codeRateLimited)
+	}
+	if _, err := dialGRPC(t).ListTasks(withToken(script), &taskpb.ListTasksRequest{}); grpcstatus.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got gRPC error %v, want ResourceExhausted", err)
+	}
+}
+
+func TestCheckWebsocketLimits(t *testing.T) {
+	defer func() { limits = defaultLimits }()
+	limits = Limits{MaxWebsockets: 3, MaxWebsocketsPerClient: 2}.withDefaults()
+	var conns []*wsConn
+	add := func(who string) {
+		c := newWSConn(nil, wsClient{who: who})
+		if err := hub.add(c); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	defer func() {
+		for _, c := range conns {
+			hub.remove(c)
+		}
+	}()
+	add("token a")
+	add("token a")
+
+	if err := checkWebsocketLimits("token a"); toAPIError(err).Status != http.StatusTooManyRequests {
+		t.Errorf("got %v for a client at its limit, want 429", err)
+	}
+	if err := checkWebsocketLimits("token b"); err != nil {
+		t.Errorf("got %v for another client, want no error", err)
+	}
+	add("token b")
+	if err := checkWebsocketLimits("token c"); toAPIError(err).Status != http.StatusServiceUnavailable {
+		t.Errorf("got %v for a full server, want 503", err)
+	}
+	if err := hub.add(newWSConn(nil, wsClient{who: "token c"})); toAPIError(err).Status != http.StatusServiceUnavailable {
+		t.Errorf("got %v adding to a full server, want 503", err)
+	}
+}
+
+func TestHubWebsocketLimits(t *testing.T) {
+	defer func() { limits = defaultLimits }()
+	limits = Limits{MaxWebsocketsPerClient: 2}.withDefaults()
+
+	// the connections opened at the same time all pass checkWebsocketLimits, the hub lets in only as many as allowed
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var added []*wsConn
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := newWSConn(nil, wsClient{who: "token a"})
+			if err := hub.add(c); err != nil {
+				if toAPIError(err).Status != http.StatusTooManyRequests {
+					t.Errorf("got %v, want 429", err)
+				}
+				return
+			}
+			mu.Lock()
+			added = append(added, c)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	defer func() {
+		for _, c := range added {
+			hub.remove(c)
+		}
+	}()
+	if len(added) != limits.MaxWebsocketsPerClient {
+		t.Errorf("added %v connections, want %v", len(added), limits.MaxWebsocketsPerClient)
+	}
+}
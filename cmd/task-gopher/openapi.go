@@ -0,0 +1,28 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openAPISpec is the OpenAPI 3 document of the API, it must describe every route of newServer
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage is a page showing the OpenAPI document to people
+//
+//go:embed docs.html
+var docsPage []byte
+
+// handleOpenAPI returns the OpenAPI document of the API
+func handleOpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, openAPISpec)
+}
+
+// handleDocs returns the documentation page of the API
+func handleDocs(c echo.Context) error {
+	return c.HTMLBlob(http.StatusOK, docsPage)
+}
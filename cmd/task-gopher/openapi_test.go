@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// openAPIPaths returns the operations of the OpenAPI document, as methods by path
+func openAPIPaths(t *testing.T) map[string]map[string]json.RawMessage {
+	var spec struct {
+		OpenAPI string
+		Paths   map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("got OpenAPI version %q, want 3.x", spec.OpenAPI)
+	}
+	return spec.Paths
+}
+
+func TestOpenAPIDocumentsRoutes(t *testing.T) {
+	paths := openAPIPaths(t)
+	param := regexp.MustCompile(`:(\w+)`)
+	var registered = map[string]bool{}
+	for _, r := range newServer().Routes() {
+		// echo writes path parameters as :id, OpenAPI as {id}
+		// The paths of the document are relative to apiPrefix, which the deprecated aliases don't have.
+		path := param.ReplaceAllString(strings.TrimPrefix(r.Path, apiPrefix), "{$1}")
+		method := strings.ToLower(r.Method)
+		registered[method+" "+path] = true
+		if _, ok := paths[path][method]; !ok {
+			t.Errorf("route %v %v is not documented in openapi.json", r.Method, r.Path)
+		}
+	}
+	// the other keys of a path item, like parameters, are shared by its operations
+	operations := map[string]bool{"get": true, "post": true, "put": true, "patch": true, "delete": true}
+	for path, item := range paths {
+		for method := range item {
+			if operations[method] && !registered[method+" "+path] {
+				t.Errorf("openapi.json documents %v %v, which is not a route", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIRefs(t *testing.T) {
+	var spec interface{}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	// every reference must point to a component of the document
+	var check func(v interface{})
+	check = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				var target interface{} = spec
+				for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					obj, _ := target.(map[string]interface{})
+					target = obj[key]
+				}
+				if target == nil {
+					t.Errorf("unresolved reference %v", ref)
+				}
+			}
+			for _, child := range v {
+				check(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				check(child)
+			}
+		}
+	}
+	check(spec)
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	e := newServer()
+	var tests = []struct {
+		path           string
+		wantDeprecated bool
+	}{
+		{apiPrefix + "/openapi.json", false},
+		{"/openapi.json", true},
+		{"/api", false},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %v: got status %v", tt.path, rec.Code)
+		}
+		deprecated := rec.Header().Get("Deprecation") != ""
+		if deprecated != tt.wantDeprecated {
+			t.Errorf("GET %v: got deprecated %v, want %v", tt.path, deprecated, tt.wantDeprecated)
+		}
+		if deprecated && rec.Header().Get("Link") != "<"+apiPrefix+tt.path+`>; rel="successor-version"` {
+			t.Errorf("GET %v: got Link %q", tt.path, rec.Header().Get("Link"))
+		}
+	}
+}
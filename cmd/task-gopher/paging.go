@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// page sizes of GET /tasks
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// defaultSort is the order of the tasks when none is given, the order of the board
+const defaultSort = "rank,created"
+
+// A TaskQuery selects a page of tasks
+type TaskQuery struct {
+	Filter string // see filter.go, all the tasks if empty
+	Sort   string // comma-separated fields, each optionally prefixed with '-' for descending order
+	Limit  int    // the size of the page
+	Cursor string // where the page starts, as returned with the previous page; the first page if empty
+}
+
+// a sortKey is an SQL expression the tasks are ordered by
+type sortKey struct {
+	expr string
+	args []interface{}
+	desc bool
+}
+
+// A pageCursor is the position after the last task of a page
+// It holds the sort keys of that task, and the sort they belong to.
+type pageCursor struct {
+	Sort   string
+	Values []interface{}
+}
+
+// sortKeys returns the SQL sort keys of a sort
+// Tasks without a value for a field are placed last, in either order, and ties are broken by ID.
+func sortKeys(sort string, defs map[string]FieldDef) ([]sortKey, error) {
+	var keys []sortKey
+	byID := false
+	for _, field := range strings.Split(sort, ",") {
+		field = strings.TrimSpace(field)
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimLeft(field, "+-")
+		if field == "" {
+			continue
+		}
+		// the expression of the field, and whether it can be empty
+		var expr string
+		var args []interface{}
+		emptyLast := true
+		switch strings.ToLower(field) {
+		case "id":
+			expr, emptyLast, byID = "tasks.id", false, true
+		case "status":
+			// board order
+			var cases strings.Builder
+			for i, def := range workflow {
+				fmt.Fprintf(&cases, " WHEN %d THEN %d", def.ID, i)
+			}
+			expr = "CASE tasks.status" + cases.String() + fmt.Sprintf(" ELSE %d END", len(workflow))
+			emptyLast = false
+		case "type":
+			expr, emptyLast = "tasks.type", false
+		case "created":
+			expr, emptyLast = "datetime(tasks.created)", false
+		case "name":
+			expr = "IFNULL(tasks.name, '')"
+		case "desc", "description":
+			expr = "IFNULL(tasks.description, '')"
+		case "tag":
+			expr = "IFNULL(tasks.tag, '')"
+		case "rank":
+			expr = "IFNULL(tasks.rank, '')"
+		case "due":
+			expr = "IFNULL(tasks.due, '')"
+		default:
+			def, ok := defs[field]
+			if !ok {
+				return nil, fmt.Errorf("unknown sort field %q", field)
+			}
+			value := "(SELECT value FROM task_fields WHERE task_fields.task_id = tasks.id AND task_fields.name = ?)"
+			keys = append(keys, sortKey{expr: "IFNULL(" + value + ", '') = ''", args: []interface{}{def.Name}})
+			emptyLast = false
+			args = []interface{}{def.Name}
+			switch def.Type {
+			case fieldNumber:
+				// never NULL, which the cursor couldn't compare to, the key above puts the tasks without it last
+				expr = "IFNULL(CAST(" + value + " AS REAL), 0)"
+			case fieldEnum:
+				// declaration order of the options
+				var cases strings.Builder
+				for i, o := range def.Options {
+					fmt.Fprintf(&cases, " WHEN ? THEN %d", i)
+					args = append(args, o)
+				}
+				expr = "CASE " + value + cases.String() + fmt.Sprintf(" ELSE %d END", len(def.Options))
+			default:
+				expr = "IFNULL(" + value + ", '')"
+			}
+		}
+		if emptyLast {
+			keys = append(keys, sortKey{expr: expr + " = ''"})
+		}
+		keys = append(keys, sortKey{expr: expr, args: args, desc: desc})
+	}
+	if !byID {
+		keys = append(keys, sortKey{expr: "tasks.id"})
+	}
+	return keys, nil
+}
+
+// encodeCursor returns the opaque form of a cursor
+func encodeCursor(cur pageCursor) string {
+	data, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor returned by encodeCursor
+func decodeCursor(s string) (pageCursor, error) {
+	var cur pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &cur)
+	}
+	if err != nil {
+		return cur, fmt.Errorf("invalid cursor %q", s)
+	}
+	return cur, nil
+}
+
+// getTaskPage returns a page of the tasks matching a query, and the cursor of the next page if there is one
+func getTaskPage(db queryer, q TaskQuery) ([]Task, string, error) {
+	if q.Limit <= 0 || q.Limit > maxPageSize {
+		return nil, "", &queryError{fmt.Errorf("limit must be between 1 and %d", maxPageSize)}
+	}
+	if q.Sort == "" {
+		q.Sort = defaultSort
+	}
+	node, err := parseFilter(q.Filter)
+	if err != nil {
+		return nil, "", &queryError{fmt.Errorf("invalid filter: %w", err)}
+	}
+	defs, err := getFields(db)
+	if err != nil {
+		return nil, "", err
+	}
+	where, whereArgs, err := compileFilter(node, defs, time.Now())
+	if err != nil {
+		return nil, "", &queryError{fmt.Errorf("invalid filter: %w", err)}
+	}
+	keys, err := sortKeys(q.Sort, defs)
+	if err != nil {
+		return nil, "", &queryError{err}
+	}
+
+	// select the sort keys along with the tasks, to order them and build the next cursor
+	var args []interface{}
+	var columns, order []string
+	for i, k := range keys {
+		columns = append(columns, fmt.Sprintf("%v AS s%d", k.expr, i))
+		args = append(args, k.args...)
+		dir := "ASC"
+		if k.desc {
+			dir = "DESC"
+		}
+		order = append(order, fmt.Sprintf("s%d %v", i, dir))
+	}
+	args = append(args, whereArgs...)
+
+	// keyset pagination: the tasks after the cursor, for the same sort
+	after := "1"
+	if q.Cursor != "" {
+		cur, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", &queryError{err}
+		}
+		if cur.Sort != q.Sort || len(cur.Values) != len(keys) {
+			return nil, "", &queryError{fmt.Errorf("the cursor belongs to another sort than %q", q.Sort)}
+		}
+		var terms []string
+		for i, k := range keys {
+			var eq []string
+			for j := 0; j < i; j++ {
+				eq = append(eq, fmt.Sprintf("s%d = ?", j))
+				args = append(args, cur.Values[j])
+			}
+			op := ">"
+			if k.desc {
+				op = "<"
+			}
+			terms = append(terms, "("+strings.Join(append(eq, fmt.Sprintf("s%d %v ?", i, op)), " AND ")+")")
+			args = append(args, cur.Values[i])
+		}
+		after = strings.Join(terms, " OR ")
+	}
+	// one more task than the page tells whether there is a next page
+	args = append(args, q.Limit+1)
+
+	rows, err := db.Query(`
+        SELECT * FROM (
+            SELECT id, name, description, status, type, tag, created, rank, due, version, `+strings.Join(columns, ", ")+`
+            FROM tasks
+            WHERE `+where+`
+        )
+        WHERE `+after+`
+        ORDER BY `+strings.Join(order, ", ")+`
+        LIMIT ?;
+    `, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var tasks = []Task{}
+	var last []interface{}
+	more := false
+	for rows.Next() {
+		values := make([]interface{}, len(keys))
+		dest := make([]interface{}, len(keys))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		task, err := row2Task(rows, dest...)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(tasks) == q.Limit {
+			more = true
+			break
+		}
+		tasks = append(tasks, task)
+		last = values
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	rows.Close()
+	if err = loadTaskFields(db, tasks); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if more {
+		for i, v := range last {
+			// text is scanned as bytes
+			if b, ok := v.([]byte); ok {
+				last[i] = string(b)
+			}
+		}
+		next = encodeCursor(pageCursor{Sort: q.Sort, Values: last})
+	}
+	return tasks, next, nil
+}
+
+// selectFields returns the tasks with only the given fields, e.g. "ID,Name,Status"
+// The names of user-defined fields select those fields in Fields.
+func selectFields(tasks []Task, fields string, defs map[string]FieldDef) ([]map[string]interface{}, error) {
+	var builtin, custom []string
+	for _, name := range strings.Split(fields, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if key, ok := taskJSONKey(name); ok {
+			builtin = append(builtin, key)
+		} else if _, ok := defs[name]; ok {
+			custom = append(custom, name)
+		} else {
+			return nil, &queryError{fmt.Errorf("unknown field %q", name)}
+		}
+	}
+	var selected = []map[string]interface{}{}
+	for _, task := range tasks {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]interface{}
+		if err = json.Unmarshal(data, &all); err != nil {
+			return nil, err
+		}
+		var m = map[string]interface{}{}
+		for _, key := range builtin {
+			if v, ok := all[key]; ok {
+				m[key] = v
+			}
+		}
+		for _, name := range custom {
+			if v, ok := task.Fields[name]; ok {
+				if m["Fields"] == nil {
+					m["Fields"] = map[string]interface{}{}
+				}
+				m["Fields"].(map[string]interface{})[name] = v
+			}
+		}
+		selected = append(selected, m)
+	}
+	return selected, nil
+}
+
+// taskJSONKey returns the JSON key of a field of Task, matched case-insensitively
+func taskJSONKey(name string) (string, bool) {
+	for _, key := range []string{"ID", "Name", "Desc", "Status", "Type", "Created", "Tag", "Rank", "Due", "Version", "Fields"} {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setupPagingTests creates tasks 1 to 4 with estimates of 10, none, 9 and none, and envs dev, none, prod and none
+func setupPagingTests(t *testing.T) {
+	db = setupTests()
+	for _, def := range []FieldDef{
+		{Name: "estimate", Type: fieldNumber},
+		{Name: "env", Type: fieldEnum, Options: []string{"prod", "dev"}},
+	} {
+		if err := addField(db, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, fields := range []map[string]string{
+		{"estimate": "10", "env": "dev"},
+		nil,
+		{"estimate": "9", "env": "prod"},
+		nil,
+	} {
+		id, err := addTask(db, "task", "", todo, generic, "", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = setTaskFields(db, id, fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetTaskPageSort(t *testing.T) {
+	var tests = []struct {
+		sort    string
+		want    []int64
+		wantErr bool
+	}{
+		{"", []int64{1, 2, 3, 4}, false},
+		{"estimate", []int64{3, 1, 2, 4}, false},
+		{"-estimate", []int64{1, 3, 2, 4}, false},
+		{"env", []int64{3, 1, 2, 4}, false},
+		{"-id", []int64{4, 3, 2, 1}, false},
+		{"name,-estimate", []int64{1, 3, 2, 4}, false},
+		{"owner", nil, true},
+	}
+	setupPagingTests(t)
+	defer teardownTests(db)
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			tasks, _, err := getTaskPage(db, TaskQuery{Sort: tt.sort, Limit: maxPageSize})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			var qerr *queryError
+			if err != nil && !errors.As(err, &qerr) {
+				t.Errorf("expected a queryError, got %v", err)
+			}
+			var ids []int64
+			for _, task := range tasks {
+				ids = append(ids, task.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTaskPageCursor(t *testing.T) {
+	setupPagingTests(t)
+	defer teardownTests(db)
+	// tasks 2 and 4 don't have the fields, so the pages after the first task without them must still have the other
+	for _, sort := range []string{"", "estimate", "-estimate", "env", "-env", "-id", "-created", "status,name"} {
+		t.Run(sort, func(t *testing.T) {
+			all, _, err := getTaskPage(db, TaskQuery{Sort: sort, Limit: maxPageSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// page through the tasks one at a time
+			var paged []Task
+			q := TaskQuery{Sort: sort, Limit: 1}
+			for i := 0; i <= len(all); i++ {
+				page, next, err := getTaskPage(db, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paged = append(paged, page...)
+				if next == "" {
+					break
+				}
+				q.Cursor = next
+			}
+			if len(all) != 4 || !reflect.DeepEqual(paged, all) {
+				t.Errorf("got %v, want %v", paged, all)
+			}
+		})
+	}
+
+	_, next, err := getTaskPage(db, TaskQuery{Sort: "estimate", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []TaskQuery{
+		{Sort: "-estimate", Limit: 1, Cursor: next},
+		{Limit: 1, Cursor: "not a cursor"},
+		{Limit: 0},
+		{Limit: maxPageSize + 1},
+	} {
+		if _, _, err := getTaskPage(db, q); err == nil {
+			t.Errorf("expected an error for %+v", q)
+		}
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	defs := map[string]FieldDef{"estimate": {Name: "estimate", Type: fieldNumber}}
+	tasks := []Task{
+		{ID: 1, Name: "one", Tag: "work", Version: 3, Fields: map[string]string{"estimate": "3", "env": "dev"}},
+		{ID: 2, Name: "two", Version: 1},
+	}
+	got, err := selectFields(tasks, "id,Name, estimate,version", defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{
+		{"ID": float64(1), "Name": "one", "Version": float64(3), "Fields": map[string]interface{}{"estimate": "3"}},
+		{"ID": float64(2), "Name": "two", "Version": float64(1)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := selectFields(tasks, "ID,owner", defs); err == nil {
+		t.Errorf("expected an error for an unknown field")
+	}
+}
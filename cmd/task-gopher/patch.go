@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// the longest text values of a task, in characters
+const (
+	maxNameLength = 200
+	maxDescLength = 10000
+	maxTagLength  = 50
+)
+
+// A NewTask is the body of a request adding a task
+type NewTask struct {
+	Name   string
+	Desc   string
+	Status string // the name or ID of a status, the initial status of the workflow if empty
+	Type   string // generic if empty
+	Tag    string
+	Due    string      // a date like YYYY-MM-DD or an offset like 3d, none if empty
+	Fields interface{} // user-defined field values, see getBodyFields
+}
+
+// task validates the request and returns the task it adds, its due date is relative to now
+func (r NewTask) task(now time.Time) (Task, error) {
+	var task = Task{Name: r.Name, Desc: r.Desc, Tag: r.Tag, Status: workflow.initial(), Type: generic}
+	var err error
+	if err = checkText("Name", r.Name, maxNameLength); err != nil {
+		return Task{}, err
+	}
+	if err = checkText("Desc", r.Desc, maxDescLength); err != nil {
+		return Task{}, err
+	}
+	if err = checkText("Tag", r.Tag, maxTagLength); err != nil {
+		return Task{}, err
+	}
+	if r.Status != "" {
+		if task.Status, err = workflow.parse(r.Status); err != nil {
+			return Task{}, &fieldError{"Status", err}
+		}
+	}
+	if r.Type != "" {
+		if task.Type, err = parseTaskType(r.Type); err != nil {
+			return Task{}, &fieldError{"Type", err}
+		}
+	}
+	if r.Due != "" {
+		if task.Due, err = parseDueValue(r.Due, now); err != nil {
+			return Task{}, &fieldError{"Due", err}
+		}
+	}
+	if task.Fields, err = getBodyFields(r.Fields); err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+// checkText checks that a text value of a task is at most max characters long, names must not be blank
+func checkText(key, s string, max int) error {
+	if key == "Name" && strings.TrimSpace(s) == "" {
+		return &fieldError{key, fmt.Errorf("Name must not be empty")}
+	}
+	if n := utf8.RuneCountInString(s); n > max {
+		return &fieldError{key, fmt.Errorf("%v must be at most %v characters long, got %v", key, max, n)}
+	}
+	return nil
+}
+
+// parseDueValue parses a due date given as RFC 3339, like tasks sent back as they were received, or as parseDue does
+func parseDueValue(s string, now time.Time) (time.Time, error) {
+	if due, err := time.Parse(time.RFC3339, s); err == nil {
+		return due, nil
+	}
+	return parseDue(s, now)
+}
+
+// A TaskPatch changes some of the values of a task, the nil ones are left unchanged
+// It is the typed form of a JSON Merge Patch (RFC 7386) of a task, see parseTaskPatch.
+type TaskPatch struct {
+	Name   *string
+	Desc   *string
+	Status *status
+	Type   *task_type
+	Tag    *string
+	Due    *time.Time // a zero time clears the due date
+
+	Fields      map[string]string // user-defined field values, an empty value clears the field
+	ClearFields bool              // clear the fields that are not in Fields
+}
+
+// readOnlyKeys are the values of a task that a patch can't change, and ignores
+// so that a task can be sent back as it was received
+var readOnlyKeys = map[string]bool{"ID": true, "Created": true, "Rank": true, "Version": true}
+
+// parseTaskPatch parses a JSON Merge Patch of a task: absent values are unchanged and null clears a value
+// Due dates are relative to now.
+func parseTaskPatch(body map[string]interface{}, now time.Time) (TaskPatch, error) {
+	var p TaskPatch
+	for key, value := range body {
+		var err error
+		switch key {
+		case "Name":
+			if p.Name, err = patchString(key, value); err == nil {
+				err = checkText(key, *p.Name, maxNameLength)
+			}
+		case "Desc":
+			if p.Desc, err = patchString(key, value); err == nil {
+				err = checkText(key, *p.Desc, maxDescLength)
+			}
+		case "Tag":
+			if p.Tag, err = patchString(key, value); err == nil {
+				err = checkText(key, *p.Tag, maxTagLength)
+			}
+		case "Status":
+			var s status
+			switch v := value.(type) {
+			case string:
+				s, err = workflow.parse(v)
+			case float64:
+				s, err = workflow.parse(strconv.Itoa(int(v)))
+			default:
+				err = fmt.Errorf("Status must be the name or the ID of a status")
+			}
+			p.Status = &s
+		case "Type":
+			var t task_type
+			switch v := value.(type) {
+			case string:
+				t, err = parseTaskType(v)
+			case float64:
+				if t = task_type(v); t < generic || t >= invalidType {
+					err = fmt.Errorf("unknown task type %v", v)
+				}
+			default:
+				err = fmt.Errorf("Type must be one of generic, daily or habit")
+			}
+			p.Type = &t
+		case "Due":
+			var due time.Time
+			switch v := value.(type) {
+			case nil:
+			case string:
+				due, err = parseDueValue(v, now)
+			default:
+				err = fmt.Errorf("Due must be a date like YYYY-MM-DD or an offset like 3d")
+			}
+			p.Due = &due
+		case "Fields":
+			if value == nil {
+				p.ClearFields = true
+				continue
+			}
+			p.Fields, err = getBodyFields(value)
+		default:
+			if !readOnlyKeys[key] {
+				err = fmt.Errorf("unknown task value %q", key)
+			}
+		}
+		if err != nil {
+			var fieldErr *fieldError
+			if !errors.As(err, &fieldErr) {
+				err = &fieldError{key, err}
+			}
+			return TaskPatch{}, err
+		}
+	}
+	return p, nil
+}
+
+// patchString returns a string value of a patch, null is the empty string
+func patchString(key string, value interface{}) (*string, error) {
+	switch v := value.(type) {
+	case nil:
+		s := ""
+		return &s, nil
+	case string:
+		return &v, nil
+	}
+	return nil, fmt.Errorf("%v must be a string", key)
+}
+
+// replacing returns the patch that replaces a task with the values of p, the values p doesn't have are cleared
+func (p TaskPatch) replacing() (TaskPatch, error) {
+	if p.Name == nil {
+		return TaskPatch{}, &fieldError{"Name", fmt.Errorf("Name must not be empty")}
+	}
+	empty := ""
+	if p.Desc == nil {
+		p.Desc = &empty
+	}
+	if p.Tag == nil {
+		p.Tag = &empty
+	}
+	if p.Status == nil {
+		initial := workflow.initial()
+		p.Status = &initial
+	}
+	if p.Type == nil {
+		t := generic
+		p.Type = &t
+	}
+	if p.Due == nil {
+		p.Due = &time.Time{}
+	}
+	p.ClearFields = true
+	return p, nil
+}
+
+// apply returns the task with the changes of the patch
+func (p TaskPatch) apply(t Task) Task {
+	if p.Name != nil {
+		t.Name = *p.Name
+	}
+	if p.Desc != nil {
+		t.Desc = *p.Desc
+	}
+	if p.Status != nil {
+		t.Status = *p.Status
+	}
+	if p.Type != nil {
+		t.Type = *p.Type
+	}
+	if p.Tag != nil {
+		t.Tag = *p.Tag
+	}
+	if p.Due != nil {
+		t.Due = *p.Due
+	}
+	fields := map[string]string{}
+	if !p.ClearFields {
+		for k, v := range t.Fields {
+			fields[k] = v
+		}
+	}
+	for k, v := range p.Fields {
+		if v == "" {
+			delete(fields, k)
+		} else {
+			fields[k] = v
+		}
+	}
+	t.Fields = nil
+	if len(fields) > 0 {
+		t.Fields = fields
+	}
+	return t
+}
+
+// updateTask applies a patch to a task in the database, increments its version and returns the updated task
+// If version is set, it fails with errVersionConflict unless it is the current version of the task.
+func updateTask(db queryer, id, version int64, p TaskPatch) (Task, error) {
+	orig, err := getTask(db, id)
+	if err != nil {
+		return Task{}, err
+	}
+	// the task must not have changed since the caller read it
+	if version != 0 && version != orig.Version {
+		return Task{}, errVersionConflict
+	}
+	if p.Fields, err = validateFields(db, p.Fields); err != nil {
+		return Task{}, err
+	}
+	task := p.apply(orig)
+
+	updateStatement := `
+        UPDATE tasks
+        SET
+            name = ?,
+            description = ?,
+            status = ?,
+            type = ?,
+            tag = ?,
+            due = ?,
+            version = version + 1
+        WHERE id = ? AND version = ?;`
+	res, err := db.Exec(updateStatement, task.Name, task.Desc, task.Status, task.Type, task.Tag, formatDue(task.Due), id, orig.Version)
+	if err != nil {
+		return Task{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Task{}, err
+	}
+	// someone else changed the task between the read and the write
+	if n == 0 {
+		return Task{}, errVersionConflict
+	}
+
+	// the fields that are set, and the cleared ones
+	var fields = map[string]string{}
+	for k := range orig.Fields {
+		fields[k] = ""
+	}
+	for k, v := range task.Fields {
+		fields[k] = v
+	}
+	if err = setTaskFields(db, id, fields); err != nil {
+		return Task{}, err
+	}
+	return getTask(db, id)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTaskPatch(t *testing.T) {
+	now := time.Date(2023, 11, 18, 23, 43, 34, 0, time.UTC)
+	name, empty := "name", ""
+	progress := inProgress
+	daily := daily
+	due := time.Date(2023, 11, 21, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name    string
+		input   map[string]interface{}
+		want    TaskPatch
+		wantErr bool
+	}{
+		{"absent values are unchanged", map[string]interface{}{}, TaskPatch{}, false},
+		{"values are set", map[string]interface{}{"Name": "name", "Status": "in progress", "Type": "daily", "Due": "3d"},
+			TaskPatch{Name: &name, Status: &progress, Type: &daily, Due: &due}, false},
+		{"statuses can be given by ID", map[string]interface{}{"Status": float64(1)}, TaskPatch{Status: &progress}, false},
+		{"null clears a value", map[string]interface{}{"Tag": nil, "Due": nil, "Fields": nil},
+			TaskPatch{Tag: &empty, Due: &time.Time{}, ClearFields: true}, false},
+		{"null clears a field", map[string]interface{}{"Fields": map[string]interface{}{"env": nil, "points": float64(3)}},
+			TaskPatch{Fields: map[string]string{"env": "", "points": "3"}}, false},
+		{"read-only values are ignored", map[string]interface{}{"ID": float64(4), "Version": float64(2)}, TaskPatch{}, false},
+		{"name must not be cleared", map[string]interface{}{"Name": nil}, TaskPatch{}, true},
+		{"unknown values are an error", map[string]interface{}{"Owner": "me"}, TaskPatch{}, true},
+		{"values must have the right type", map[string]interface{}{"Tag": float64(3)}, TaskPatch{}, true},
+		{"unknown status", map[string]interface{}{"Status": "later"}, TaskPatch{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTaskPatch(tt.input, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	orig := Task{
+		ID:      1,
+		Name:    "name",
+		Tag:     "tag",
+		Desc:    "test",
+		Status:  inProgress,
+		Due:     time.Date(2023, 11, 21, 0, 0, 0, 0, time.UTC),
+		Created: time.Date(2023, 11, 18, 7, 42, 34, 1, time.UTC),
+		Version: 3,
+		Fields:  map[string]string{"env": "dev", "points": "3"},
+	}
+	desc, empty := "new", ""
+	replace, err := TaskPatch{Name: &orig.Name}.replacing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		input TaskPatch
+		want  Task
+	}{
+		{"an empty patch changes nothing", TaskPatch{}, orig},
+		{"only the given values change", TaskPatch{Desc: &desc, Tag: &empty, Due: &time.Time{}}, Task{
+			ID: 1, Name: "name", Desc: "new", Status: inProgress, Created: orig.Created, Version: 3,
+			Fields: map[string]string{"env": "dev", "points": "3"},
+		}},
+		{"fields are merged", TaskPatch{Fields: map[string]string{"env": "", "owner": "me"}}, Task{
+			ID: 1, Name: "name", Tag: "tag", Desc: "test", Status: inProgress, Due: orig.Due, Created: orig.Created, Version: 3,
+			Fields: map[string]string{"points": "3", "owner": "me"},
+		}},
+		{"replacing clears the other values", replace, Task{
+			ID: 1, Name: "name", Status: workflow.initial(), Created: orig.Created, Version: 3,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.input.apply(orig)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+	if _, err = (TaskPatch{}).replacing(); err == nil {
+		t.Errorf("replacing a task without a name should fail")
+	}
+}
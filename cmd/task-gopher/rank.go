@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Tasks are ordered by a lexicographic rank, a string of base-36 digits that never ends in '0'.
+// There is always room for a rank between two others, so moving a task only rewrites its own rank.
+
+const rankDigits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// rankBetween returns a rank that sorts after a and before b
+// An empty a means no lower bound and an empty b means no upper bound
+func rankBetween(a, b string) (string, error) {
+	if b != "" && a >= b {
+		return "", fmt.Errorf("cannot rank between %q and %q", a, b)
+	}
+	return rankMidpoint(a, b), nil
+}
+
+func rankMidpoint(a, b string) string {
+	if b != "" {
+		// keep the common prefix, treating a as padded with zeros
+		n := 0
+		for n < len(b) && rankDigitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + rankMidpoint(rankSuffix(a, n), b[n:])
+		}
+	}
+	da := strings.IndexByte(rankDigits, rankDigitAt(a, 0))
+	db := len(rankDigits)
+	if b != "" {
+		db = strings.IndexByte(rankDigits, b[0])
+	}
+	if db-da > 1 {
+		return string(rankDigits[(da+db)/2])
+	}
+	// the first digits are consecutive
+	if len(b) > 1 {
+		return b[:1]
+	}
+	return string(rankDigits[da]) + rankMidpoint(rankSuffix(a, 1), "")
+}
+
+// firstRank is the rank of the first task, it leaves room for many tasks before and after it
+const firstRank = "i0001"
+
+// rankAfter returns a short rank that sorts after a, used to append tasks at the end
+// It increments a as a base-36 number, so appending doesn't make ranks grow longer
+func rankAfter(a string) string {
+	if a == "" {
+		return firstRank
+	}
+	r := []byte(a)
+	for {
+		i := len(r) - 1
+		for ; i >= 0; i-- {
+			d := strings.IndexByte(rankDigits, r[i])
+			if d < len(rankDigits)-1 {
+				r[i] = rankDigits[d+1]
+				break
+			}
+			r[i] = rankDigits[0]
+		}
+		if i < 0 {
+			// every digit was the largest one
+			return a + rankMidpoint("", "")
+		}
+		if r[len(r)-1] != rankDigits[0] {
+			return string(r)
+		}
+	}
+}
+
+func rankDigitAt(r string, i int) byte {
+	if i < len(r) {
+		return r[i]
+	}
+	return rankDigits[0]
+}
+
+func rankSuffix(r string, i int) string {
+	if i < len(r) {
+		return r[i:]
+	}
+	return ""
+}
+
+// lastRank returns the rank of the last task, or "" if there are no tasks
+func lastRank(db queryer) (string, error) {
+	var rank sql.NullString
+	err := db.QueryRow(`SELECT MAX(rank) FROM tasks;`).Scan(&rank)
+	return rank.String, err
+}
+
+// getRank returns the rank of the task with a given id
+func getRank(db queryer, id int64) (string, error) {
+	var rank string
+	err := db.QueryRow(`SELECT rank FROM tasks WHERE id = ?;`, id).Scan(&rank)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("task %v not found", id)
+	}
+	return rank, err
+}
+
+// moveTask places a task after the task with id after and before the task with id before
+// Either of them may be 0; if both are, the task is moved to the end. It returns the new rank.
+// It reads the ranks of the neighbours before writing the new one, so concurrent moves run it in a transaction.
+func moveTask(db queryer, id, after, before int64) (string, error) {
+	if _, err := getRank(db, id); err != nil {
+		return "", err
+	}
+	var lower, upper string
+	var err error
+	if after != 0 {
+		if lower, err = getRank(db, after); err != nil {
+			return "", err
+		}
+	}
+	if before != 0 {
+		if upper, err = getRank(db, before); err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case after != 0 && before == 0:
+		// the next task (other than the moved one) is the upper bound
+		var next sql.NullString
+		err = db.QueryRow(`SELECT MIN(rank) FROM tasks WHERE rank > ? AND id != ?;`, lower, id).Scan(&next)
+		upper = next.String
+	case after == 0 && before != 0:
+		// the previous task (other than the moved one) is the lower bound
+		var prev sql.NullString
+		err = db.QueryRow(`SELECT MAX(rank) FROM tasks WHERE rank < ? AND id != ?;`, upper, id).Scan(&prev)
+		lower = prev.String
+	case after == 0 && before == 0:
+		lower, err = lastRank(db)
+	}
+	if err != nil {
+		return "", err
+	}
+	var rank string
+	if upper == "" {
+		rank = rankAfter(lower)
+	} else if rank, err = rankBetween(lower, upper); err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`UPDATE tasks SET rank = ?, version = version + 1 WHERE id = ?;`, rank, id)
+	return rank, err
+}
+
+// backfillRanks gives the tasks without a rank one after the last ranked task, in creation order
+func backfillRanks(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id FROM tasks WHERE rank IS NULL OR rank = '' ORDER BY created ASC;`)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rank, err := lastRank(db)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		rank = rankAfter(rank)
+		if _, err = db.Exec(`UPDATE tasks SET rank = ? WHERE id = ?;`, rank, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
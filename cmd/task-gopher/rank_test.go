@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRankBetween(t *testing.T) {
+	var tests = []struct {
+		a, b string
+	}{
+		{"", ""},
+		{"", "i0001"},
+		{"i0001", ""},
+		{"i0001", "i0002"},
+		{"a", "b"},
+		{"a5", "a6"},
+		{"", "1"},
+		{"", "01"},
+		{"z", ""},
+		{"i000z", "i0011"},
+	}
+	for _, tt := range tests {
+		got, err := rankBetween(tt.a, tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got <= tt.a || (tt.b != "" && got >= tt.b) || got[len(got)-1] == '0' {
+			t.Errorf("rankBetween(%q, %q) = %q", tt.a, tt.b, got)
+		}
+	}
+	if _, err := rankBetween("b", "a"); err == nil {
+		t.Errorf("expected an error for out of order ranks")
+	}
+}
+
+func TestRankBetweenRepeated(t *testing.T) {
+	// keep inserting at the top and right after the first task
+	lower, upper := "", firstRank
+	for i := 0; i < 200; i++ {
+		r, err := rankBetween(lower, upper)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r <= lower || r >= upper {
+			t.Fatalf("rankBetween(%q, %q) = %q", lower, upper, r)
+		}
+		if i%2 == 0 {
+			upper = r
+		} else {
+			lower = r
+		}
+	}
+}
+
+func TestRankAfter(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  string
+	}{
+		{"", firstRank},
+		{"i0001", "i0002"},
+		{"i000z", "i0011"},
+		{"z", "zi"},
+		{"zz", "zzi"},
+	}
+	for _, tt := range tests {
+		if got := rankAfter(tt.input); got != tt.want {
+			t.Errorf("rankAfter(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+// taskIDs returns the IDs of all tasks in board order
+func taskIDs(t *testing.T, db *sql.DB) []int64 {
+	tasks, err := getTasks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+func TestMoveTask(t *testing.T) {
+	var tests = []struct {
+		name          string
+		id            int64
+		after, before int64
+		want          []int64
+	}{
+		{"move to the top", 3, 0, 1, []int64{3, 1, 2, 4}},
+		{"move between", 4, 1, 2, []int64{1, 4, 2, 3}},
+		{"move after", 1, 2, 0, []int64{2, 1, 3, 4}},
+		{"move to the end", 2, 0, 0, []int64{1, 3, 4, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db = setupTests()
+			defer teardownTests(db)
+			for _, name := range []string{"one", "two", "three", "four"} {
+				if _, err := addTask(db, name, "", todo, generic, "", time.Time{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := moveTask(db, tt.id, tt.after, tt.before); err != nil {
+				t.Fatal(err)
+			}
+			if got := taskIDs(t, db); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackfillRanks(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	for _, name := range []string{"one", "two", "three"} {
+		if _, err := addTask(db, name, "", todo, generic, "", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a database created before tasks had ranks
+	if _, err := db.Exec(`UPDATE tasks SET rank = NULL;`); err != nil {
+		t.Fatal(err)
+	}
+	if err := backfillRanks(db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := taskIDs(t, db), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPlaceTaskConcurrently(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	const moved = 10
+	for i := 0; i < moved+2; i++ {
+		if _, err := addTask(db, "task", "", todo, generic, "", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// all the tasks move right after the first one at once, those that can't wait fail instead of sharing a rank
+	var wg sync.WaitGroup
+	for id := int64(3); id <= moved+2; id++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			placeTask(id, 1, 0)
+		}(id)
+	}
+	wg.Wait()
+	var duplicates int
+	if err := db.QueryRow(`SELECT COUNT(*) - COUNT(DISTINCT rank) FROM tasks;`).Scan(&duplicates); err != nil {
+		t.Fatal(err)
+	}
+	if duplicates != 0 {
+		t.Errorf("got %v tasks sharing a rank", duplicates)
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,21 +20,69 @@ import (
 
 var db *sql.DB
 var (
-	upgrader = websocket.Upgrader{}
+	upgrader = websocket.Upgrader{Subprotocols: []string{eventsProtocol}}
 )
-var clients = make(map[*websocket.Conn]bool)
 
-// serve starts an echo server
+// A wsClient is the client of a websocket connection of /ws
+type wsClient struct {
+	id       string // the client ID, which isn't told about its own changes, see changeOrigin
+	addr     string // the address of the client
+	who      string // the device or token of the connection, see requester
+	name     string // the name of the device or token, for its rate
+	scope    string // the scope of the device or token, the requests of the client are limited to
+	protocol string // eventsProtocol, or "" for the clients told "UPDATE"
+}
+
+// serve starts an echo server, over HTTPS if it is given a certificate and its key
+// With mtls, every client needs a device certificate issued by the CA of the server.
+// With a grpcPort, the gRPC API is served on it too, see serveGRPC.
 // It opens the SQLite database and sets up the accepted routes
-func serve(port string) {
+func serve(port, grpcPort, certFile, keyFile string, mtls bool) {
 	// create or open the database
 	db = createDB()
 	defer db.Close()
 	// log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	// create the server
+	e := newServer()
+
+	// Goroutine for checking new day start
+	go checkDayStart(db)
+
+	// start on port
+	var cfg *tls.Config
+	if certFile != "" {
+		var err error
+		cfg, err = serverTLSConfig(certFile, keyFile, mtls)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fp, err := certificateFingerprint(certFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the clients ask to compare it with this one on first use, see verifyServer
+		log.Println("Serving over TLS, the key fingerprint of the certificate is", fp)
+	}
+	if grpcPort != "" {
+		go func() {
+			log.Fatal(serveGRPC(grpcPort, cfg))
+		}()
+	}
+	if cfg != nil {
+		e.Logger.Fatal(e.StartServer(&http.Server{Addr: ":" + port, TLSConfig: cfg}))
+	}
+	e.Logger.Fatal(e.Start(":" + port))
+}
+
+// newServer returns an echo server with the middleware and the routes of the API
+// Every route must be documented in openapi.json.
+func newServer() *echo.Echo {
 	e := echo.New()
 	// e.Pre(middleware.HTTPSRedirect())
+	e.HTTPErrorHandler = handleHTTPError
+	// the rates are limited by the address of the connection, which the clients can't forge like X-Forwarded-For
+	e.IPExtractor = echo.ExtractIPDirect()
 
 	// set up middleware
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
@@ -40,304 +91,800 @@ func serve(port string) {
 		LogRemoteIP: true,
 		LogHost:     true,
 		LogMethod:   true,
+		HandleError: true, // log the status of the error responses
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
-			log.Printf("%v %v. Status: %v\n", v.Method, v.URI, v.Status)
+			log.Printf("%v %v by %v. Status: %v\n", v.Method, redactToken(v.URI), requester(c), v.Status)
 			return nil
 		},
 	}))
 	e.Use(middleware.Recover())
 	e.Use(middleware.Secure())
+	e.Use(limitClients(clientLimiter))
+	e.Use(limitBody())
+	e.Use(checkClientID)
+
+	// the routes that need a device or a token are then limited to its rate
+	limit := limitTokens(tokenLimiter)
+	auth := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return authenticate(limit(next))
+	}
 
-	// set up routes
-	e.GET("/tasks", handleGetTasks)
-	e.GET("/tasks/:id", handleGetTask)
-	e.POST("/tasks/add", handleAddTask)
-	e.PUT("/tasks/:id", handleUpdateTask)
-	e.DELETE("/tasks/:id", handleDeleteTask)
-	e.GET("/ws", handleWebsocket)
-
-	// Goroutine for checking new day start
-	go checkDayStart(db)
+	// set up routes, under the version of the API and at the root as deprecated aliases from before it was versioned
+	e.GET("/", handleWebApp)
+	e.GET("/api", handleGetAPIVersions)
+	addRoutes(e.Group(apiPrefix), auth)
+	addRoutes(e.Group(""), auth, deprecated)
 
-	// start on port
-	e.Logger.Fatal(e.Start(":" + port))
+	return e
 }
 
-// getJSONRawBody returns the body of a request c in JSON format
-func getJSONRawBody(c echo.Context) (map[string]interface{}, error) {
+// addRoutes adds the routes of the API to a group, with some middleware
+// All the routes need a device certificate or an API token, checked by the auth middleware, except for the documentation.
+func addRoutes(g *echo.Group, authMiddleware echo.MiddlewareFunc, m ...echo.MiddlewareFunc) {
+	auth := append(m[:len(m):len(m)], authMiddleware)
+	g.GET("/tasks", handleGetTasks, auth...)
+	g.GET("/tasks/:id", handleGetTask, auth...)
+	g.POST("/tasks/add", handleAddTask, auth...)
+	g.PUT("/tasks/:id", handleReplaceTask, auth...)
+	g.PATCH("/tasks/:id", handlePatchTask, auth...)
+	g.DELETE("/tasks/:id", handleDeleteTask, auth...)
+	g.POST("/tasks/:id/move", handleMoveTask, auth...)
+	g.POST("/tasks/bulk", handleBulkTasks, auth...)
+	g.GET("/workflow", handleGetWorkflow, auth...)
+	g.GET("/fields", handleGetFields, auth...)
+	g.POST("/fields", handleAddField, auth...)
+	g.DELETE("/fields/:name", handleDeleteField, auth...)
+	g.GET("/templates", handleGetTemplates, auth...)
+	g.GET("/templates/:name", handleGetTemplate, auth...)
+	g.PUT("/templates/:name", handleSaveTemplate, auth...)
+	g.DELETE("/templates/:name", handleDeleteTemplate, auth...)
+	g.POST("/templates/:name/apply", handleApplyTemplate, auth...)
+	g.GET("/views", handleGetViews, auth...)
+	g.GET("/views/:name", handleGetView, auth...)
+	g.PUT("/views/:name", handleSaveView, auth...)
+	g.DELETE("/views/:name", handleDeleteView, auth...)
+	g.GET("/ws", handleWebsocket, auth...)
+	g.GET("/token", handleGetToken, auth...)
+	g.GET("/device", handleGetDevice, auth...)
+	g.GET("/graphql", handleGraphQL, auth...)
+	g.POST("/graphql", handleGraphQL, auth...)
+	g.GET("/openapi.json", handleOpenAPI, m...)
+	g.GET("/docs", handleDocs, m...)
+}
 
-	jsonBody := make(map[string]interface{})
-	err := json.NewDecoder(c.Request().Body).Decode(&jsonBody)
-	if err != nil {
-		return nil, err
+// getBodyFields returns the user-defined field values in the "Fields" object of a request body
+// The values are strings or numbers, null clears a field.
+func getBodyFields(raw interface{}) (map[string]string, error) {
+	if raw == nil {
+		return nil, nil
 	}
-
-	return jsonBody, nil
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, &fieldError{"Fields", fmt.Errorf("Fields must be an object")}
+	}
+	fields := make(map[string]string, len(obj))
+	for name, value := range obj {
+		switch v := value.(type) {
+		case string:
+			fields[name] = v
+		case float64:
+			fields[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+			fields[name] = ""
+		default:
+			return nil, &fieldError{"Fields." + name, fmt.Errorf("field %q must be a string or a number", name)}
+		}
+	}
+	return fields, nil
 }
 
 // handleWebsocket handles the WebSocket connection.
+// The clients asking for eventsProtocol get the changes as JSON events, the others the text message "UPDATE".
+// Both can send requests, see wsRequest. The connection is registered with the hub, which queues the messages
+// to send, and is dropped if the client doesn't answer the pings of the server in time.
 func handleWebsocket(c echo.Context) error {
+	if err := checkWebsocketLimits(requester(c)); err != nil {
+		return err
+	}
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
-	// remove connection from list of connections and close it when done
-	defer func() {
-		delete(clients, ws)
-		ws.Close()
-	}()
+	ws.SetReadLimit(limits.MaxWebsocketMessageSize)
 
-	err = manageConnections(ws) // keep list of connections
-	if err != nil {
-		c.Logger().Error(err)
+	client := wsClient{id: clientID(c), addr: ws.RemoteAddr().String(), who: requester(c), protocol: ws.Subprotocol()}
+	if client.id == "" {
+		// the client learns it from the connected event
+		client.id = newClientID()
+	}
+	if d, ok := c.Get("device").(Device); ok {
+		client.name, client.scope = d.Name, d.Scope
+	} else if t, ok := c.Get("token").(Token); ok {
+		client.name, client.scope = t.Name, t.Scope
+	}
+	log.Println("WS connection from", client.addr, "by", client.who)
+	conn := newWSConn(ws, client)
+	if err := hub.add(conn); err != nil {
+		// other connections took the last places since checkWebsocketLimits
+		closeWebsocket(ws, websocket.CloseTryAgainLater, toAPIError(err).Message)
+		ws.Close()
+		return nil
 	}
+	// remove connection from the hub when done, which closes it
+	defer hub.remove(conn)
+	go conn.writePump(wsWriteWait, wsPingInterval)
 
 	// Write hello message
-	err = ws.WriteMessage(websocket.TextMessage, []byte("Websocket connected!"))
-	if err != nil {
-		c.Logger().Error(err)
+	hello := []byte("Websocket connected!")
+	if client.protocol == eventsProtocol {
+		hello, _ = json.Marshal(connected(client.id))
 	}
-
+	conn.enqueue(hello)
+
+	// every message or pong shows the client is still there
+	pongWait := wsPongWait
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
 	for {
 		// Read message
 		_, msg, err := ws.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Println("handleWebsocket: Client websocket disconnected")
-				log.Printf("error: %v", err)
-				return nil
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("handleWebsocket: Client websocket disconnected:", err)
 			}
+			return nil
 		}
+		ws.SetReadDeadline(time.Now().Add(pongWait))
 		if string(msg) == "" || string(msg) == " " {
 			log.Println("handleWebsocket: Client websocket sent empty message, exiting.")
 			return nil
 		}
-		err = handleMessage(ws, msg) // handle message
+		err = handleMessage(conn, msg) // handle message
 		if err != nil {
 			c.Logger().Error(err)
+			return nil
 		}
 	}
 }
 
-func sendUpdateSockets(ip string) {
-	// Notify all clients that a change was made
-	var update_msg = "UPDATE"
-	for client := range clients {
-		// Don't update the client that sent the message
-		//TODO what if there are two clients with the same IP? e.g. web and desktop
-		if strings.Split(client.RemoteAddr().String(), ":")[0] == strings.Split(ip, ":")[0] {
-			continue
-		}
-
-		if client.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(10*time.Second)) != nil {
-			log.Println("sendUpdateSockets: Client websocket disconnected")
-			delete(clients, client)
-			client.Close()
-		}
-
-		err := client.WriteMessage(websocket.TextMessage, []byte(update_msg))
+// sendMu keeps the IDs of the events in the order they are sent
+var sendMu sync.Mutex
+
+// sendUpdateSockets tells the websocket clients about the events of a change, except the one it comes from
+// The clients of eventsProtocol get each event, tagged with the client ID of the origin, the others a single "UPDATE",
+// see wsHub.
+func sendUpdateSockets(origin changeOrigin, events []Event) {
+	sendMu.Lock()
+	defer sendMu.Unlock()
+	var eventMsgs [][]byte
+	for _, event := range events {
+		event.ID = lastEventID.Add(1)
+		event.ClientID = origin.clientID
+		msg, err := json.Marshal(event)
 		if err != nil {
-			log.Println(err)
+			log.Println("sendUpdateSockets:", err)
+			return
 		}
+		eventMsgs = append(eventMsgs, msg)
 	}
+	hub.send(origin, eventMsgs)
 }
 
 // handleMessage handles an incoming (through websocket) message
-func handleMessage(ws *websocket.Conn, msg []byte) error {
-
-	// ping connection, close if no response
-	if ws.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(10*time.Second)) != nil {
-		log.Println("handleMessage: Client websocket disconnected")
-		return nil
-		// delete(clients, ws)
-		// ws.Close()
-	}
-
-	log.Printf("Received message from socket: %s\n", msg)
-
-	// Unmarshal JSON
-	var result map[string]interface{}
-	jsonString := string(msg)
-	err := json.Unmarshal([]byte(jsonString), &result)
-
+// It is a request of the client, which is answered on the websocket, see answerRequest.
+func handleMessage(conn *wsConn, msg []byte) error {
+	res, err := json.Marshal(answerRequest(conn.client, msg))
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	if !conn.enqueue(res) {
+		return fmt.Errorf("handleMessage: the queue of %v is full, dropping it", conn.client.who)
 	}
+	return nil
+}
 
-	log.Println(jsonString)
-	// for key, value := range result {
-	// 	log.Println(key, ":", value)
-	// }
-	// if result["action"] == "update" {
-	// 	return nil
-	// }
+// checkWebsocketLimits refuses a new websocket connection when the server or the client has too many
+// The connections of the GraphQL subscriptions are in the hub too. It answers with an HTTP error before the upgrade,
+// the hub checks the limits again when it adds the connection.
+func checkWebsocketLimits(who string) error {
+	return websocketLimitError(hub.connections(who))
+}
 
+// websocketLimitError returns the error for one more websocket connection, given the number of connections and those of the client
+func websocketLimitError(conns, mine int) error {
+	if conns >= limits.MaxWebsockets {
+		return newAPIError(http.StatusServiceUnavailable, codeRateLimited, "The server has too many websocket connections")
+	}
+	if mine >= limits.MaxWebsocketsPerClient {
+		return newAPIError(http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("Too many websocket connections, at most %v are allowed", limits.MaxWebsocketsPerClient))
+	}
 	return nil
 }
 
-// manageConnections manages the list of websocket connections
-func manageConnections(ws *websocket.Conn) error {
-	log.Println("WS connection from", ws.RemoteAddr().String())
-	clients[ws] = true
-	return nil
+// paramID returns the task id in the path of a request
+func paramID(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: "Invalid task id " + strconv.Quote(c.Param("id")), Field: "id"}
+	}
+	return id, nil
 }
 
-// handleGetTasks fetches all tasks from the database and returns them in JSON form in the response
+// handleGetTasks fetches a page of the tasks matching the q filter, or all tasks, and returns them in JSON form in the response
+// The page is set by the limit and cursor parameters, the order by sort and the fields of the tasks by fields.
+// The cursor of the next page, if any, is returned in the X-Next-Cursor and Link headers.
 func handleGetTasks(c echo.Context) error {
 	// log.Println(c.Request().RemoteAddr+":", c.Request().Method, c.Request().RequestURI)
-	tasks, err := getTasks(db)
+	var q = TaskQuery{
+		Filter: c.QueryParam("q"),
+		Sort:   c.QueryParam("sort"),
+		Limit:  defaultPageSize,
+		Cursor: c.QueryParam("cursor"),
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return &APIError{Status: http.StatusBadRequest, Code: codeInvalidQuery, Message: "Invalid limit " + limit, Field: "limit"}
+		}
+	}
+	tasks, next, err := getTaskPage(db, q)
 	if err != nil {
 		return err
 	}
+	if next != "" {
+		u := *c.Request().URL
+		params := u.Query()
+		params.Set("cursor", next)
+		u.RawQuery = params.Encode()
+		c.Response().Header().Set("X-Next-Cursor", next)
+		c.Response().Header().Add("Link", "<"+u.RequestURI()+`>; rel="next"`)
+	}
+	if fields := c.QueryParam("fields"); fields != "" {
+		defs, err := getFields(db)
+		if err != nil {
+			return internalError("Could not fetch fields", err)
+		}
+		selected, err := selectFields(tasks, fields, defs)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, selected)
+	}
 	return c.JSON(http.StatusOK, tasks)
 }
 
 // handleGetTasks fetches a task from the database by ID and returns it in JSON form in the response
 func handleGetTask(c echo.Context) error {
 	// log.Println(c.Request().RemoteAddr+":", c.Request().Method, c.Request().RequestURI)
-	idStr := c.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	id, err := paramID(c)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "Invalid task id")
+		return err
 	}
-	tasks, err := getTask(db, id)
+	tasks, err := fetchTask(id)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Could not fetch task "+fmt.Sprint(id))
+		return err
+	}
+	etag := formatETag(tasks.Version)
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
 	}
 	return c.JSON(http.StatusOK, tasks)
 }
 
+// fetchTask returns a task by ID, or the error response if it can't
+func fetchTask(id int64) (Task, error) {
+	task, err := getTask(db, id)
+	if err == sql.ErrNoRows {
+		return Task{}, notFound("No task with id " + fmt.Sprint(id))
+	}
+	if err != nil {
+		return Task{}, internalError("Could not fetch task "+fmt.Sprint(id), err)
+	}
+	return task, nil
+}
+
 // handleDeleteTask deletes a task from the database and returns its id
 func handleDeleteTask(c echo.Context) error {
 	// log.Println(c.Request().RemoteAddr+":", c.Request().Method, c.Request().RequestURI)
-	idStr := c.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	id, err := paramID(c)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "Invalid task id")
+		return err
 	}
-	err = delTask(db, int64(id))
+	task, err := removeTask(id)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Could not delete task "+fmt.Sprint(id))
+		return err
 	}
-	go sendUpdateSockets(c.Request().RemoteAddr)
+	notifyChange(requestOrigin(c), taskDeleted(task))
 	return c.String(http.StatusOK, fmt.Sprint(id))
 }
 
+// removeTask deletes a task by ID and returns it, it is shared by the APIs of the server
+func removeTask(id int64) (Task, error) {
+	task, err := fetchTask(id)
+	if err != nil {
+		return Task{}, err
+	}
+	if err = delTask(db, id); err != nil {
+		return Task{}, internalError("Could not delete task "+fmt.Sprint(id), err)
+	}
+	return task, nil
+}
+
 // handleAddTask adds a task to the database
-// It gets the task data from the request body in JSON form
+// It gets the task data from the request body in JSON form, see NewTask
 func handleAddTask(c echo.Context) error {
 	// log.Println(c.Request().RemoteAddr+":", c.Request().Method, c.Request().RequestURI)
-	body, err := getJSONRawBody(c)
+	var req NewTask
+	if err := decodeBody(c, &req); err != nil {
+		return err
+	}
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+	task, err := createTask(req, force)
+	if err != nil {
+		return err
+	}
+	notifyChange(requestOrigin(c), taskCreated(task))
+	return c.JSON(http.StatusOK, task)
+}
 
+// createTask validates a new task and adds it, it is shared by the APIs of the server
+// The work-in-progress limit of its status is checked, unless forced.
+func createTask(req NewTask, force bool) (Task, error) {
+	task, err := req.task(time.Now())
 	if err != nil {
-		fmt.Println(err)
-		return c.String(http.StatusBadRequest, "You must provide a request body")
+		return Task{}, err
 	}
+	if task.Fields, err = validateFields(db, task.Fields); err != nil {
+		return Task{}, err
+	}
+
+	// create task, with its fields and due date or not at all,
+	// after checking the work-in-progress limits of the status in the same transaction, unless forced
+	var id int64
+	err = withTx(db, func(tx *sql.Tx) error {
+		if !force {
+			if err := checkStoredWIPLimit(tx, task, nil); err != nil {
+				return err
+			}
+		}
+		if id, err = addTask(tx, task.Name, task.Desc, task.Status, task.Type, task.Tag, task.Due); err != nil {
+			return err
+		}
+		return setTaskFields(tx, id, task.Fields)
+	})
+	var wipErr *wipLimitError
+	if errors.As(err, &wipErr) {
+		return Task{}, err
+	}
+	if err != nil {
+		return Task{}, internalError("Could not create task", err)
+	}
+	return fetchTask(id)
+}
+
+// handleReplaceTask replaces a task in the database by its id
+// The id is given in the request parameters and the task in the request body; the values it doesn't have are cleared
+func handleReplaceTask(c echo.Context) error {
+	return updateTaskFromRequest(c, true)
+}
 
-	// get task details from JSON
-	name := body["Name"].(string)
-	desc := body["Desc"].(string)
-	tag := body["Tag"].(string)
-	completed := body["Status"].(string)
-	type_s := body["Type"].(string)
+// handlePatchTask changes some values of a task in the database by its id
+// The id is given in the request parameters and the changes in the request body, as a JSON Merge Patch (RFC 7386):
+// absent values are left unchanged and null clears a value
+func handlePatchTask(c echo.Context) error {
+	return updateTaskFromRequest(c, false)
+}
 
-	var status status
-	switch completed {
-	case todo.String():
-		status = todo
-	case inProgress.String():
-		status = inProgress
-	case done.String():
-		status = done
-	default:
-		status = invalidStatus
+// updateTaskFromRequest applies the patch in the body of a request, or replaces the task with the body
+// An If-Match header makes sure the task didn't change since its client got it.
+func updateTaskFromRequest(c echo.Context, replace bool) error {
+	// log.Println(c.Request().RemoteAddr+":", c.Request().Method, c.Request().RequestURI)
+	var body map[string]interface{}
+	if err := decodeBody(c, &body); err != nil {
+		return err
+	}
+	id, err := paramID(c)
+	if err != nil {
+		return err
 	}
 
-	var type_t task_type
-	switch type_s {
-	case generic.String():
-		type_t = generic
-	case daily.String():
-		type_t = daily
-	case habit.String():
-		type_t = habit
-	default:
-		type_t = invalidType
+	// the version the update is based on, if any
+	var version int64
+	if ifMatch := c.Request().Header.Get("If-Match"); ifMatch != "" {
+		version, err = parseETag(ifMatch)
+		if err != nil {
+			return &APIError{Status: http.StatusBadRequest, Code: codeInvalidRequest, Message: err.Error(), Field: "If-Match"}
+		}
+	} else if requireIfMatch {
+		return newAPIError(http.StatusPreconditionRequired, codePreconditionRequired, "If-Match is required, get the task for its ETag")
 	}
 
-	if name == "" {
-		return c.String(http.StatusBadRequest, "You must provide a task name")
+	patch, err := parseTaskPatch(body, time.Now())
+	if err == nil && replace {
+		patch, err = patch.replacing()
+	}
+	if err != nil {
+		return err
 	}
 
-	// create task
-	id, err := addTask(db, name, desc, status, type_t, tag)
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+	updated, changed, err := changeTask(id, version, patch, force)
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		return versionConflict(c, conflict.Current)
+	}
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Could not create task")
+		return err
 	}
+	notifyChange(requestOrigin(c), taskUpdated(updated, changed))
+	c.Response().Header().Set("ETag", formatETag(updated.Version))
+	return c.JSON(http.StatusOK, updated)
+}
 
-	// get the task
-	task, err := getTask(db, id)
+// changeTask applies a patch to a task and returns it with the names of the values that changed, see changedValues
+// It is shared by the APIs of the server.
+// Unless version is 0, the task must still be at that version, or a *conflictError with the current task is returned.
+// The work-in-progress limit of the status the task ends up in is checked, unless forced.
+func changeTask(id, version int64, patch TaskPatch, force bool) (Task, []string, error) {
+	var err error
+	patch.Fields, err = validateFields(db, patch.Fields)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Could not create task")
+		return Task{}, nil, err
 	}
-	go sendUpdateSockets(c.Request().RemoteAddr)
+
+	orig, err := fetchTask(id)
+	if err != nil {
+		return Task{}, nil, err
+	}
+	if version != 0 && version != orig.Version {
+		return Task{}, nil, &conflictError{orig}
+	}
+
+	// check that the workflow allows the status change
+	if patch.Status != nil && *patch.Status != orig.Status && !workflow.canTransition(orig.Status, *patch.Status) {
+		return Task{}, nil, &transitionError{orig, orig.Status, *patch.Status}
+	}
+
+	// update task, as long as nobody changed it since it was read, along with its fields,
+	// after checking the work-in-progress limits of the status it ends up in in the same transaction, unless forced
+	var updated Task
+	err = withTx(db, func(tx *sql.Tx) error {
+		if !force {
+			if err := checkStoredWIPLimit(tx, patch.apply(orig), &orig); err != nil {
+				return err
+			}
+		}
+		updated, err = updateTask(tx, id, orig.Version, patch)
+		return err
+	})
+	var wipErr *wipLimitError
+	if errors.As(err, &wipErr) {
+		return Task{}, nil, err
+	}
+	if err == errVersionConflict {
+		current, err := fetchTask(id)
+		if err != nil {
+			return Task{}, nil, err
+		}
+		return Task{}, nil, &conflictError{current}
+	}
+	if err != nil {
+		return Task{}, nil, internalError("Could not update task", err)
+	}
+	return updated, changedValues(orig, updated), nil
+}
+
+// versionConflict responds to an update based on an old version of a task with the current one
+func versionConflict(c echo.Context, current Task) error {
+	c.Response().Header().Set("ETag", formatETag(current.Version))
+	return c.JSON(http.StatusConflict, errorResponse{
+		Error:   toAPIError(&conflictError{current}),
+		Current: &current,
+	})
+}
+
+// handleGetWorkflow returns the configured workflow statuses in board order
+func handleGetWorkflow(c echo.Context) error {
+	return c.JSON(http.StatusOK, workflow)
+}
+
+// handleGetFields returns all the user-defined field definitions
+func handleGetFields(c echo.Context) error {
+	defs, err := getFields(db)
+	if err != nil {
+		return internalError("Could not fetch fields", err)
+	}
+	var list = []FieldDef{}
+	for _, def := range defs {
+		list = append(list, def)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return c.JSON(http.StatusOK, list)
+}
+
+// handleAddField creates or replaces a user-defined field definition
+// The definition is given in the request body in JSON form
+func handleAddField(c echo.Context) error {
+	var def FieldDef
+	err := decodeBody(c, &def)
+	if err != nil {
+		return err
+	}
+	if def.Type, err = parseFieldType(string(def.Type)); err != nil {
+		return &fieldError{"Type", err}
+	}
+	if err = def.validate(); err != nil {
+		return err
+	}
+	if err = addField(db, def); err != nil {
+		return internalError("Could not create field", err)
+	}
+	notifyChange(requestOrigin(c), fieldsChanged(def.Name))
+	return c.JSON(http.StatusOK, def)
+}
+
+// handleDeleteField deletes a user-defined field definition and its values by name
+func handleDeleteField(c echo.Context) error {
+	name := c.Param("name")
+	if err := delField(db, name); err != nil {
+		return internalError("Could not delete field "+name, err)
+	}
+	notifyChange(requestOrigin(c), fieldsChanged(name))
+	return c.String(http.StatusOK, name)
+}
+
+// handleMoveTask changes the position of a task on the board
+// The request body gives the IDs of the tasks it should be placed after and before, either can be omitted
+func handleMoveTask(c echo.Context) error {
+	id, err := paramID(c)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		After  int64 // the task to place the moved task after
+		Before int64 // the task to place the moved task before
+	}
+	err = decodeBody(c, &body)
+	if err != nil {
+		return err
+	}
+	task, err := placeTask(id, body.After, body.Before)
+	if err != nil {
+		return err
+	}
+	notifyChange(requestOrigin(c), taskUpdated(task, []string{"Rank"}))
 	return c.JSON(http.StatusOK, task)
 }
 
-// handleUpdateTask updates a task in the database by its id
-// The id is given in the request parameters and the changed values are given in the request body
-func handleUpdateTask(c echo.Context) error {
-	// log.Println(c.Request().RemoteAddr+":", c.Request().Method, c.Request().RequestURI)
-	body, err := getJSONRawBody(c)
+// placeTask moves a task between two others on the board, it is shared by the APIs of the server
+// Either can be 0, to move the task to the start or the end.
+func placeTask(id, after, before int64) (Task, error) {
+	if after == id || before == id {
+		return Task{}, newAPIError(http.StatusUnprocessableEntity, codeInvalidValue, "A task cannot be moved relative to itself")
+	}
+	if _, err := fetchTask(id); err != nil {
+		return Task{}, err
+	}
+	for _, other := range []struct {
+		key string
+		id  int64
+	}{{"After", after}, {"Before", before}} {
+		if _, err := getTask(db, other.id); other.id != 0 && err == sql.ErrNoRows {
+			return Task{}, &fieldError{other.key, fmt.Errorf("No task with id %v", other.id)}
+		}
+	}
+	// the ranks of the neighbours can't change before the new rank is written
+	err := withTx(db, func(tx *sql.Tx) error {
+		_, err := moveTask(tx, id, after, before)
+		return err
+	})
+	if err != nil {
+		return Task{}, newAPIError(http.StatusUnprocessableEntity, codeInvalidValue, "Could not move task "+fmt.Sprint(id)+": "+err.Error())
+	}
+	return fetchTask(id)
+}
 
+// handleGetTemplates returns all the task templates
+func handleGetTemplates(c echo.Context) error {
+	templates, err := getTemplates(db)
 	if err != nil {
-		fmt.Println(err)
-		return c.String(http.StatusBadRequest, "You must provide a request body")
+		return internalError("Could not fetch templates", err)
+	}
+	return c.JSON(http.StatusOK, templates)
+}
+
+// handleGetTemplate returns a task template by name
+func handleGetTemplate(c echo.Context) error {
+	name := c.Param("name")
+	tmpl, err := getTemplate(db, name)
+	if err == sql.ErrNoRows {
+		return notFound("No template named " + name)
 	}
-	idStr := c.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		fmt.Println(err)
-		return c.String(http.StatusBadRequest, "Invalid task id")
+		return internalError("Could not fetch template "+name, err)
 	}
+	return c.JSON(http.StatusOK, tmpl)
+}
 
-	// get task details from JSON
-	name := body["Name"].(string)
-	desc := body["Desc"].(string)
-	tag := body["Tag"].(string)
-	completed := body["Status"].(string)
-	type_s := body["Type"].(string)
+// handleSaveTemplate creates or replaces a task template
+// The name is given in the request parameters and the template in the request body
+func handleSaveTemplate(c echo.Context) error {
+	var tmpl Template
+	err := decodeBody(c, &tmpl)
+	if err != nil {
+		return err
+	}
+	tmpl.Name = c.Param("name")
+	if err = tmpl.validate(); err != nil {
+		return err
+	}
+	if err = saveTemplate(db, tmpl); err != nil {
+		return internalError("Could not save template "+tmpl.Name, err)
+	}
+	return c.JSON(http.StatusOK, tmpl)
+}
+
+// handleDeleteTemplate deletes a task template by name
+func handleDeleteTemplate(c echo.Context) error {
+	name := c.Param("name")
+	err := delTemplate(db, name)
+	if err == sql.ErrNoRows {
+		return notFound("No template named " + name)
+	}
+	if err != nil {
+		return internalError("Could not delete template "+name, err)
+	}
+	return c.String(http.StatusOK, name)
+}
 
-	var status status
-	switch completed {
-	case todo.String():
-		status = todo
-	case inProgress.String():
-		status = inProgress
-	case done.String():
-		status = done
-	default:
-		status = invalidStatus
+// handleGetViews returns all the saved views
+func handleGetViews(c echo.Context) error {
+	views, err := getViews(db)
+	if err != nil {
+		return internalError("Could not fetch views", err)
 	}
+	return c.JSON(http.StatusOK, views)
+}
 
-	var type_t task_type
-	switch type_s {
-	case generic.String():
-		type_t = generic
-	case daily.String():
-		type_t = daily
-	case habit.String():
-		type_t = habit
-	default:
-		type_t = invalidType
+// handleGetView returns a saved view by name
+func handleGetView(c echo.Context) error {
+	name := c.Param("name")
+	v, err := getView(db, name)
+	if err == sql.ErrNoRows {
+		return notFound("No view named " + name)
+	}
+	if err != nil {
+		return internalError("Could not fetch view "+name, err)
 	}
+	return c.JSON(http.StatusOK, v)
+}
 
-	// update task
-	newTask := Task{int64(id), name, desc, status, type_t, time.Now(), tag}
-	err = editTask(db, newTask)
+// handleSaveView creates or replaces a view
+// The name is given in the request parameters and the view in the request body
+func handleSaveView(c echo.Context) error {
+	var v View
+	err := decodeBody(c, &v)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, "Could not update task")
+		return err
+	}
+	v.Name = c.Param("name")
+	defs, err := getFields(db)
+	if err != nil {
+		return internalError("Could not fetch fields", err)
 	}
-	go sendUpdateSockets(c.Request().RemoteAddr)
-	return c.NoContent(http.StatusOK)
+	if err = v.validate(defs); err != nil {
+		return err
+	}
+	if err = saveView(db, v); err != nil {
+		return internalError("Could not save view "+v.Name, err)
+	}
+	return c.JSON(http.StatusOK, v)
+}
+
+// handleDeleteView deletes a view by name
+func handleDeleteView(c echo.Context) error {
+	name := c.Param("name")
+	err := delView(db, name)
+	if err == sql.ErrNoRows {
+		return notFound("No view named " + name)
+	}
+	if err != nil {
+		return internalError("Could not delete view "+name, err)
+	}
+	return c.String(http.StatusOK, name)
+}
+
+// handleApplyTemplate creates the tasks of a template and returns them
+// The values of the template variables are given in the request body
+func handleApplyTemplate(c echo.Context) error {
+	name := c.Param("name")
+	var body struct {
+		Vars map[string]string // values of the {{var}} placeholders
+	}
+	err := decodeBody(c, &body)
+	if err != nil {
+		return err
+	}
+	tmpl, err := getTemplate(db, name)
+	if err == sql.ErrNoRows {
+		return notFound("No template named " + name)
+	}
+	if err != nil {
+		return internalError("Could not fetch template "+name, err)
+	}
+
+	// check the work-in-progress limits for all the new tasks, unless forced
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+	if !force {
+		newTasks, err := tmpl.instantiate(body.Vars, time.Now())
+		if err != nil {
+			return err
+		}
+		tasks, err := getTasks(db)
+		if err != nil {
+			return internalError("Could not apply template "+name, err)
+		}
+		for i, task := range newTasks {
+			// the new tasks have no ID yet, but need one to be told apart
+			task.ID = -int64(i + 1)
+			if err = checkWIPLimit(tasks, task, nil); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+		}
+	}
+
+	// create all the tasks or none
+	var created []Task
+	err = withTx(db, func(tx *sql.Tx) error {
+		created, err = applyTemplate(tx, tmpl, body.Vars, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var events []Event
+	for _, task := range created {
+		events = append(events, taskCreated(task))
+	}
+	notifyChange(requestOrigin(c), events...)
+	return c.JSON(http.StatusOK, created)
+}
+
+// handleBulkTasks changes or deletes all the tasks matching a filter in one transaction
+// The request is given in the request body as a BulkRequest; the response holds the affected tasks
+func handleBulkTasks(c echo.Context) error {
+	var req BulkRequest
+	err := decodeBody(c, &req)
+	if err != nil {
+		return err
+	}
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+
+	// the matched tasks before the changes, to tell the clients what changed
+	var before, tasks []Task
+	err = withTx(db, func(tx *sql.Tx) error {
+		if !req.DryRun && !req.Delete {
+			if before, err = matchBulk(tx, req); err != nil {
+				return err
+			}
+		}
+		tasks, err = applyBulk(tx, req, force)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if tasks == nil {
+		tasks = []Task{}
+	}
+
+	// a single notification, and event, for all the changes
+	if !req.DryRun && len(tasks) > 0 {
+		notifyChange(requestOrigin(c), tasksBulk(before, tasks, req.Delete))
+	}
+	return c.JSON(http.StatusOK, tasks)
 }
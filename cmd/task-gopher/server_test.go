@@ -1,4 +1,109 @@
 package main
 
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
 //TODO: test that the endpoints (when pointing LOCALLY, using the tmp DB)
 // perform the expected operations
+
+// serveTest sends a request to a handler and returns the response
+func serveTest(method, path, body string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	e := echo.New()
+	e.HTTPErrorHandler = handleHTTPError
+	e.Add(method, "/tasks/:id", handler)
+	e.Add(method, "/tasks/add", handler)
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerErrors(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	if _, err := addTask(db, "test", "", todo, generic, "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		handler   echo.HandlerFunc
+		wantCode  int
+		wantError APIError
+	}{
+		{"no body", http.MethodPost, "/tasks/add", "", handleAddTask,
+			http.StatusBadRequest, APIError{Code: codeInvalidRequest, Message: "You must provide a request body"}},
+		{"not JSON", http.MethodPost, "/tasks/add", "name", handleAddTask,
+			http.StatusBadRequest, APIError{Code: codeInvalidRequest}},
+		{"missing name", http.MethodPost, "/tasks/add", `{"Tag": "x"}`, handleAddTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Field: "Name"}},
+		{"name of the wrong type", http.MethodPost, "/tasks/add", `{"Name": 3}`, handleAddTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Message: "Name must be of type string", Field: "Name"}},
+		{"name too long", http.MethodPost, "/tasks/add", `{"Name": "` + strings.Repeat("a", maxNameLength+1) + `"}`, handleAddTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Field: "Name"}},
+		{"unknown status", http.MethodPost, "/tasks/add", `{"Name": "x", "Status": "later"}`, handleAddTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Field: "Status"}},
+		{"unknown value", http.MethodPost, "/tasks/add", `{"Name": "x", "Owner": "me"}`, handleAddTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Message: `unknown value "Owner"`, Field: "Owner"}},
+		{"invalid due date", http.MethodPatch, "/tasks/1", `{"Due": "someday"}`, handlePatchTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Field: "Due"}},
+		{"unknown field", http.MethodPatch, "/tasks/1", `{"Fields": {"estimate": 3}}`, handlePatchTask,
+			http.StatusUnprocessableEntity, APIError{Code: codeInvalidValue, Field: "Fields.estimate"}},
+		{"invalid id", http.MethodPatch, "/tasks/one", `{}`, handlePatchTask,
+			http.StatusBadRequest, APIError{Code: codeInvalidRequest, Field: "id"}},
+		{"missing task", http.MethodGet, "/tasks/42", "", handleGetTask,
+			http.StatusNotFound, APIError{Code: codeNotFound, Message: "No task with id 42"}},
+		{"stale version", http.MethodPatch, "/tasks/1", `{"Name": "x"}`, func(c echo.Context) error {
+			c.Request().Header.Set("If-Match", formatETag(7))
+			return handlePatchTask(c)
+		}, http.StatusConflict, APIError{Code: codeVersionConflict}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveTest(tt.method, tt.path, tt.body, tt.handler)
+			if rec.Code != tt.wantCode {
+				t.Errorf("got status %v, want %v", rec.Code, tt.wantCode)
+			}
+			var body errorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == nil {
+				t.Fatalf("got body %q, want an error response", rec.Body)
+			}
+			got := *body.Error
+			if tt.wantError.Message == "" {
+				got.Message = ""
+			}
+			if got != tt.wantError {
+				t.Errorf("got error %+v, want %+v", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestHandleAddTask(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	// values that are not given take their defaults
+	rec := serveTest(http.MethodPost, "/tasks/add", `{"Name": "test", "Type": "daily", "Due": "2023-12-01"}`, handleAddTask)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v: %s", rec.Code, rec.Body)
+	}
+	var task Task
+	if err := json.Unmarshal(rec.Body.Bytes(), &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Name != "test" || task.Tag != "" || task.Status != workflow.initial() || task.Type != daily || formatDue(task.Due) != "2023-12-01" {
+		t.Errorf("got %+v", task)
+	}
+}
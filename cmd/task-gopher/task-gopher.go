@@ -12,11 +12,17 @@ Available Commands:
 	completion  Generate the autocompletion script for the specified shell
 	del         Delete a task by its ID
 	deldb       delete all your tasks
+	device      Manage the certificates of the devices, on the server
+	field       Manage user-defined task fields
 	help        Help about any command
-	kanban      Interact with your tasks in a Kanban board
-	list        List all your tasks
+	kanban      Interact with your tasks, or those matching a filter, in a Kanban board
+	list        List all your tasks, or those matching a filter
+	login       Check an API token or a device certificate with the server and use it for every request, asks for the token without TOKEN
 	serve       create and start a server for the DB
+	template    Manage task templates, named sets of tasks that can be created together
+	token       Manage the API tokens of the clients, on the server
 	update      Update an existing task name, description, tag or completion status by its id
+	view        Manage saved views and the context applied to list and kanban
 
 Flags:
 
@@ -31,7 +37,8 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -46,18 +53,27 @@ var projectDir = homeDir + "/go/src/github.com/czonios/task-gopher"
 // var projectDir = "."
 var _ = os.Mkdir(projectDir, os.ModePerm)
 
-// status enum
+// dataDir holds the files of the server, like the database and its TLS certificates
+var dataDir = projectDir + "/data/"
+
+// status of a task, one of the statuses of the configured workflow
 type status int
 
+// statuses of the default workflow
 const (
 	todo status = iota
 	inProgress
 	done
-	invalidStatus
 )
 
+// invalidStatus marks a status that is not set
+const invalidStatus status = -1
+
 func (s status) String() string {
-	return [...]string{"todo", "in progress", "done", "invalid"}[s]
+	if def, ok := workflow.lookup(s); ok {
+		return def.Name
+	}
+	return "invalid"
 }
 
 // task type enum
@@ -74,15 +90,30 @@ func (s task_type) String() string {
 	return [...]string{"generic", "daily", "habit", "invalid"}[s]
 }
 
+// parseTaskType returns the task type named by s
+func parseTaskType(s string) (task_type, error) {
+	for _, t := range []task_type{generic, daily, habit} {
+		if strings.EqualFold(t.String(), s) {
+			return t, nil
+		}
+	}
+	return invalidType, fmt.Errorf("unknown task type %q (expected generic, daily or habit)", s)
+}
+
 // A Task is the representation of a task
 type Task struct {
 	ID      int64     // unique task ID
 	Name    string    // task title
 	Desc    string    // optional description
-	Status  status    // the status, one of {todo, in progress, done}
+	Status  status    // the status, one of the workflow statuses
 	Type    task_type // the type of the task, one of {generic, daily, habit}
 	Created time.Time // timestamp of when the task was created
 	Tag     string    // optional tag for the task
+	Rank    string    // position of the task on the board, see rankBetween
+	Due     time.Time // optional due date, zero if not set
+	Version int64     // incremented on every change of the task, see updateTask
+
+	Fields map[string]string `json:",omitempty"` // user-defined fields, see FieldDef
 }
 
 // implement list.Item & list.DefaultItem
@@ -98,50 +129,19 @@ func (t Task) Description() string {
 	return t.Tag
 }
 
-// implement kancli.Status
-func (s status) Next() int {
-	if s == done {
-		return int(todo)
-	}
-	return int(s + 1)
+// Next returns the status after s in the workflow, wrapping around at the end
+func (s status) Next() status {
+	i := workflow.index(s)
+	return workflow[(i+1)%len(workflow)].ID
 }
 
-func (s status) Prev() int {
-	if s == todo {
-		return int(done)
+// Prev returns the status before s in the workflow, wrapping around at the start
+func (s status) Prev() status {
+	i := workflow.index(s)
+	if i <= 0 {
+		return workflow[len(workflow)-1].ID
 	}
-	return int(s - 1)
-}
-
-func (s status) Int() int {
-	return int(s)
-}
-
-// merge the changed fields to the original task
-func (orig *Task) merge(t Task) {
-	uValues := reflect.ValueOf(&t).Elem()
-	oValues := reflect.ValueOf(orig).Elem()
-	for i := 0; i < uValues.NumField(); i++ {
-		uField := uValues.Field(i).Interface()
-		if oValues.CanSet() {
-			if v, ok := uField.(int64); ok && uField != 0 {
-				oValues.Field(i).SetInt(v)
-			}
-			if v, ok := uField.(string); ok && uField != "" {
-				if uField == " " {
-					v = ""
-				}
-				oValues.Field(i).SetString(v)
-			}
-			if v, ok := uField.(status); ok && uField != invalidStatus {
-				oValues.Field(i).SetInt(int64(v))
-			}
-			if v, ok := uField.(task_type); ok && uField != invalidType {
-				oValues.Field(i).SetInt(int64(v))
-			}
-		}
-	}
-
+	return workflow[i-1].ID
 }
 
 func main() {
@@ -152,10 +152,13 @@ func main() {
 	if port == "" || addr == "" {
 		log.Fatalf("Environment variables not set!")
 	}
+	if err := loadConfig(projectDir + "/config.json"); err != nil {
+		log.Fatal(err)
+	}
 
 	// execute root command
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		printError(err)
 		os.Exit(1)
 	}
 
@@ -179,37 +182,49 @@ func checkDayStart(db *sql.DB) error {
 			fmt.Println("Time to reset dailies!")
 			prevDay = startOfDay
 			// impl new day logic (daily tasks should reset to todo status)
-			err := resetDailyTasks(db)
+			reset, err := resetDailyTasks(db)
 			if err != nil {
 				return err
 			}
-			sendUpdateSockets("")
+			notifyChange(changeOrigin{}, dailiesReset(reset))
 		}
 	}
 	return nil
 }
 
-func resetDailyTasks(db *sql.DB) error {
+// resetDailyTasks sets the daily tasks back to the initial status and returns them
+func resetDailyTasks(db *sql.DB) ([]Task, error) {
 	// Get all tasks with Type daily
 	dailyTasks, err := getTasksByType(db, daily)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Reset the status of each daily task to "todo"
-	for _, task := range dailyTasks {
-		task.Status = todo
-		editTask(db, task)
+	// Reset the status of each daily task to the initial status of the workflow, all of them or none
+	initial := workflow.initial()
+	var reset []Task
+	err = withTx(db, func(tx *sql.Tx) error {
+		for _, task := range dailyTasks {
+			task, err := updateTask(tx, task.ID, 0, TaskPatch{Status: &initial})
+			if err != nil {
+				return err
+			}
+			reset = append(reset, task)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return reset, nil
 }
 
-func getTasksByType(db *sql.DB, taskType task_type) ([]Task, error) {
+func getTasksByType(db queryer, taskType task_type) ([]Task, error) {
 	// get tasks by type
 	rows, err := db.Query(`
-        SELECT id, name, description, status, type, tag, created
+        SELECT id, name, description, status, type, tag, created, rank, due, version
         FROM tasks
 		WHERE type = ?
-        ORDER BY created ASC;
+        ORDER BY rank ASC, created ASC;
     `, taskType)
 	if err != nil {
 		return nil, err
@@ -228,13 +243,36 @@ func getTasksByType(db *sql.DB, taskType task_type) ([]Task, error) {
 	}
 
 	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	err = loadTaskFields(db, tasks)
 	return tasks, err
 }
 
+// A queryer runs SQL statements, it is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// withTx runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 // createDB returns an opened SQLite database that can be used to run queries
 // It creates the directory and the db file, if they don't exist
 func createDB(args ...bool) *sql.DB {
-	var dataDir = projectDir + "/data/"
 	var dbPath = dataDir + dbFname
 	_ = os.Mkdir(dataDir, os.ModePerm)
 
@@ -249,34 +287,122 @@ func createDB(args ...bool) *sql.DB {
 	var db, err = sql.Open("sqlite3", dbPath)
 	handleErr(err)
 
-	if _, err := db.Query("SELECT * FROM tasks"); err == nil {
-		// fmt.Println("Found tasks DB!")
-	} else {
-		sqlStatement := `
-            CREATE TABLE "tasks" (
-                "id" INTEGER NOT NULL PRIMARY KEY,
-                "name" TEXT NOT NULL,
-                "description" TEXT,
-                "status" INTEGER,
-				"type" INTEGER,
-                "created" TEXT,
-                "tag" TEXT
-            );
-            DELETE FROM tasks;
-        `
-		_, err = db.Exec(sqlStatement)
-		handleErr(err)
-	}
+	err = initDB(db)
+	handleErr(err)
 	return db
 }
 
-// addTask inserts a task into the database
-func addTask(db *sql.DB, name string, description string, completed status, t_type task_type, tag string) (int64, error) {
+// initDB creates the tables used by task-gopher, if they don't exist
+func initDB(db *sql.DB) error {
+	sqlStatement := `
+        CREATE TABLE IF NOT EXISTS "tasks" (
+            "id" INTEGER NOT NULL PRIMARY KEY,
+            "name" TEXT NOT NULL,
+            "description" TEXT,
+            "status" INTEGER,
+            "type" INTEGER,
+            "created" TEXT,
+            "tag" TEXT,
+            "rank" TEXT,
+            "due" TEXT,
+            "version" INTEGER NOT NULL DEFAULT 1
+        );
+        CREATE TABLE IF NOT EXISTS "fields" (
+            "name" TEXT NOT NULL PRIMARY KEY,
+            "type" TEXT NOT NULL,
+            "options" TEXT
+        );
+        CREATE TABLE IF NOT EXISTS "task_fields" (
+            "task_id" INTEGER NOT NULL,
+            "name" TEXT NOT NULL,
+            "value" TEXT NOT NULL,
+            PRIMARY KEY ("task_id", "name")
+        );
+        CREATE TABLE IF NOT EXISTS "templates" (
+            "name" TEXT NOT NULL PRIMARY KEY,
+            "description" TEXT,
+            "tasks" TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS "views" (
+            "name" TEXT NOT NULL PRIMARY KEY,
+            "filter" TEXT NOT NULL,
+            "description" TEXT
+        );
+        CREATE TABLE IF NOT EXISTS "tokens" (
+            "name" TEXT NOT NULL PRIMARY KEY,
+            "hash" TEXT NOT NULL UNIQUE,
+            "scope" TEXT NOT NULL,
+            "created" TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS "devices" (
+            "serial" TEXT NOT NULL PRIMARY KEY,
+            "name" TEXT NOT NULL,
+            "scope" TEXT NOT NULL,
+            "created" TEXT NOT NULL,
+            "revoked" TEXT
+        );
+    `
+	_, err := db.Exec(sqlStatement)
+	if err != nil {
+		return err
+	}
+	return migrateDB(db)
+}
+
+// migrateDB adds the columns introduced after a database was created
+func migrateDB(db *sql.DB) error {
+	added, err := addColumn(db, "tasks", "rank", "TEXT")
+	if err != nil {
+		return err
+	}
+	if added {
+		if err = backfillRanks(db); err != nil {
+			return err
+		}
+	}
+	if _, err = addColumn(db, "tasks", "due", "TEXT"); err != nil {
+		return err
+	}
+	_, err = addColumn(db, "tasks", "version", "INTEGER NOT NULL DEFAULT 1")
+	return err
+}
+
+// addColumn adds a column to a table if it doesn't have it, and reports whether it did
+func addColumn(db *sql.DB, table, column, decl string) (bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %v;`, table, column, decl))
+	return err == nil, err
+}
+
+// addTask inserts a task into the database, at version 1 with or without a due date
+func addTask(db queryer, name string, description string, completed status, t_type task_type, tag string, due time.Time) (int64, error) {
+	// new tasks go to the end of the board
+	rank, err := lastRank(db)
+	if err != nil {
+		return 0, err
+	}
 	sqlStatement := `
         INSERT INTO 
-            tasks(id, name, description, status, type, tag, created) 
-            values ((SELECT MAX(id) FROM tasks LIMIT 1) + 1, ?, ?, ?, ?, ?, ?);`
-	res, err := db.Exec(sqlStatement, name, description, completed, t_type, tag, time.Now().Format(time.RFC3339))
+            tasks(id, name, description, status, type, tag, created, rank, due) 
+            values ((SELECT MAX(id) FROM tasks LIMIT 1) + 1, ?, ?, ?, ?, ?, ?, ?, ?);`
+	res, err := db.Exec(sqlStatement, name, description, completed, t_type, tag, time.Now().Format(time.RFC3339), rankAfter(rank), formatDue(due))
 	if err != nil {
 		return 0, err
 	}
@@ -288,49 +414,73 @@ func addTask(db *sql.DB, name string, description string, completed status, t_ty
 }
 
 // delTask deletes a task from the database
-func delTask(db *sql.DB, id int64) error {
-	sqlStatement := `DELETE FROM tasks WHERE id = ?;`
-	_, err := db.Exec(sqlStatement, id)
+func delTask(db queryer, id int64) error {
+	sqlStatement := `
+        DELETE FROM task_fields WHERE task_id = ?;
+        DELETE FROM tasks WHERE id = ?;`
+	_, err := db.Exec(sqlStatement, id, id)
 	if err != nil {
 		return err
 	}
 	return err
 }
 
-// editTask updates an existing task in the database
-func editTask(db *sql.DB, task Task) error {
-	// get existing task
-	var orig, err = getTask(db, task.ID)
+// dueLayout is the format due dates are stored and displayed in
+const dueLayout = "2006-01-02"
 
+// formatDue returns a due date in its stored form, or "" if it is not set
+func formatDue(due time.Time) string {
+	if due.IsZero() {
+		return ""
+	}
+	return due.Format(dueLayout)
+}
+
+// parseDue parses a due date, either as YYYY-MM-DD or as an offset in days or weeks from now (e.g. 3d, -1w)
+func parseDue(s string, now time.Time) (time.Time, error) {
+	if due, err := time.Parse(dueLayout, s); err == nil {
+		return due, nil
+	}
+	days, err := parseDayOffset(s)
 	if err != nil {
-		return err
+		return time.Time{}, fmt.Errorf("invalid due date %q (expected YYYY-MM-DD or an offset like 3d or -1w)", s)
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return today.AddDate(0, 0, days), nil
+}
+
+// parseDayOffset parses an offset in days or weeks, such as 3d, +2w or -1d, and returns it in days
+func parseDayOffset(s string) (int, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid offset %q", s)
 	}
-	orig.merge(task)
-
-	// update task
-	updateStatement := `
-        UPDATE tasks
-        SET 
-            name = ?,
-            description = ?,
-            status = ?,
-            type = ?,
-            tag = ?,
-            created = ?
-        WHERE id = ?;`
-	res, err := db.Exec(updateStatement, orig.Name, orig.Desc, orig.Status, orig.Type, orig.Tag, orig.Created.Format(time.RFC3339), orig.ID)
+	n, err := strconv.Atoi(strings.TrimPrefix(s[:len(s)-1], "+"))
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("invalid offset %q", s)
 	}
-	_, err = res.RowsAffected()
+	switch s[len(s)-1] {
+	case 'd':
+		return n, nil
+	case 'w':
+		return 7 * n, nil
+	}
+	return 0, fmt.Errorf("invalid offset %q", s)
+}
+
+// setTaskDue sets the due date of a task, a zero due date clears it
+func setTaskDue(db queryer, id int64, due time.Time) error {
+	_, err := db.Exec(`UPDATE tasks SET due = ?, version = version + 1 WHERE id = ?;`, formatDue(due), id)
 	return err
 }
 
 // row2Task returns a task scanned from a database row
-func row2Task(rows *sql.Rows) (Task, error) {
+// Columns selected after the task columns are scanned into extra.
+func row2Task(rows *sql.Rows, extra ...interface{}) (Task, error) {
 	var task Task
 	var timestr string
-	var err = rows.Scan(&task.ID, &task.Name, &task.Desc, &task.Status, &task.Type, &task.Tag, &timestr)
+	var rank, due sql.NullString
+	var dest = []interface{}{&task.ID, &task.Name, &task.Desc, &task.Status, &task.Type, &task.Tag, &timestr, &rank, &due, &task.Version}
+	var err = rows.Scan(append(dest, extra...)...)
 	if err != nil {
 		return Task{}, err
 	}
@@ -338,22 +488,36 @@ func row2Task(rows *sql.Rows) (Task, error) {
 	if err != nil {
 		return Task{}, err
 	}
+	task.Rank = rank.String
+	if due.String != "" {
+		task.Due, err = time.Parse(dueLayout, due.String)
+		if err != nil {
+			return Task{}, err
+		}
+	}
 	return task, nil
 }
 
 // getTask returns the task with a given id
-func getTask(db *sql.DB, id int64) (Task, error) {
+func getTask(db queryer, id int64) (Task, error) {
 	var row, err = db.Query(`
-        SELECT id, name, description, status, type, tag, created 
+        SELECT id, name, description, status, type, tag, created, rank, due, version
         FROM tasks WHERE id = ?
         LIMIT 1
     `, id)
 	if err != nil {
 		return Task{}, err
 	}
-	row.Next()
-	defer row.Close()
+	if !row.Next() {
+		row.Close()
+		return Task{}, sql.ErrNoRows
+	}
 	task, err := row2Task(row)
+	row.Close()
+	if err != nil {
+		return Task{}, err
+	}
+	task.Fields, err = getTaskFields(db, id)
 	if err != nil {
 		return Task{}, err
 	}
@@ -361,13 +525,19 @@ func getTask(db *sql.DB, id int64) (Task, error) {
 }
 
 // getTasks returns all the tasks in the database
-func getTasks(db *sql.DB) ([]Task, error) {
+func getTasks(db queryer) ([]Task, error) {
+	return queryTasks(db, "1")
+}
+
+// queryTasks returns the tasks matching an SQL condition on the tasks table, e.g. compiled from a filter
+func queryTasks(db queryer, where string, args ...interface{}) ([]Task, error) {
 	// get tasks
 	rows, err := db.Query(`
-        SELECT id, name, description, status, type, tag, created
+        SELECT id, name, description, status, type, tag, created, rank, due, version
         FROM tasks
-        ORDER BY created ASC;
-    `)
+        WHERE `+where+`
+        ORDER BY rank ASC, created ASC;
+    `, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -385,6 +555,10 @@ func getTasks(db *sql.DB) ([]Task, error) {
 	}
 
 	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	err = loadTaskFields(db, tasks)
 	return tasks, err
 }
 
@@ -10,47 +10,6 @@ import (
 	"time"
 )
 
-func TestMerge(t *testing.T) {
-	tests := []struct {
-		new  Task
-		old  Task
-		want Task
-	}{
-		{
-			new: Task{
-				ID:      1,
-				Name:    "name",
-				Tag:     "",
-				Desc:    "test",
-				Status:  invalidStatus,
-				Created: time.Date(2023, 11, 18, 7, 43, 34, 1, time.UTC),
-			},
-			old: Task{
-				ID:      1,
-				Name:    "",
-				Tag:     "tag",
-				Desc:    "",
-				Status:  inProgress,
-				Created: time.Date(2023, 11, 18, 7, 42, 34, 1, time.UTC),
-			},
-			want: Task{
-				ID:      1,
-				Name:    "name",
-				Tag:     "tag",
-				Desc:    "test",
-				Status:  inProgress,
-				Created: time.Date(2023, 11, 18, 7, 42, 34, 1, time.UTC),
-			},
-		},
-	}
-	for _, tc := range tests {
-		tc.old.merge(tc.new)
-		if !reflect.DeepEqual(tc.old, tc.want) {
-			t.Fatalf("got: %#v, want %#v", tc.new, tc.want)
-		}
-	}
-}
-
 func TestAddTask(t *testing.T) {
 
 	var tests = []struct {
@@ -78,7 +37,7 @@ func TestAddTask(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			db = setupTests()
 			defer teardownTests(db)
-			id, err := addTask(db, tt.input.Name, tt.input.Desc, tt.input.Status, tt.input.Type, tt.input.Tag)
+			id, err := addTask(db, tt.input.Name, tt.input.Desc, tt.input.Status, tt.input.Type, tt.input.Tag, time.Time{})
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -89,6 +48,8 @@ func TestAddTask(t *testing.T) {
 			// fields that we don't know in advance
 			tt.want.ID = id
 			tt.want.Created = ans.Created
+			tt.want.Rank = ans.Rank
+			tt.want.Version = 1
 			if !reflect.DeepEqual(ans, tt.want) {
 				t.Errorf("got %v, want %v", ans, tt.want)
 			}
@@ -100,42 +61,42 @@ func TestAddTask(t *testing.T) {
 	}
 }
 
-func TestEditTask(t *testing.T) {
+func TestUpdateTask(t *testing.T) {
+	name, tag, desc, empty := "test2", "x", "asdf", ""
+	progress, initial := inProgress, todo
 
 	var tests = []struct {
 		name  string
-		input Task
+		input TaskPatch
 		want  Task
 	}{
-		{"edit name", Task{Name: "test2"}, Task{Name: "test2", Status: todo}},
-		{"edit tag", Task{Tag: "x"}, Task{Name: "test", Tag: "x", Status: todo}},
-		{"edit status to inProgress", Task{Status: inProgress}, Task{Name: "test", Status: inProgress}},
-		{"edit status to todo", Task{Status: todo}, Task{Name: "test", Status: todo}},
-		{"edit description", Task{Desc: "asdf"}, Task{Name: "test", Status: todo, Desc: "asdf"}},
+		{"edit name", TaskPatch{Name: &name}, Task{Name: "test2", Tag: "tag", Status: todo}},
+		{"edit tag", TaskPatch{Tag: &tag}, Task{Name: "test", Tag: "x", Status: todo}},
+		{"edit status to inProgress", TaskPatch{Status: &progress}, Task{Name: "test", Tag: "tag", Status: inProgress}},
+		{"edit status to todo", TaskPatch{Status: &initial}, Task{Name: "test", Tag: "tag", Status: todo}},
+		{"edit description", TaskPatch{Desc: &desc}, Task{Name: "test", Tag: "tag", Status: todo, Desc: "asdf"}},
+		{"clear tag", TaskPatch{Tag: &empty}, Task{Name: "test", Status: todo}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db = setupTests()
 			defer teardownTests(db)
 			// put task in db
-			id, err := addTask(db, "test", "", todo, generic, "")
+			id, err := addTask(db, "test", "", todo, generic, "tag", time.Time{})
 			if err != nil {
 				log.Fatal(err)
 			}
-			tt.input.ID = id
 			// edit it
-			err = editTask(db, tt.input)
-			if err != nil {
-				log.Fatal(err)
-			}
-			// get updated task
-			ans, err := getTask(db, id)
+			ans, err := updateTask(db, id, 0, tt.input)
 			if err != nil {
 				log.Fatal(err)
 			}
 			// set fields that we don't know in advance
 			tt.want.ID = id
 			tt.want.Created = ans.Created
+			tt.want.Rank = ans.Rank
+			// editing increments the version
+			tt.want.Version = 2
 			if !reflect.DeepEqual(ans, tt.want) {
 				t.Errorf("got %v, want %v", ans, tt.want)
 			}
@@ -160,7 +121,7 @@ func TestDelTask(t *testing.T) {
 			db = setupTests()
 			defer teardownTests(db)
 			// put task in db
-			id, err := addTask(db, "test", "", todo, generic, "")
+			id, err := addTask(db, "test", "", todo, generic, "", time.Time{})
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -172,6 +133,8 @@ func TestDelTask(t *testing.T) {
 			}
 			tt.want.ID = ans.ID
 			tt.want.Created = ans.Created
+			tt.want.Rank = ans.Rank
+			tt.want.Version = 1
 			if !reflect.DeepEqual(ans, tt.want) {
 				t.Errorf("got %v, want %v", ans, tt.want)
 			}
@@ -192,35 +155,44 @@ func TestDelTask(t *testing.T) {
 
 func setupTests() *sql.DB {
 	var dbPath = filepath.Join(os.TempDir(), "test.db")
-	// start the database
+	// start from an empty database
+	os.Remove(dbPath)
 	var db, err = sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if _, err := db.Query("SELECT * FROM tasks"); err == nil {
-
-	} else {
-		sqlStatement := `
-            CREATE TABLE "tasks" (
-                "id" INTEGER NOT NULL PRIMARY KEY,
-                "name" TEXT NOT NULL,
-                "description" TEXT,
-                "status" INTEGER,
-                "type" INTEGER,
-                "created" TEXT,
-                "tag" TEXT
-            );
-            DELETE FROM tasks;
-        `
-		_, err = db.Exec(sqlStatement)
-		if err != nil {
-			log.Fatal(err)
-		}
+	err = initDB(db)
+	if err != nil {
+		log.Fatal(err)
 	}
+	// the tests reuse the names of the tokens, each starts with full buckets
+	clientLimiter, tokenLimiter = newRateLimiter(), newRateLimiter()
 	return db
 }
 
 func teardownTests(db *sql.DB) {
 	db.Close()
 }
+
+func TestParseDue(t *testing.T) {
+	now := time.Date(2023, 11, 18, 23, 43, 34, 0, time.UTC)
+	var tests = []struct {
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2023-12-01", time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC), false},
+		{"3d", time.Date(2023, 11, 21, 0, 0, 0, 0, time.UTC), false},
+		{"+1w", time.Date(2023, 11, 25, 0, 0, 0, 0, time.UTC), false},
+		{"-1d", time.Date(2023, 11, 17, 0, 0, 0, 0, time.UTC), false},
+		{"tomorrow", time.Time{}, true},
+		{"3m", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDue(tt.input, now)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseDue(%q) = %v, %v, want %v", tt.input, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Template is a named set of tasks that can be created together, e.g. a release checklist
+type Template struct {
+	Name  string         // unique template name
+	Desc  string         // optional description
+	Tasks []TemplateTask // the tasks created when the template is applied
+}
+
+// A TemplateTask is the blueprint of a task in a template
+// Its text values may contain {{var}} placeholders, filled in when the template is applied
+type TemplateTask struct {
+	Name   string
+	Desc   string            `json:",omitempty"`
+	Tag    string            `json:",omitempty"`
+	Type   string            `json:",omitempty"` // one of {generic, daily, habit}, generic if empty
+	Due    string            `json:",omitempty"` // offset from the day the template is applied, e.g. 3d or 1w
+	Fields map[string]string `json:",omitempty"` // user-defined field values
+}
+
+// templateVar matches the {{var}} placeholders of a template
+var templateVar = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// validate checks that a template is complete and its tasks have valid types and due offsets
+func (tmpl Template) validate() error {
+	if tmpl.Name == "" {
+		return &fieldError{"Name", fmt.Errorf("template name must not be empty")}
+	}
+	if len(tmpl.Tasks) == 0 {
+		return &fieldError{"Tasks", fmt.Errorf("template %q has no tasks", tmpl.Name)}
+	}
+	for i, t := range tmpl.Tasks {
+		field := fmt.Sprintf("Tasks[%v].", i)
+		if t.Name == "" {
+			return &fieldError{field + "Name", fmt.Errorf("task %v of template %q has no name", i+1, tmpl.Name)}
+		}
+		if t.Type != "" {
+			if _, err := parseTaskType(t.Type); err != nil {
+				return &fieldError{field + "Type", fmt.Errorf("task %q: %w", t.Name, err)}
+			}
+		}
+		if t.Due != "" {
+			if _, err := parseDayOffset(t.Due); err != nil {
+				return &fieldError{field + "Due", fmt.Errorf("task %q: due must be an offset like 3d or 1w: %w", t.Name, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// vars returns the names of the placeholders used in the template, sorted
+func (tmpl Template) vars() []string {
+	var seen = map[string]bool{}
+	var names []string
+	collect := func(s string) {
+		for _, m := range templateVar.FindAllStringSubmatch(s, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				names = append(names, m[1])
+			}
+		}
+	}
+	for _, t := range tmpl.Tasks {
+		collect(t.Name)
+		collect(t.Desc)
+		collect(t.Tag)
+		for _, v := range t.Fields {
+			collect(v)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instantiate returns the tasks of the template with its placeholders filled in from vars
+// and due dates relative to now
+func (tmpl Template) instantiate(vars map[string]string, now time.Time) ([]Task, error) {
+	var missing []string
+	for _, name := range tmpl.vars() {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &fieldError{"Vars", fmt.Errorf("template %q needs a value for %v", tmpl.Name, strings.Join(missing, ", "))}
+	}
+	fill := func(s string) string {
+		return templateVar.ReplaceAllStringFunc(s, func(m string) string {
+			return vars[templateVar.FindStringSubmatch(m)[1]]
+		})
+	}
+
+	var tasks []Task
+	for _, t := range tmpl.Tasks {
+		task := Task{
+			Name:   fill(t.Name),
+			Desc:   fill(t.Desc),
+			Tag:    fill(t.Tag),
+			Status: workflow.initial(),
+			Type:   generic,
+		}
+		if t.Type != "" {
+			task.Type, _ = parseTaskType(t.Type)
+		}
+		if t.Due != "" {
+			due, err := parseDue(t.Due, now)
+			if err != nil {
+				return nil, err
+			}
+			task.Due = due
+		}
+		if len(t.Fields) > 0 {
+			task.Fields = map[string]string{}
+			for k, v := range t.Fields {
+				task.Fields[k] = fill(v)
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// saveTemplate inserts or replaces a template in the database
+func saveTemplate(db *sql.DB, tmpl Template) error {
+	if err := tmpl.validate(); err != nil {
+		return err
+	}
+	tasks, err := json.Marshal(tmpl.Tasks)
+	if err != nil {
+		return err
+	}
+	sqlStatement := `INSERT OR REPLACE INTO templates(name, description, tasks) values (?, ?, ?);`
+	_, err = db.Exec(sqlStatement, tmpl.Name, tmpl.Desc, string(tasks))
+	return err
+}
+
+// delTemplate deletes a template from the database
+func delTemplate(db *sql.DB, name string) error {
+	res, err := db.Exec(`DELETE FROM templates WHERE name = ?;`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// getTemplate returns the template with a given name
+func getTemplate(db *sql.DB, name string) (Template, error) {
+	var tmpl Template
+	var desc sql.NullString
+	var tasks string
+	err := db.QueryRow(`SELECT name, description, tasks FROM templates WHERE name = ?;`, name).Scan(&tmpl.Name, &desc, &tasks)
+	if err != nil {
+		return Template{}, err
+	}
+	tmpl.Desc = desc.String
+	err = json.Unmarshal([]byte(tasks), &tmpl.Tasks)
+	return tmpl, err
+}
+
+// getTemplates returns all the templates, sorted by name
+func getTemplates(db *sql.DB) ([]Template, error) {
+	rows, err := db.Query(`SELECT name, description, tasks FROM templates ORDER BY name ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates = []Template{}
+	for rows.Next() {
+		var tmpl Template
+		var desc sql.NullString
+		var tasks string
+		if err := rows.Scan(&tmpl.Name, &desc, &tasks); err != nil {
+			return nil, err
+		}
+		tmpl.Desc = desc.String
+		if err := json.Unmarshal([]byte(tasks), &tmpl.Tasks); err != nil {
+			return nil, err
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, rows.Err()
+}
+
+// applyTemplate creates the tasks of a template and returns them
+func applyTemplate(db queryer, tmpl Template, vars map[string]string, now time.Time) ([]Task, error) {
+	tasks, err := tmpl.instantiate(vars, now)
+	if err != nil {
+		return nil, err
+	}
+	// validate everything before creating any task
+	for i, task := range tasks {
+		tasks[i].Fields, err = validateFields(db, task.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("task %q: %w", task.Name, err)
+		}
+	}
+	var created []Task
+	for _, task := range tasks {
+		id, err := addTask(db, task.Name, task.Desc, task.Status, task.Type, task.Tag, task.Due)
+		if err != nil {
+			return nil, err
+		}
+		if err = setTaskFields(db, id, task.Fields); err != nil {
+			return nil, err
+		}
+		task, err = getTask(db, id)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, task)
+	}
+	return created, nil
+}
+
+// templateFromTasks returns a template with the given tasks as blueprints
+// Due dates become offsets from now
+func templateFromTasks(name, desc string, tasks []Task, now time.Time) Template {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	tmpl := Template{Name: name, Desc: desc}
+	for _, task := range tasks {
+		t := TemplateTask{Name: task.Name, Desc: task.Desc, Tag: task.Tag, Fields: task.Fields}
+		if task.Type != generic {
+			t.Type = task.Type.String()
+		}
+		if !task.Due.IsZero() {
+			t.Due = fmt.Sprintf("%dd", int(task.Due.Sub(today).Hours()/24))
+		}
+		tmpl.Tasks = append(tmpl.Tasks, t)
+	}
+	return tmpl
+}
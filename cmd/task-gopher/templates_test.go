@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var releaseTemplate = Template{
+	Name: "release",
+	Desc: "release checklist",
+	Tasks: []TemplateTask{
+		{Name: "Tag v{{version}}", Tag: "release", Due: "0d"},
+		{Name: "Announce v{{ version }}", Desc: "mail {{list}}", Type: "daily", Due: "1w"},
+	},
+}
+
+func TestTemplateInstantiate(t *testing.T) {
+	now := time.Date(2023, 11, 18, 7, 43, 34, 0, time.UTC)
+	tasks, err := releaseTemplate.instantiate(map[string]string{"version": "1.4", "list": "users"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Task{
+		{Name: "Tag v1.4", Tag: "release", Status: todo, Type: generic, Due: time.Date(2023, 11, 18, 0, 0, 0, 0, time.UTC)},
+		{Name: "Announce v1.4", Desc: "mail users", Status: todo, Type: daily, Due: time.Date(2023, 11, 25, 0, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(tasks, want) {
+		t.Errorf("got %v, want %v", tasks, want)
+	}
+
+	if _, err := releaseTemplate.instantiate(map[string]string{"version": "1.4"}, now); err == nil {
+		t.Errorf("expected an error for a missing variable")
+	}
+	if got, want := releaseTemplate.vars(), []string{"list", "version"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got vars %v, want %v", got, want)
+	}
+}
+
+func TestTemplateValidate(t *testing.T) {
+	var tests = []struct {
+		name    string
+		tmpl    Template
+		wantErr bool
+	}{
+		{"valid", releaseTemplate, false},
+		{"no tasks", Template{Name: "empty"}, true},
+		{"unknown type", Template{Name: "x", Tasks: []TemplateTask{{Name: "a", Type: "chore"}}}, true},
+		{"absolute due date", Template{Name: "x", Tasks: []TemplateTask{{Name: "a", Due: "2023-11-18"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.tmpl.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyTemplate(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	if err := saveTemplate(db, releaseTemplate); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := getTemplate(db, "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tmpl, releaseTemplate) {
+		t.Errorf("got %v, want %v", tmpl, releaseTemplate)
+	}
+
+	created, err := applyTemplate(db, tmpl, map[string]string{"version": "2.0", "list": "dev"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := getTasks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(created, tasks) {
+		t.Errorf("got %v, want %v", tasks, created)
+	}
+	if len(tasks) != 2 || tasks[1].Name != "Announce v2.0" || tasks[1].Due.IsZero() {
+		t.Errorf("unexpected tasks %v", tasks)
+	}
+
+	if err = delTemplate(db, "release"); err != nil {
+		t.Fatal(err)
+	}
+	if templates, _ := getTemplates(db); len(templates) != 0 {
+		t.Errorf("expected no templates, got %v", templates)
+	}
+}
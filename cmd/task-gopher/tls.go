@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// files of the certificates generated by serve --tls, in dataDir
+const (
+	caCertFile     = "ca.crt"
+	caKeyFile      = "ca.key"
+	serverCertFile = "server.crt"
+	serverKeyFile  = "server.key"
+)
+
+// the generated certificates are renewed this long before they expire
+const renewBefore = 30 * 24 * time.Hour
+
+// ensureCertificates returns the files of a server certificate signed by a self-signed CA, both kept in dir
+// They are created on first use, and the server certificate is renewed with the same key when it is about to expire
+// or doesn't cover one of the hosts, so the fingerprint pinned by the clients stays the same.
+func ensureCertificates(dir string, hosts []string) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, serverCertFile), filepath.Join(dir, serverKeyFile)
+	if cert, err := readCertificate(certFile); err == nil && time.Until(cert.NotAfter) > renewBefore && coversHosts(cert, hosts) {
+		return certFile, keyFile, nil
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", "", err
+	}
+	caCert, caKey, err := ensureCA(dir)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := loadOrCreateKey(keyFile)
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"task-gopher"}, CommonName: hosts[0]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := signCertificate(template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, writePEM(certFile, "CERTIFICATE", der, 0o644)
+}
+
+// ensureCA returns the self-signed CA in dir, creating it if it doesn't exist
+func ensureCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)
+	key, err := loadOrCreateKey(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cert, err := readCertificate(certFile); err == nil {
+		return cert, key, nil
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"task-gopher"}, CommonName: "task-gopher CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := signCertificate(template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = writePEM(certFile, "CERTIFICATE", der, 0o644); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// signCertificate signs a certificate for a public key with a random serial number, and returns it DER encoded
+func signCertificate(template, parent *x509.Certificate, pub *ecdsa.PublicKey, signer *ecdsa.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	return x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+}
+
+// loadOrCreateKey reads the private key in a file, or creates it if the file doesn't exist
+func loadOrCreateKey(file string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writePEM(file, "EC PRIVATE KEY", der, 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not a PEM file", file)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// readCertificate reads the first certificate of a PEM file
+func readCertificate(file string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%v has no certificate", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// writePEM writes a PEM file with a single block
+func writePEM(file, blockType string, der []byte, perm os.FileMode) error {
+	return os.WriteFile(file, encodePEM(blockType, der), perm)
+}
+
+// encodePEM returns a PEM block
+func encodePEM(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+// serverTLSConfig returns the TLS config of the server with a certificate and its key
+// With mtls, the clients must also have a certificate, see mutualTLSConfig.
+func serverTLSConfig(certFile, keyFile string, mtls bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	if mtls {
+		err = mutualTLSConfig(cfg, dataDir)
+	}
+	return cfg, err
+}
+
+// coversHosts reports whether a certificate is valid for all the hosts
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// serverHosts returns the names and addresses the clients may use to reach this server:
+// the host of ADDRESS, the hostname and the addresses of the network interfaces, e.g. on a ZeroTier network
+func serverHosts() []string {
+	hosts := []string{"localhost"}
+	if u, err := url.Parse(os.Getenv("ADDRESS")); err == nil && u.Hostname() != "" && u.Hostname() != "localhost" {
+		hosts = append(hosts, u.Hostname())
+	}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+	// the certificate names each host once
+	seen := map[string]bool{}
+	unique := hosts[:0]
+	for _, h := range hosts {
+		if !seen[h] {
+			seen[h] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique
+}
+
+// fingerprint returns the SSH-style fingerprint of the public key of a certificate, e.g. SHA256:47DEQpj8...
+// It is what the clients pin, so it stays the same when a certificate is renewed with the same key.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// certificateFingerprint returns the fingerprint of the first certificate of a PEM file
+func certificateFingerprint(certFile string) (string, error) {
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint(cert), nil
+}
+
+// dialTLS connects to a server over TLS, checking its certificate with verifyServer
+// It is the TLS dialer of the requests of the CLI.
+func dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: 30 * time.Second}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cfg := &tls.Config{
+		// the certificate is checked by verifyServer instead, which accepts the pinned self-signed ones
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyServer(addr, host, cs)
+		},
+	}
+	if net.ParseIP(host) == nil {
+		cfg.ServerName = host
+	}
+	// servers in mTLS mode ask for the certificate of the device, if it has one
+	cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := loadDeviceCertificate()
+		if cert == nil {
+			return &tls.Certificate{}, err
+		}
+		return cert, nil
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// verifyServer checks the certificate of the server at addr like SSH checks host keys: a certificate trusted by the system
+// is accepted, otherwise its fingerprint must match the one pinned for addr in the client config. The fingerprint of an
+// unknown server is pinned on first use, if the user trusts it.
+func verifyServer(addr, host string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("the server sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	fp := fingerprint(leaf)
+	cfg, err := loadClientConfig()
+	if err != nil {
+		return err
+	}
+	if pinned, ok := cfg.KnownServers[addr]; ok {
+		if pinned == fp {
+			return nil
+		}
+		return fmt.Errorf("the key of %v changed from %v to %v, someone may be impersonating the server. "+
+			"If its certificate was replaced, remove %v from the KnownServers of %v", addr, pinned, fp, addr, clientConfigPath)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates}); err == nil {
+		return nil
+	}
+	// ask once per command, the version negotiation and the request that follows connect to the same server
+	if distrusted[fp] || !trustServer(addr, fp) {
+		distrusted[fp] = true
+		return fmt.Errorf("the certificate of %v is not trusted, check its fingerprint %v by running the command in a terminal", addr, fp)
+	}
+	if cfg.KnownServers == nil {
+		cfg.KnownServers = map[string]string{}
+	}
+	cfg.KnownServers[addr] = fp
+	return cfg.save()
+}
+
+// distrusted are the fingerprints of the certificates the user didn't trust
+var distrusted = map[string]bool{}
+
+// trustServer asks the user whether to trust a server seen for the first time, it can't be asked without a terminal
+var trustServer = func(host, fp string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "The authenticity of %v can't be established.\n", host)
+	fmt.Fprintf(os.Stderr, "Its key fingerprint is %v, compare it with the one printed by task-gopher serve.\n", fp)
+	fmt.Fprint(os.Stderr, "Trust it and remember it (yes/no)? ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(strings.ToLower(answer)) == "yes"
+}
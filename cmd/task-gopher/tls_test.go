@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnsureCertificates(t *testing.T) {
+	dir := t.TempDir()
+	hosts := []string{"localhost", "tasks.example", "10.147.17.5"}
+	certFile, keyFile, err := ensureCertificates(dir, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatalf("the certificate doesn't match its key: %v", err)
+	}
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !coversHosts(cert, hosts) {
+		t.Errorf("got a certificate for %v %v, want one for %v", cert.DNSNames, cert.IPAddresses, hosts)
+	}
+	ca, err := readCertificate(filepath.Join(dir, caCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("the certificate is not signed by the CA: %v", err)
+	}
+
+	// a new host renews the certificate, with the same key
+	renewed, _, err := ensureCertificates(dir, append(hosts, "laptop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert2, err := readCertificate(renewed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert2.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Errorf("the certificate was not renewed for the new host")
+	}
+	if fingerprint(cert2) != fingerprint(cert) {
+		t.Errorf("got fingerprint %v after renewal, want %v", fingerprint(cert2), fingerprint(cert))
+	}
+}
+
+func TestVerifyServer(t *testing.T) {
+	clientConfigPath = filepath.Join(t.TempDir(), "client.json")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	client := &http.Client{Transport: apiTransport(), Timeout: 5 * time.Second}
+
+	var asked []string
+	trust := true
+	trustServer = func(host, fp string) bool {
+		asked = append(asked, host)
+		return trust
+	}
+	// an unknown server is pinned once the user trusts it, then accepted without asking
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		// a new connection is checked again
+		client.CloseIdleConnections()
+	}
+	if len(asked) != 1 {
+		t.Errorf("got asked to trust %v, want to be asked once", asked)
+	}
+	cfg, err := loadClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp := fingerprint(server.Certificate()); asked[0] != server.Listener.Addr().String() || cfg.KnownServers[asked[0]] != fp {
+		t.Errorf("got known servers %v, want %v pinned to %v", cfg.KnownServers, asked[0], fp)
+	}
+
+	// a changed certificate is refused
+	cfg.KnownServers[asked[0]] = "SHA256:other"
+	if err = cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("got error %v for a changed certificate, want it refused", err)
+	}
+
+	// so is an unknown server the user doesn't trust
+	cfg.KnownServers = nil
+	if err = cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+	trust = false
+	if _, err = client.Get(server.URL); err == nil {
+		t.Errorf("got no error for a server that is not trusted")
+	}
+}
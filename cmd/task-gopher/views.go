@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A View is a named filter shared by all clients, e.g. "today" for "due.before:tomorrow status.ne:done"
+// A client can use a view as its context, which then applies to every list and kanban command.
+type View struct {
+	Name   string // unique view name
+	Filter string // the filter expression of the view, see filter.go
+	Desc   string `json:",omitempty"` // optional description
+}
+
+// validate checks that a view has a name and a valid filter on the given fields
+func (v View) validate(defs map[string]FieldDef) error {
+	if v.Name == "" {
+		return &fieldError{"Name", fmt.Errorf("view name must not be empty")}
+	}
+	if strings.ContainsAny(v.Name, " \t\n/") {
+		return &fieldError{"Name", fmt.Errorf("view name %q must not contain spaces or '/'", v.Name)}
+	}
+	node, err := parseFilter(v.Filter)
+	if err != nil {
+		return &fieldError{"Filter", err}
+	}
+	if node == nil {
+		return &fieldError{"Filter", fmt.Errorf("view %q needs a filter", v.Name)}
+	}
+	if _, _, err = compileFilter(node, defs, time.Now()); err != nil {
+		return &fieldError{"Filter", err}
+	}
+	return nil
+}
+
+// saveView inserts or replaces a view in the database
+func saveView(db *sql.DB, v View) error {
+	defs, err := getFields(db)
+	if err != nil {
+		return err
+	}
+	if err = v.validate(defs); err != nil {
+		return err
+	}
+	sqlStatement := `INSERT OR REPLACE INTO views(name, filter, description) values (?, ?, ?);`
+	_, err = db.Exec(sqlStatement, v.Name, v.Filter, v.Desc)
+	return err
+}
+
+// delView deletes a view from the database
+func delView(db *sql.DB, name string) error {
+	res, err := db.Exec(`DELETE FROM views WHERE name = ?;`, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// getView returns the view with a given name
+func getView(db *sql.DB, name string) (View, error) {
+	var v View
+	var desc sql.NullString
+	err := db.QueryRow(`SELECT name, filter, description FROM views WHERE name = ?;`, name).Scan(&v.Name, &v.Filter, &desc)
+	v.Desc = desc.String
+	return v, err
+}
+
+// getViews returns all the views, sorted by name
+func getViews(db *sql.DB) ([]View, error) {
+	rows, err := db.Query(`SELECT name, filter, description FROM views ORDER BY name ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views = []View{}
+	for rows.Next() {
+		var v View
+		var desc sql.NullString
+		if err := rows.Scan(&v.Name, &v.Filter, &desc); err != nil {
+			return nil, err
+		}
+		v.Desc = desc.String
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+// withContext combines the filter of the context view with the filter given on the command line
+func withContext(context View, filter string) string {
+	switch {
+	case context.Filter == "":
+		return filter
+	case strings.TrimSpace(filter) == "":
+		return context.Filter
+	}
+	return "(" + context.Filter + ") and (" + filter + ")"
+}
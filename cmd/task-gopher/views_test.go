@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestSaveView(t *testing.T) {
+	var tests = []struct {
+		name    string
+		view    View
+		wantErr bool
+	}{
+		{"valid view", View{Name: "mine", Filter: "assignee:me status.ne:done", Desc: "my open tasks"}, false},
+		{"empty name", View{Filter: "tag:work"}, true},
+		{"name with spaces", View{Name: "on call", Filter: "tag:ops"}, true},
+		{"empty filter", View{Name: "all"}, true},
+		{"invalid filter", View{Name: "broken", Filter: "(tag:ops"}, true},
+		{"unknown field", View{Name: "unknown", Filter: "owner:me"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db = setupTests()
+			defer teardownTests(db)
+			if err := addField(db, FieldDef{Name: "assignee", Type: fieldString}); err != nil {
+				t.Fatal(err)
+			}
+			err := saveView(db, tt.view)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			views, err := getViews(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if len(views) != 0 {
+					t.Errorf("expected no views, got %v", views)
+				}
+				return
+			}
+			if want := []View{tt.view}; !reflect.DeepEqual(views, want) {
+				t.Errorf("got %v, want %v", views, want)
+			}
+		})
+	}
+}
+
+func TestDelView(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	if err := saveView(db, View{Name: "ops", Filter: "tag:ops"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delView(db, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getView(db, "ops"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+	if err := delView(db, "ops"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	var tests = []struct {
+		context View
+		filter  string
+		want    string
+	}{
+		{View{}, "tag:work", "tag:work"},
+		{View{Name: "mine", Filter: "assignee:me"}, "", "assignee:me"},
+		{View{Name: "mine", Filter: "assignee:me or tag:me"}, "status:todo or status:done", "(assignee:me or tag:me) and (status:todo or status:done)"},
+	}
+	for _, tt := range tests {
+		if got := withContext(tt.context, tt.filter); got != tt.want {
+			t.Errorf("withContext(%v, %q) = %q, want %q", tt.context, tt.filter, got, tt.want)
+		}
+	}
+}
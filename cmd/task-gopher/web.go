@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// webPage is the web app of task-gopher, a single page with a list and a board of the tasks
+// It calls the API of the server that serves it and reloads when /ws tells it the tasks changed.
+//
+//go:embed web.html
+var webPage []byte
+
+// handleWebApp returns the web app
+func handleWebApp(c echo.Context) error {
+	return c.HTMLBlob(http.StatusOK, webPage)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebApp(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+
+	// the page is public, it asks for a token itself
+	rec := httptest.NewRecorder()
+	newServer().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("got Content-Type %q, want text/html", ct)
+	}
+	// the page calls the current version of the API
+	if body := rec.Body.String(); !strings.Contains(body, `const api = "`+apiPrefix+`";`) {
+		t.Errorf("the page doesn't call the API under %v", apiPrefix)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// status category enum, groups the configured statuses by what they mean for a task
+type statusCategory string
+
+const (
+	categoryTodo  statusCategory = "todo"
+	categoryDoing statusCategory = "doing"
+	categoryDone  statusCategory = "done"
+)
+
+// A StatusDef is the configuration of a workflow status
+type StatusDef struct {
+	ID          status         // value stored in the database, must be unique and never reused
+	Name        string         // unique display name
+	Category    statusCategory // one of {todo, doing, done}
+	Transitions []string       `json:",omitempty"` // names of the statuses a task may move to, any if empty
+	Limit       int            `json:",omitempty"` // work-in-progress limit of the status, unlimited if 0
+	UserLimit   int            `json:",omitempty"` // work-in-progress limit for each user, see Config.UserField
+}
+
+// A Workflow is the list of statuses a task goes through, in board order
+type Workflow []StatusDef
+
+// defaultWorkflow is used when no workflow is configured, it matches the original todo/in progress/done enum
+var defaultWorkflow = Workflow{
+	{ID: todo, Name: "todo", Category: categoryTodo},
+	{ID: inProgress, Name: "in progress", Category: categoryDoing},
+	{ID: done, Name: "done", Category: categoryDone},
+}
+
+// workflow is the active workflow; the server reads it from the config and clients fetch it from the server
+var workflow = defaultWorkflow
+
+// A Config holds the server settings read from config.json in the project directory
+type Config struct {
+	Workflow  Workflow `json:",omitempty"` // the statuses of the board, the default workflow if empty
+	UserField string   `json:",omitempty"` // the user-defined field holding the user of a task, for StatusDef.UserLimit
+
+	RequireIfMatch bool `json:",omitempty"` // refuse task updates without an If-Match header, see formatETag
+
+	Limits Limits `json:",omitempty"` // rates and sizes allowed to the clients, see defaultLimits
+}
+
+// userField is the user-defined field that UserLimit applies to
+var userField string
+
+// requireIfMatch makes If-Match mandatory on task updates
+var requireIfMatch bool
+
+// loadConfig reads the config file at path and applies it
+// A missing file is not an error and leaves the defaults in place
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	if len(cfg.Workflow) > 0 {
+		if err = cfg.Workflow.validate(); err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+		workflow = cfg.Workflow
+	}
+	userField = cfg.UserField
+	requireIfMatch = cfg.RequireIfMatch
+	if err = cfg.Limits.validate(); err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	limits = cfg.Limits.withDefaults()
+	return nil
+}
+
+// validate checks that the statuses of a workflow are unique and their transitions exist
+func (w Workflow) validate() error {
+	var ids = map[status]bool{}
+	var names = map[string]bool{}
+	for _, def := range w {
+		if def.ID < 0 {
+			return fmt.Errorf("status %q: ID must not be negative", def.Name)
+		}
+		if def.Name == "" {
+			return fmt.Errorf("status %v: name must not be empty", def.ID)
+		}
+		if ids[def.ID] {
+			return fmt.Errorf("status %q: duplicate ID %v", def.Name, def.ID)
+		}
+		if names[strings.ToLower(def.Name)] {
+			return fmt.Errorf("duplicate status %q", def.Name)
+		}
+		if def.Limit < 0 || def.UserLimit < 0 {
+			return fmt.Errorf("status %q: limits must not be negative", def.Name)
+		}
+		switch def.Category {
+		case categoryTodo, categoryDoing, categoryDone:
+		default:
+			return fmt.Errorf("status %q: unknown category %q (expected todo, doing or done)", def.Name, def.Category)
+		}
+		ids[def.ID] = true
+		names[strings.ToLower(def.Name)] = true
+	}
+	for _, def := range w {
+		for _, t := range def.Transitions {
+			if !names[strings.ToLower(t)] {
+				return fmt.Errorf("status %q: transition to unknown status %q", def.Name, t)
+			}
+		}
+	}
+	return nil
+}
+
+// index returns the position of status s in the workflow, or -1 if it is not part of it
+func (w Workflow) index(s status) int {
+	for i, def := range w {
+		if def.ID == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup returns the definition of status s
+func (w Workflow) lookup(s status) (StatusDef, bool) {
+	if i := w.index(s); i >= 0 {
+		return w[i], true
+	}
+	return StatusDef{}, false
+}
+
+// parse returns the status named by s, either by its name or its ID
+func (w Workflow) parse(s string) (status, error) {
+	for _, def := range w {
+		if strings.EqualFold(def.Name, s) {
+			return def.ID, nil
+		}
+	}
+	if id, err := strconv.Atoi(s); err == nil {
+		if _, ok := w.lookup(status(id)); ok {
+			return status(id), nil
+		}
+	}
+	return invalidStatus, fmt.Errorf("unknown status %q (expected one of %v)", s, strings.Join(w.names(), ", "))
+}
+
+// names returns the names of the statuses in board order
+func (w Workflow) names() []string {
+	var names []string
+	for _, def := range w {
+		names = append(names, def.Name)
+	}
+	return names
+}
+
+// initial returns the status new tasks start in, the first status of the todo category
+func (w Workflow) initial() status {
+	for _, def := range w {
+		if def.Category == categoryTodo {
+			return def.ID
+		}
+	}
+	return w[0].ID
+}
+
+// canTransition reports whether a task may move from status from to status to
+func (w Workflow) canTransition(from, to status) bool {
+	if from == to {
+		return true
+	}
+	target, ok := w.lookup(to)
+	if !ok {
+		return false
+	}
+	def, ok := w.lookup(from)
+	if !ok || len(def.Transitions) == 0 {
+		// tasks in unknown statuses (e.g. after a workflow change) may move anywhere
+		return true
+	}
+	for _, t := range def.Transitions {
+		if strings.EqualFold(t, target.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// A wipLimitError reports that moving a task would exceed a work-in-progress limit
+type wipLimitError struct {
+	Status StatusDef
+	User   string // the user whose limit is reached, empty for the status limit
+	Count  int    // the number of tasks already in the status
+	Limit  int
+}
+
+func (e *wipLimitError) Error() string {
+	if e.User != "" {
+		return fmt.Sprintf("WIP limit reached for %q of %v %q (%v/%v)", e.Status.Name, userField, e.User, e.Count, e.Limit)
+	}
+	return fmt.Sprintf("WIP limit reached for %q (%v/%v)", e.Status.Name, e.Count, e.Limit)
+}
+
+// checkWIPLimit returns a *wipLimitError if a task can't be moved into its status
+// because the status already holds as many tasks as its limits allow
+// The task is given with its new status and fields; orig is the task as it is stored, if any
+func checkWIPLimit(tasks []Task, task Task, orig *Task) error {
+	def, user, ok := wipLimited(task, orig)
+	if !ok {
+		return nil
+	}
+	var count, userCount int
+	for _, t := range tasks {
+		if t.Status != def.ID || t.ID == task.ID {
+			continue
+		}
+		count++
+		if userField != "" && user != "" && t.Fields[userField] == user {
+			userCount++
+		}
+	}
+	return wipLimitReached(def, user, task, orig, count, userCount)
+}
+
+// checkStoredWIPLimit is checkWIPLimit counting the tasks of the status in the database instead
+// It must run in the transaction writing the task, so no other task can fill the status in between.
+func checkStoredWIPLimit(db queryer, task Task, orig *Task) error {
+	def, user, ok := wipLimited(task, orig)
+	if !ok {
+		return nil
+	}
+	var count, userCount int
+	err := db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE status = ? AND id != ?;`, def.ID, task.ID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if userField != "" && user != "" {
+		err = db.QueryRow(`
+            SELECT COUNT(*) FROM tasks
+            JOIN task_fields ON task_fields.task_id = tasks.id AND task_fields.name = ?
+            WHERE tasks.status = ? AND tasks.id != ? AND task_fields.value = ?;`, userField, def.ID, task.ID, user).Scan(&userCount)
+		if err != nil {
+			return err
+		}
+	}
+	return wipLimitReached(def, user, task, orig, count, userCount)
+}
+
+// wipLimited returns the status of a task and its user, and whether the task needs to be counted in their limits
+func wipLimited(task Task, orig *Task) (StatusDef, string, bool) {
+	def, ok := workflow.lookup(task.Status)
+	if !ok || (def.Limit == 0 && def.UserLimit == 0) {
+		return def, "", false
+	}
+	user := task.Fields[userField]
+	if orig != nil && orig.Status == task.Status && (userField == "" || orig.Fields[userField] == user) {
+		// the task is already counted
+		return def, "", false
+	}
+	return def, user, true
+}
+
+// wipLimitReached returns a *wipLimitError if the other tasks of the status, or of its user, fill its limits
+func wipLimitReached(def StatusDef, user string, task Task, orig *Task, count, userCount int) error {
+	if orig == nil || orig.Status != task.Status {
+		if def.Limit > 0 && count >= def.Limit {
+			return &wipLimitError{Status: def, Count: count, Limit: def.Limit}
+		}
+	}
+	if def.UserLimit > 0 && userField != "" && user != "" && userCount >= def.UserLimit {
+		return &wipLimitError{Status: def, User: user, Count: userCount, Limit: def.UserLimit}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var reviewWorkflow = Workflow{
+	{ID: 3, Name: "backlog", Category: categoryTodo, Transitions: []string{"todo"}},
+	{ID: todo, Name: "todo", Category: categoryTodo},
+	{ID: inProgress, Name: "doing", Category: categoryDoing},
+	{ID: 4, Name: "review", Category: categoryDoing, Transitions: []string{"doing", "done"}},
+	{ID: done, Name: "done", Category: categoryDone},
+}
+
+func TestWorkflowNextPrev(t *testing.T) {
+	defer func() { workflow = defaultWorkflow }()
+	workflow = reviewWorkflow
+
+	var tests = []struct {
+		s    status
+		next status
+		prev status
+	}{
+		{3, todo, done},
+		{inProgress, 4, todo},
+		{done, 3, 4},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Next(); got != tt.next {
+			t.Errorf("%v.Next() = %v, want %v", tt.s, got, tt.next)
+		}
+		if got := tt.s.Prev(); got != tt.prev {
+			t.Errorf("%v.Prev() = %v, want %v", tt.s, got, tt.prev)
+		}
+	}
+}
+
+func TestWorkflowParse(t *testing.T) {
+	var tests = []struct {
+		input   string
+		want    status
+		wantErr bool
+	}{
+		{"Review", 4, false},
+		{"4", 4, false},
+		{"backlog", 3, false},
+		{"in progress", invalidStatus, true},
+		{"7", invalidStatus, true},
+	}
+	for _, tt := range tests {
+		got, err := reviewWorkflow.parse(tt.input)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parse(%q) = %v, %v, want %v", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestWorkflowCanTransition(t *testing.T) {
+	var tests = []struct {
+		from, to status
+		want     bool
+	}{
+		{3, todo, true},
+		{3, done, false},
+		{4, done, true},
+		{4, todo, false},
+		{todo, done, true},
+		{todo, 9, false},
+	}
+	for _, tt := range tests {
+		if got := reviewWorkflow.canTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("canTransition(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+	if got := reviewWorkflow.initial(); got != 3 {
+		t.Errorf("initial() = %v, want 3", got)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer func() { workflow = defaultWorkflow }()
+	var tests = []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"valid workflow", `{"Workflow": [{"ID": 0, "Name": "todo", "Category": "todo"}, {"ID": 1, "Name": "done", "Category": "done"}]}`, false},
+		{"duplicate ID", `{"Workflow": [{"ID": 0, "Name": "todo", "Category": "todo"}, {"ID": 0, "Name": "done", "Category": "done"}]}`, true},
+		{"unknown category", `{"Workflow": [{"ID": 0, "Name": "todo", "Category": "later"}]}`, true},
+		{"unknown transition", `{"Workflow": [{"ID": 0, "Name": "todo", "Category": "todo", "Transitions": ["done"]}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workflow = defaultWorkflow
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := loadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(workflow) != 2 {
+				t.Errorf("expected the configured workflow to be active, got %v", workflow)
+			}
+		})
+	}
+}
+
+func TestCheckWIPLimit(t *testing.T) {
+	defer func() { workflow, userField = defaultWorkflow, "" }()
+	workflow = Workflow{
+		{ID: todo, Name: "todo", Category: categoryTodo},
+		{ID: inProgress, Name: "in progress", Category: categoryDoing, Limit: 3, UserLimit: 1},
+		{ID: done, Name: "done", Category: categoryDone},
+	}
+	userField = "assignee"
+	alice := map[string]string{"assignee": "alice"}
+	bob := map[string]string{"assignee": "bob"}
+	tasks := []Task{
+		{ID: 1, Status: inProgress, Fields: alice},
+		{ID: 2, Status: inProgress, Fields: bob},
+		{ID: 3, Status: todo, Fields: alice},
+		{ID: 4, Status: todo},
+		{ID: 5, Status: todo, Fields: map[string]string{"assignee": "carol"}},
+	}
+	var tests = []struct {
+		name    string
+		task    Task
+		wantErr bool
+	}{
+		{"user limit reached", Task{ID: 3, Status: inProgress, Fields: alice}, true},
+		{"unassigned task within the limit", Task{ID: 4, Status: inProgress}, false},
+		{"other user within the limit", Task{ID: 5, Status: inProgress, Fields: map[string]string{"assignee": "carol"}}, false},
+		{"reassigning in the same status", Task{ID: 2, Status: inProgress, Fields: alice}, true},
+		{"unlimited status", Task{ID: 1, Status: done, Fields: alice}, false},
+		{"already counted", Task{ID: 1, Status: inProgress, Fields: alice}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var orig *Task
+			for i := range tasks {
+				if tasks[i].ID == tt.task.ID {
+					orig = &tasks[i]
+				}
+			}
+			err := checkWIPLimit(tasks, tt.task, orig)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the status limit applies to everyone
+	full := append(tasks, Task{ID: 6, Status: inProgress})
+	if err := checkWIPLimit(full, Task{ID: 4, Status: inProgress}, &full[3]); err == nil {
+		t.Errorf("expected the status limit to be reached")
+	}
+}
+
+func TestCheckStoredWIPLimit(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	defer func() { workflow, userField = defaultWorkflow, "" }()
+	workflow = Workflow{
+		{ID: todo, Name: "todo", Category: categoryTodo},
+		{ID: inProgress, Name: "in progress", Category: categoryDoing, Limit: 2, UserLimit: 1},
+		{ID: done, Name: "done", Category: categoryDone},
+	}
+	userField = "assignee"
+	if err := addField(db, FieldDef{Name: "assignee", Type: fieldString}); err != nil {
+		t.Fatal(err)
+	}
+	alice := map[string]string{"assignee": "alice"}
+	tasks := []Task{
+		{Status: inProgress, Fields: alice},
+		{Status: todo, Fields: alice},
+		{Status: todo},
+	}
+	for i, task := range tasks {
+		id, err := addTask(db, "test", "", task.Status, generic, "", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = setTaskFields(db, id, task.Fields); err != nil {
+			t.Fatal(err)
+		}
+		tasks[i].ID = id
+	}
+	var tests = []struct {
+		name    string
+		task    Task
+		orig    *Task
+		wantErr bool
+	}{
+		{"user limit reached", Task{ID: 2, Status: inProgress, Fields: alice}, &tasks[1], true},
+		{"new task of the user", Task{Status: inProgress, Fields: alice}, nil, true},
+		{"unassigned task within the limit", Task{ID: 3, Status: inProgress}, &tasks[2], false},
+		{"already counted", Task{ID: 1, Status: inProgress, Fields: alice}, &tasks[0], false},
+		{"unlimited status", Task{ID: 1, Status: done, Fields: alice}, &tasks[0], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStoredWIPLimit(db, tt.task, tt.orig)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the status limit applies to everyone
+	if _, err := addTask(db, "test", "", inProgress, generic, "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStoredWIPLimit(db, Task{ID: 3, Status: inProgress}, &tasks[2]); err == nil {
+		t.Errorf("expected the status limit to be reached")
+	}
+}
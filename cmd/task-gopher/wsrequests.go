@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// the actions of the requests sent over /ws
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+	actionMove   = "move"
+	actionList   = "list"
+)
+
+// A wsRequest is a request sent by a client over /ws, answered with a wsResponse with the same RequestID
+// The values it needs depend on its action, like the routes of the REST API.
+type wsRequest struct {
+	RequestID string          // chosen by the client to match the response, e.g. a counter
+	Action    string          // one of create, update, delete, move or list
+	ID        int64           `json:",omitempty"` // the task to update, delete or move
+	Task      json.RawMessage `json:",omitempty"` // the NewTask to create, or the JSON Merge Patch of an update
+	Version   int64           `json:",omitempty"` // the version of the task an update is based on, like If-Match
+	Force     bool            `json:",omitempty"` // ignore the work-in-progress limits, like ?force=true
+	After     int64           `json:",omitempty"` // the task to move the task after
+	Before    int64           `json:",omitempty"` // the task to move the task before
+	Filter    string          `json:",omitempty"` // the tasks to list, see GET /tasks
+	Sort      string          `json:",omitempty"`
+	Limit     int             `json:",omitempty"`
+	Cursor    string          `json:",omitempty"`
+}
+
+// A wsResponse answers a wsRequest, with its result or an error
+type wsResponse struct {
+	Type       string    // always "response", to tell the responses from the events
+	RequestID  string    // the RequestID of the request
+	Task       *Task     `json:",omitempty"` // the created, updated, moved or deleted task
+	Tasks      *[]Task   `json:",omitempty"` // the listed tasks, [] if there are none, only in the responses of list
+	NextCursor string    `json:",omitempty"` // where the next page of a list starts, if there is one
+	Error      *APIError `json:",omitempty"`
+	Current    *Task     `json:",omitempty"` // the current task, when an update conflicts with it
+}
+
+// answerRequest runs a request of a websocket client and returns its response
+// The changes are notified to the other clients like those made over HTTP, the client itself only gets the response.
+func answerRequest(client wsClient, msg []byte) wsResponse {
+	origin := changeOrigin{client.id, client.who}
+	var req wsRequest
+	if err := decodeJSON(bytes.NewReader(msg), &req); err != nil {
+		// answer with the RequestID, if there is one
+		json.Unmarshal(msg, &req)
+		return wsErrorResponse(req.RequestID, err)
+	}
+	if wait := tokenLimiter.wait(client.who, tokenRate(client.name), time.Now()); wait > 0 {
+		return wsErrorResponse(req.RequestID, newAPIError(http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("Too many requests, retry in %v", wait.Round(time.Second))))
+	}
+	if req.Action != actionList && client.scope != scopeWrite {
+		return wsErrorResponse(req.RequestID, newAPIError(http.StatusForbidden, codeForbidden, fmt.Sprintf("The %v has the %v scope, which doesn't allow changes", client.who, client.scope)))
+	}
+
+	res := wsResponse{Type: "response", RequestID: req.RequestID}
+	var task Task
+	var err error
+	switch req.Action {
+	case actionCreate:
+		var newTask NewTask
+		if err = req.decodeTask(&newTask); err == nil {
+			task, err = createTask(newTask, req.Force)
+		}
+		if err == nil {
+			notifyChange(origin, taskCreated(task))
+		}
+	case actionUpdate:
+		var body map[string]interface{}
+		var patch TaskPatch
+		var changed []string
+		if err = req.decodeTask(&body); err == nil {
+			patch, err = parseTaskPatch(body, time.Now())
+		}
+		if err == nil {
+			task, changed, err = changeTask(req.ID, req.Version, patch, req.Force)
+		}
+		if err == nil {
+			notifyChange(origin, taskUpdated(task, changed))
+		}
+	case actionDelete:
+		if task, err = removeTask(req.ID); err == nil {
+			notifyChange(origin, taskDeleted(task))
+		}
+	case actionMove:
+		if task, err = placeTask(req.ID, req.After, req.Before); err == nil {
+			notifyChange(origin, taskUpdated(task, []string{"Rank"}))
+		}
+	case actionList:
+		q := TaskQuery{Filter: req.Filter, Sort: req.Sort, Limit: req.Limit, Cursor: req.Cursor}
+		if q.Limit == 0 {
+			q.Limit = defaultPageSize
+		}
+		var tasks []Task
+		tasks, res.NextCursor, err = getTaskPage(db, q)
+		res.Tasks = &tasks
+	default:
+		err = &fieldError{"Action", fmt.Errorf("unknown action %q, expected one of create, update, delete, move or list", req.Action)}
+	}
+	if err != nil {
+		return wsErrorResponse(req.RequestID, err)
+	}
+	if req.Action != actionList {
+		res.Task = &task
+	}
+	return res
+}
+
+// decodeTask decodes the Task of a request into v
+func (req wsRequest) decodeTask(v interface{}) error {
+	if len(req.Task) == 0 {
+		return &fieldError{"Task", fmt.Errorf("the task must be given")}
+	}
+	return decodeJSON(bytes.NewReader(req.Task), v)
+}
+
+// wsErrorResponse returns the response of a request that failed, with the current task if it conflicts with it
+func wsErrorResponse(requestID string, err error) wsResponse {
+	res := wsResponse{Type: "response", RequestID: requestID, Error: toAPIError(err)}
+	if res.Error.cause != nil {
+		log.Println("websocket request", requestID+":", res.Error.Message+":", res.Error.cause)
+	}
+	var conflict *conflictError
+	if errors.As(err, &conflict) {
+		res.Current = &conflict.Current
+	}
+	return res
+}
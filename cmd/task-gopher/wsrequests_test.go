@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebsocket opens a websocket of /ws with a token and reads its hello message
+func dialWebsocket(t *testing.T, serverURL, token string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(serverURL, "http") + apiPrefix + "/ws?access_token=" + token
+	dialer := websocket.Dialer{Subprotocols: []string{eventsProtocol}}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var hello Event
+	if err = ws.ReadJSON(&hello); err != nil || hello.Type != eventConnected {
+		t.Fatalf("got hello %+v, %v", hello, err)
+	}
+	return ws
+}
+
+func TestWebsocketRequests(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	write, err := createToken(db, Token{Name: "kanban", Scope: scopeWrite, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := createToken(db, Token{Name: "dashboard", Scope: scopeRead, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newServer())
+	defer server.Close()
+	ws := dialWebsocket(t, server.URL, write)
+
+	send := func(ws *websocket.Conn, msg string) wsResponse {
+		t.Helper()
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		var res wsResponse
+		if err := ws.ReadJSON(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Type != "response" {
+			t.Fatalf("got %+v, want a response", res)
+		}
+		return res
+	}
+
+	res := send(ws, `{"RequestID": "1", "Action": "create", "Task": {"Name": "deploy", "Tag": "work"}}`)
+	if res.RequestID != "1" || res.Error != nil || res.Task == nil || res.Task.Name != "deploy" {
+		t.Fatalf("got create response %+v", res)
+	}
+	task := *res.Task
+	other := send(ws, `{"RequestID": "2", "Action": "create", "Task": {"Name": "review"}}`).Task
+
+	res = send(ws, `{"RequestID": "3", "Action": "list", "Filter": "tag:work"}`)
+	if res.Error != nil || res.Tasks == nil || len(*res.Tasks) != 1 || (*res.Tasks)[0].ID != task.ID || res.NextCursor != "" {
+		t.Errorf("got list response %+v", res)
+	}
+	// an empty page has its Tasks, unlike the responses of the other actions
+	client := wsClient{id: "cli-1", who: "token kanban", name: "kanban", scope: scopeWrite}
+	if msg, _ := json.Marshal(answerRequest(client, []byte(`{"RequestID": "3", "Action": "list", "Filter": "tag:none"}`))); !strings.Contains(string(msg), `"Tasks":[]`) {
+		t.Errorf("got empty list response %s, want its Tasks", msg)
+	}
+
+	res = send(ws, fmt.Sprintf(`{"RequestID": "4", "Action": "update", "ID": %v, "Version": %v, "Task": {"Tag": null}}`, task.ID, task.Version))
+	if res.Error != nil || res.Task.Tag != "" || res.Task.Version != task.Version+1 {
+		t.Errorf("got update response %+v", res)
+	}
+
+	res = send(ws, fmt.Sprintf(`{"RequestID": "5", "Action": "move", "ID": %v, "Before": %v}`, task.ID, other.ID))
+	if res.Error != nil || res.Task.Rank >= other.Rank {
+		t.Errorf("got move response %+v, want a rank before %v", res, other.Rank)
+	}
+
+	// each request gets its own error, the connection stays open
+	var tests = []struct {
+		name      string
+		ws        *websocket.Conn
+		msg       string
+		wantID    string
+		wantCode  string
+		wantField string
+	}{
+		{"invalid JSON", ws, `{"RequestID": "6", "Action":`, "", codeInvalidRequest, ""},
+		{"unknown value", ws, `{"RequestID": "7", "Action": "list", "Page": 2}`, "7", codeInvalidValue, "Page"},
+		{"unknown action", ws, `{"RequestID": "8", "Action": "rename"}`, "8", codeInvalidValue, "Action"},
+		{"no task", ws, `{"RequestID": "9", "Action": "create"}`, "9", codeInvalidValue, "Task"},
+		{"invalid task", ws, `{"RequestID": "10", "Action": "create", "Task": {"Name": ""}}`, "10", codeInvalidValue, "Name"},
+		{"old version", ws, fmt.Sprintf(`{"RequestID": "11", "Action": "update", "ID": %v, "Version": 1, "Task": {"Name": "x"}}`, task.ID), "11", codeVersionConflict, ""},
+		{"missing task", ws, `{"RequestID": "12", "Action": "delete", "ID": 999}`, "12", codeNotFound, ""},
+		{"invalid filter", ws, `{"RequestID": "13", "Action": "list", "Filter": "(tag:work"}`, "13", codeInvalidQuery, ""},
+		{"read token", dialWebsocket(t, server.URL, read), fmt.Sprintf(`{"RequestID": "14", "Action": "delete", "ID": %v}`, task.ID), "14", codeForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := send(tt.ws, tt.msg)
+			if res.RequestID != tt.wantID || res.Error == nil || res.Error.Code != tt.wantCode || res.Error.Field != tt.wantField {
+				t.Errorf("got response %+v with error %+v, want %v %v on %q", res, res.Error, tt.wantCode, tt.wantField, tt.wantID)
+			}
+		})
+	}
+	if res := send(ws, `{"RequestID": "15", "Action": "update", "ID": `+fmt.Sprint(task.ID)+`, "Version": 1, "Task": {"Name": "x"}}`); res.Current == nil || res.Current.ID != task.ID {
+		t.Errorf("got conflict response %+v, want the current task", res)
+	}
+
+	res = send(ws, fmt.Sprintf(`{"RequestID": "16", "Action": "delete", "ID": %v}`, task.ID))
+	if res.Error != nil || res.Task.ID != task.ID {
+		t.Errorf("got delete response %+v", res)
+	}
+}
+
+func TestAnswerRequestNotifies(t *testing.T) {
+	db = setupTests()
+	defer teardownTests(db)
+	changed, stop := changes.subscribe()
+	defer stop()
+
+	client := wsClient{id: "cli-1", who: "token kanban", name: "kanban", scope: scopeWrite}
+	res := answerRequest(client, []byte(`{"RequestID": "1", "Action": "create", "Task": {"Name": "deploy"}}`))
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change was not notified")
+	}
+
+	// listing changes nothing
+	answerRequest(client, []byte(`{"RequestID": "2", "Action": "list"}`))
+	select {
+	case <-changed:
+		t.Error("a list was notified as a change")
+	default:
+	}
+}